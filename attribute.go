@@ -0,0 +1,131 @@
+package saml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attribute name formats, which say how the Name of an Attribute or of a
+// RequestedAttribute is to be interpreted. See SAMLCore section 8.2.
+const (
+	UnspecifiedAttributeNameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+	URIAttributeNameFormat         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	BasicAttributeNameFormat       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+)
+
+// integerTypes are the XML Schema types derived from xs:integer whose values
+// fit in an int64.
+var integerTypes = map[string]bool{
+	"integer":            true,
+	"long":               true,
+	"int":                true,
+	"short":              true,
+	"byte":               true,
+	"nonNegativeInteger": true,
+	"nonPositiveInteger": true,
+	"positiveInteger":    true,
+	"negativeInteger":    true,
+	"unsignedInt":        true,
+	"unsignedShort":      true,
+	"unsignedByte":       true,
+}
+
+// TypeName returns the local part of the xsi:type of the value, for example
+// "boolean" for "xs:boolean", or "" if the value has no declared type.
+func (v *AttributeValue) TypeName() string {
+	return v.Type[strings.LastIndex(v.Type, ":")+1:]
+}
+
+// TypedValue returns the value parsed according to its xsi:type, as a bool
+// for xs:boolean, an int64 for xs:integer and the types derived from it, and
+// a time.Time for xs:dateTime. Values of other types, values without a type,
+// and values that are not valid for their declared type are returned as the
+// raw string.
+func (v *AttributeValue) TypedValue() interface{} {
+	var rv interface{}
+	var err error
+	switch typeName := v.TypeName(); {
+	case typeName == "boolean":
+		rv, err = parseBool(v.Value)
+	case integerTypes[typeName]:
+		rv, err = parseInt(v.Value)
+	case typeName == "dateTime":
+		rv, err = parseDateTime(v.Value)
+	default:
+		return v.Value
+	}
+	if err != nil {
+		return v.Value
+	}
+	return rv
+}
+
+// GetBool returns the first value of the attribute parsed as an
+// xs:boolean, which is one of "true", "false", "1" or "0". Some IDPs send
+// flags this way without declaring the type, so the value is parsed
+// whatever its xsi:type.
+func (a *Attribute) GetBool() (bool, error) {
+	value, err := a.firstValue()
+	if err != nil {
+		return false, err
+	}
+	return parseBool(value)
+}
+
+// GetInt returns the first value of the attribute parsed as an xs:integer.
+func (a *Attribute) GetInt() (int64, error) {
+	value, err := a.firstValue()
+	if err != nil {
+		return 0, err
+	}
+	return parseInt(value)
+}
+
+// GetTime returns the first value of the attribute parsed as an
+// xs:dateTime. Values without a time zone are taken to be in UTC.
+func (a *Attribute) GetTime() (time.Time, error) {
+	value, err := a.firstValue()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseDateTime(value)
+}
+
+func (a *Attribute) firstValue() (string, error) {
+	if len(a.Values) == 0 {
+		return "", fmt.Errorf("attribute %q has no values", a.Name)
+	}
+	return a.Values[0].Value, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.TrimSpace(value) {
+	case "true", "1":
+		return true, nil
+	case "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a valid xs:boolean", value)
+}
+
+func parseInt(value string) (int64, error) {
+	rv, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid xs:integer", value)
+	}
+	return rv, nil
+}
+
+func parseDateTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("%q is not a valid xs:dateTime", value)
+	}
+	var rv RelaxedTime
+	if err := rv.UnmarshalText([]byte(value)); err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a valid xs:dateTime", value)
+	}
+	return time.Time(rv), nil
+}
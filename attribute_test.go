@@ -0,0 +1,81 @@
+package saml
+
+import (
+	"encoding/xml"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AttributeTest{})
+
+type AttributeTest struct {
+}
+
+func (test *AttributeTest) TestTypedValue(c *C) {
+	input := `<saml:Attribute xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" Name="test">` +
+		`<saml:AttributeValue xsi:type="xs:boolean">true</saml:AttributeValue>` +
+		`<saml:AttributeValue xsi:type="xs:integer"> 42 </saml:AttributeValue>` +
+		`<saml:AttributeValue xsi:type="xsd:unsignedShort">7</saml:AttributeValue>` +
+		`<saml:AttributeValue xsi:type="xs:dateTime">2015-12-01T01:57:09Z</saml:AttributeValue>` +
+		`<saml:AttributeValue xsi:type="xs:string">1</saml:AttributeValue>` +
+		`<saml:AttributeValue>untyped</saml:AttributeValue>` +
+		`<saml:AttributeValue xsi:type="xs:boolean">maybe</saml:AttributeValue>` +
+		`<saml:AttributeValue xsi:type="xs:anyURI">https://example.com/</saml:AttributeValue>` +
+		`</saml:Attribute>`
+	attribute := Attribute{}
+	err := xml.Unmarshal([]byte(input), &attribute)
+	c.Assert(err, IsNil)
+
+	var values []interface{}
+	for _, value := range attribute.Values {
+		values = append(values, value.TypedValue())
+	}
+	c.Assert(values, DeepEquals, []interface{}{
+		true,
+		int64(42),
+		int64(7),
+		time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC),
+		"1",
+		"untyped",
+		"maybe",
+		"https://example.com/",
+	})
+	c.Assert(attribute.Values[0].TypeName(), Equals, "boolean")
+	c.Assert(attribute.Values[5].TypeName(), Equals, "")
+}
+
+func (test *AttributeTest) TestGetters(c *C) {
+	attribute := Attribute{Name: "flag", Values: []AttributeValue{{Type: "xs:boolean", Value: "1"}}}
+	b, err := attribute.GetBool()
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, true)
+
+	// the value is parsed even if the IDP does not declare its type
+	attribute = Attribute{Name: "flag", Values: []AttributeValue{{Value: "false"}}}
+	b, err = attribute.GetBool()
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, false)
+
+	attribute = Attribute{Name: "count", Values: []AttributeValue{{Type: "xs:int", Value: "-3"}, {Value: "4"}}}
+	i, err := attribute.GetInt()
+	c.Assert(err, IsNil)
+	c.Assert(i, Equals, int64(-3))
+	_, err = attribute.GetBool()
+	c.Assert(err, ErrorMatches, "\"-3\" is not a valid xs:boolean")
+
+	attribute = Attribute{Name: "expires", Values: []AttributeValue{{Type: "xs:dateTime", Value: "2015-12-01T01:57:09.123+01:00"}}}
+	t, err := attribute.GetTime()
+	c.Assert(err, IsNil)
+	c.Assert(t.UTC(), Equals, time.Date(2015, 12, 1, 0, 57, 9, 123000000, time.UTC))
+	_, err = attribute.GetInt()
+	c.Assert(err, ErrorMatches, "\"2015-12-01T01:57:09.123\\+01:00\" is not a valid xs:integer")
+
+	attribute = Attribute{Name: "expires", Values: []AttributeValue{{Value: "tomorrow"}}}
+	_, err = attribute.GetTime()
+	c.Assert(err, ErrorMatches, "\"tomorrow\" is not a valid xs:dateTime")
+
+	attribute = Attribute{Name: "empty"}
+	_, err = attribute.GetBool()
+	c.Assert(err, ErrorMatches, "attribute \"empty\" has no values")
+}
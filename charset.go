@@ -0,0 +1,96 @@
+package saml
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// CharsetReader returns a reader that converts input, a document encoded
+// in charset, to UTF-8. It is used to parse responses and metadata whose
+// XML declaration specifies an encoding other than UTF-8.
+//
+// The default supports ISO-8859-1 and US-ASCII. To support other charsets,
+// set it to, for example, the NewReaderLabel function of the package
+// golang.org/x/net/html/charset.
+var CharsetReader = defaultCharsetReader
+
+// defaultCharsetReader implements CharsetReader for ISO-8859-1 and the
+// subset of it that is US-ASCII.
+func defaultCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "l1", "us-ascii", "ascii":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// latin1Reader converts ISO-8859-1, in which each byte is the code point
+// of a character, to UTF-8.
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf [utf8.UTFMax]byte
+	n   int
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if l.n > 0 {
+			copied := copy(p[i:], l.buf[:l.n])
+			copy(l.buf[:], l.buf[copied:l.n])
+			l.n -= copied
+			i += copied
+			continue
+		}
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		l.n = utf8.EncodeRune(l.buf[:], rune(b))
+	}
+	return i, nil
+}
+
+// xmlDeclarationEncodingRegexp matches the encoding declared by the XML
+// declaration at the start of a document.
+var xmlDeclarationEncodingRegexp = regexp.MustCompile(`^\s*<\?xml[^>]*?\sencoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+
+// decodeCharset returns buf, an XML document, encoded in UTF-8. If its XML
+// declaration specifies another encoding, the document is converted with
+// CharsetReader and the declaration is changed to specify UTF-8, so that
+// the result can be parsed by decoders that assume UTF-8.
+//
+// Signatures remain valid, because they are computed over the canonical
+// form of the document, which is always encoded in UTF-8.
+func decodeCharset(buf []byte) ([]byte, error) {
+	m := xmlDeclarationEncodingRegexp.FindSubmatchIndex(buf)
+	if m == nil {
+		return buf, nil
+	}
+	charset := string(buf[m[2]:m[3]])
+	if strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "utf8") {
+		return buf, nil
+	}
+
+	r, err := CharsetReader(charset, bytes.NewReader(buf[m[3]:]))
+	if err != nil {
+		return nil, err
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]byte, 0, m[2]+len("UTF-8")+len(rest))
+	rv = append(rv, buf[:m[2]]...)
+	rv = append(rv, "UTF-8"...)
+	return append(rv, rest...), nil
+}
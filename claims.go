@@ -0,0 +1,118 @@
+package saml
+
+// defaultClaimAttributeNames maps the claims produced by Assertion.Claims
+// to the names of the attributes that may hold them, in order of
+// preference.
+var defaultClaimAttributeNames = map[string][]string{
+	"email": {
+		"email",
+		"mail",
+		"emailAddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	},
+	"name": {
+		"name",
+		"displayName",
+		"cn",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"urn:oid:2.5.4.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+	},
+	"groups": {
+		"groups",
+		"memberOf",
+		"isMemberOf",
+		"urn:oid:1.3.6.1.4.1.5923.1.5.1.1",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups",
+	},
+}
+
+// Claims returns the contents of the assertion as a map of claims in the
+// style of OpenID Connect:
+//
+//	iss     the Issuer
+//	sub     the value of the Subject's NameID
+//	iat     the IssueInstant, in seconds since the epoch
+//	exp     the NotOnOrAfter of the Conditions, in seconds since the epoch
+//	email   the first value of the email attribute
+//	name    the first value of the name attribute
+//	groups  all the values of the groups attribute, as a []string
+//
+// The attributes are found using the names returned by
+// DefaultClaimAttributeNames. Claims for which the assertion has no value
+// are omitted.
+//
+// Claims does not validate the assertion, so it should only be used on
+// assertions returned by ParseResponse.
+func (a *Assertion) Claims() map[string]interface{} {
+	return a.ClaimsWithAttributeNames(defaultClaimAttributeNames)
+}
+
+// DefaultClaimAttributeNames returns a copy of the names of the attributes
+// that Assertion.Claims uses, which can be modified and passed to
+// ClaimsWithAttributeNames to suit IDPs that use other names.
+func DefaultClaimAttributeNames() map[string][]string {
+	rv := map[string][]string{}
+	for claim, names := range defaultClaimAttributeNames {
+		rv[claim] = append([]string(nil), names...)
+	}
+	return rv
+}
+
+// ClaimsWithAttributeNames is like Claims, but finds the attributes using
+// attributeNames, which maps each claim to the names of the attributes that
+// may hold it, in order of preference. An attribute matches if either its
+// Name or FriendlyName is equal to one of the names. Claims other than
+// groups hold the first value of the matching attribute.
+func (a *Assertion) ClaimsWithAttributeNames(attributeNames map[string][]string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if a.Issuer.Value != "" {
+		claims["iss"] = a.Issuer.Value
+	}
+	if a.Subject != nil && a.Subject.NameID != nil && a.Subject.NameID.Value != "" {
+		claims["sub"] = a.Subject.NameID.Value
+	}
+	if !a.IssueInstant.IsZero() {
+		claims["iat"] = a.IssueInstant.Unix()
+	}
+	if a.Conditions != nil && !a.Conditions.NotOnOrAfter.IsZero() {
+		claims["exp"] = a.Conditions.NotOnOrAfter.Unix()
+	}
+	for claim, names := range attributeNames {
+		values := a.attributeValues(names)
+		if len(values) == 0 {
+			continue
+		}
+		if claim == "groups" {
+			claims[claim] = values
+		} else {
+			claims[claim] = values[0]
+		}
+	}
+	return claims
+}
+
+// attributeValues returns the values of the first of names that matches an
+// attribute of the assertion.
+func (a *Assertion) attributeValues(names []string) []string {
+	for _, name := range names {
+		var values []string
+		found := false
+		for _, attributeStatement := range a.AttributeStatements {
+			for _, attr := range attributeStatement.Attributes {
+				if attr.Name != name && attr.FriendlyName != name {
+					continue
+				}
+				found = true
+				for _, value := range attr.Values {
+					values = append(values, value.Value)
+				}
+			}
+		}
+		if found {
+			return values
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package saml
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ClaimsTest{})
+
+type ClaimsTest struct {
+}
+
+func (test *ClaimsTest) TestClaims(c *C) {
+	issueInstant := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	assertion := Assertion{
+		IssueInstant: issueInstant,
+		Issuer:       Issuer{Value: "https://idp.example.com/"},
+		Subject:      &Subject{NameID: &NameID{Value: "alice"}},
+		Conditions:   &Conditions{NotOnOrAfter: issueInstant.Add(time.Hour)},
+		AttributeStatements: []AttributeStatement{
+			{
+				Attributes: []Attribute{
+					{
+						Name:         "urn:oid:0.9.2342.19200300.100.1.3",
+						FriendlyName: "mail",
+						Values:       []AttributeValue{{Value: "alice@example.com"}},
+					},
+					{
+						Name:   "displayName",
+						Values: []AttributeValue{{Value: "Alice Smith"}},
+					},
+					{
+						Name:   "cn",
+						Values: []AttributeValue{{Value: "alice"}},
+					},
+					{
+						Name:   "memberOf",
+						Values: []AttributeValue{{Value: "admins"}, {Value: "staff"}},
+					},
+				},
+			},
+		},
+	}
+
+	c.Assert(assertion.Claims(), DeepEquals, map[string]interface{}{
+		"iss":    "https://idp.example.com/",
+		"sub":    "alice",
+		"iat":    issueInstant.Unix(),
+		"exp":    issueInstant.Add(time.Hour).Unix(),
+		"email":  "alice@example.com",
+		"name":   "Alice Smith",
+		"groups": []string{"admins", "staff"},
+	})
+
+	c.Assert((&Assertion{}).Claims(), DeepEquals, map[string]interface{}{})
+}
+
+func (test *ClaimsTest) TestClaimAttributeNamesCanBeOverridden(c *C) {
+	attributeNames := DefaultClaimAttributeNames()
+	attributeNames["name"] = []string{"cn"}
+	attributeNames["groups"] = []string{"roles"}
+
+	assertion := Assertion{
+		AttributeStatements: []AttributeStatement{
+			{
+				Attributes: []Attribute{
+					{Name: "displayName", Values: []AttributeValue{{Value: "Alice Smith"}}},
+					{Name: "cn", Values: []AttributeValue{{Value: "alice"}}},
+					{Name: "roles", Values: []AttributeValue{{Value: "admin"}}},
+				},
+			},
+		},
+	}
+	c.Assert(assertion.ClaimsWithAttributeNames(attributeNames), DeepEquals, map[string]interface{}{
+		"name":   "alice",
+		"groups": []string{"admin"},
+	})
+
+	// the defaults are not modified
+	c.Assert(assertion.Claims(), DeepEquals, map[string]interface{}{
+		"name": "Alice Smith",
+	})
+}
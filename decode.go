@@ -0,0 +1,71 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// DecodePOSTMessage returns the XML of a SAMLRequest or SAMLResponse sent
+// with the HTTP-POST binding, which base64 encodes it. It is meant for
+// debugging, for example to inspect a SAMLResponse captured in the
+// browser, so encoded may be the value of the parameter or a whole
+// captured form body or URL, and may be URL encoded or broken into lines.
+func DecodePOSTMessage(encoded string) ([]byte, error) {
+	buf, err := base64.StdEncoding.DecodeString(capturedMessage(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode base64: %s", err)
+	}
+	return buf, nil
+}
+
+// DecodeRedirectMessage returns the XML of a SAMLRequest or SAMLResponse
+// sent with the HTTP-Redirect binding, which DEFLATE compresses and base64
+// encodes it. Like DecodePOSTMessage, it is meant for debugging, and
+// encoded may be the value of the parameter or a whole captured URL.
+func DecodeRedirectMessage(encoded string) ([]byte, error) {
+	compressed, err := DecodePOSTMessage(encoded)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := inflate(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress: %s", err)
+	}
+	return buf, nil
+}
+
+// inflate decompresses buf, a message compressed with DEFLATE as the
+// HTTP-Redirect binding requires.
+func inflate(buf []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(buf)))
+}
+
+// capturedMessage returns the base64 encoded message in s, which is either
+// the value of the SAMLRequest or SAMLResponse parameter, or a URL, query
+// string or form body in which the value of that parameter is found. The
+// value is URL decoded if it contains escapes, and whitespace is removed.
+// A plus sign is kept as it is, rather than decoded as a space, since it
+// is one of the characters of base64.
+func capturedMessage(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		s = s[i+1:]
+	}
+	for _, param := range strings.Split(s, "&") {
+		if strings.HasPrefix(param, "SAMLRequest=") || strings.HasPrefix(param, "SAMLResponse=") {
+			s = param[strings.IndexByte(param, '=')+1:]
+			break
+		}
+	}
+	if strings.Contains(s, "%") {
+		if unescaped, err := url.QueryUnescape(strings.Replace(s, "+", "%2B", -1)); err == nil {
+			s = unescaped
+		}
+	}
+	return whitespaceRegexp.ReplaceAllString(s, "")
+}
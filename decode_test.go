@@ -0,0 +1,61 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&DecodeTest{})
+
+type DecodeTest struct {
+}
+
+const decodeTestMessage = `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-00020406080a0c0e10121416181a1c1e" Version="2.0"></samlp:AuthnRequest>`
+
+func (test *DecodeTest) TestDecodePOSTMessage(c *C) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(decodeTestMessage))
+
+	for _, captured := range []string{
+		encoded,
+		"  " + encoded[:40] + "\r\n" + encoded[40:] + "\n",
+		url.QueryEscape(encoded),
+		"RelayState=abc&SAMLResponse=" + url.QueryEscape(encoded),
+	} {
+		buf, err := DecodePOSTMessage(captured)
+		c.Assert(err, IsNil)
+		c.Assert(string(buf), Equals, decodeTestMessage)
+	}
+
+	_, err := DecodePOSTMessage("<samlp:Response/>")
+	c.Assert(err, ErrorMatches, "cannot decode base64: illegal base64 data at input byte 0")
+}
+
+func (test *DecodeTest) TestDecodeRedirectMessage(c *C) {
+	compressed := bytes.Buffer{}
+	w, err := flate.NewWriter(&compressed, flate.BestCompression)
+	c.Assert(err, IsNil)
+	w.Write([]byte(decodeTestMessage))
+	c.Assert(w.Close(), IsNil)
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+
+	for _, captured := range []string{
+		encoded,
+		url.QueryEscape(encoded),
+		"https://idp.example.com/sso?SAMLRequest=" + url.QueryEscape(encoded) + "&RelayState=abc",
+	} {
+		buf, err := DecodeRedirectMessage(captured)
+		c.Assert(err, IsNil)
+		c.Assert(string(buf), Equals, decodeTestMessage)
+	}
+
+	_, err = DecodeRedirectMessage("!")
+	c.Assert(err, ErrorMatches, "cannot decode base64: illegal base64 data at input byte 0")
+
+	// a message sent with the HTTP-POST binding is not compressed
+	_, err = DecodeRedirectMessage(base64.StdEncoding.EncodeToString([]byte(decodeTestMessage)))
+	c.Assert(err, ErrorMatches, "cannot decompress: flate: corrupt input before offset .*")
+}
@@ -126,3 +126,17 @@ func (d *Duration) UnmarshalText(text []byte) error {
 	*d = Duration(sign * out)
 	return nil
 }
+
+// optionalDuration is a Duration that is zero, rather than an error, if the
+// text is not a valid xsd:duration.
+type optionalDuration Duration
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *optionalDuration) UnmarshalText(text []byte) error {
+	var v Duration
+	if err := v.UnmarshalText(text); err != nil {
+		v = 0
+	}
+	*d = optionalDuration(v)
+	return nil
+}
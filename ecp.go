@@ -0,0 +1,202 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// PAOSContentType is the media type of the messages of the PAOS binding.
+const PAOSContentType = "application/vnd.paos+xml"
+
+// ECPService is the URN that identifies the ECP profile in the PAOS header
+// of an enhanced client's request, and in the PAOS request of the SP.
+const ECPService = "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"
+
+const (
+	soapEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soapActorNext         = "http://schemas.xmlsoap.org/soap/actor/next"
+	paosNamespace         = "urn:liberty:paos:2003-08"
+)
+
+// maxECPResponseSize limits the size of the SOAP envelope that
+// ParseECPResponse reads.
+const maxECPResponseSize = 1 << 20
+
+// IsECPRequest returns true if req is from an Enhanced Client or Proxy
+// (ECP) that is able to authenticate with the PAOS binding, which it
+// signals with an Accept header that includes PAOSContentType and a PAOS
+// header that names ECPService. See section 4.2.3.1 of SAMLProfiles.
+func IsECPRequest(req *http.Request) bool {
+	if !strings.Contains(req.Header.Get("Accept"), PAOSContentType) {
+		return false
+	}
+	paos := req.Header.Get("PAOS")
+	return strings.Contains(paos, paosNamespace) && strings.Contains(paos, ECPService)
+}
+
+// MakeECPAuthenticationRequest produces a new AuthnRequest for an Enhanced
+// Client or Proxy, which asks for the response to be sent to AcsURL with
+// the PAOS binding. Its PAOS method produces the SOAP message to send to
+// the client. The IDP must allow the PAOS binding for AcsURL, which is
+// advertised in our metadata if sp.ECP is set.
+func (sp *ServiceProvider) MakeECPAuthenticationRequest() (*AuthnRequest, error) {
+	idpURL, err := sp.ssoBindingLocation(SOAPBinding)
+	if err != nil {
+		return nil, err
+	}
+	return sp.makeAuthenticationRequest(idpURL, PAOSBinding, PAOSBinding, ecpACSIndex)
+}
+
+// PAOS returns the SOAP message that carries req to an Enhanced Client or
+// Proxy, which is sent with the content type PAOSContentType in response to
+// a request for which IsECPRequest is true. The message has the paos:Request
+// and ecp:Request headers required by section 4.2.4.2 of SAMLProfiles and,
+// if relayState is not empty, an ecp:RelayState header, which the client
+// returns along with the response.
+func (req *AuthnRequest) PAOS(relayState string) []byte {
+	envelopeEl := etree.NewElement("S:Envelope")
+	envelopeEl.CreateAttr("xmlns:S", soapEnvelopeNamespace)
+	headerEl := envelopeEl.CreateElement("S:Header")
+
+	paosRequestEl := headerEl.CreateElement("paos:Request")
+	paosRequestEl.CreateAttr("xmlns:paos", paosNamespace)
+	paosRequestEl.CreateAttr("S:actor", soapActorNext)
+	paosRequestEl.CreateAttr("S:mustUnderstand", "1")
+	paosRequestEl.CreateAttr("responseConsumerURL", req.AssertionConsumerServiceURL)
+	paosRequestEl.CreateAttr("service", ECPService)
+
+	ecpRequestEl := headerEl.CreateElement("ecp:Request")
+	ecpRequestEl.CreateAttr("xmlns:ecp", ECPService)
+	ecpRequestEl.CreateAttr("S:actor", soapActorNext)
+	ecpRequestEl.CreateAttr("S:mustUnderstand", "1")
+	if req.IsPassive != nil && *req.IsPassive {
+		ecpRequestEl.CreateAttr("IsPassive", "1")
+	} else {
+		ecpRequestEl.CreateAttr("IsPassive", "0")
+	}
+	if req.ProviderName != "" {
+		ecpRequestEl.CreateAttr("ProviderName", req.ProviderName)
+	}
+	if req.Issuer != nil {
+		issuerEl := req.Issuer.Element()
+		issuerEl.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+		ecpRequestEl.AddChild(issuerEl)
+	}
+
+	if relayState != "" {
+		relayStateEl := headerEl.CreateElement("ecp:RelayState")
+		relayStateEl.CreateAttr("xmlns:ecp", ECPService)
+		relayStateEl.CreateAttr("S:actor", soapActorNext)
+		relayStateEl.CreateAttr("S:mustUnderstand", "1")
+		relayStateEl.SetText(relayState)
+	}
+
+	envelopeEl.CreateElement("S:Body").AddChild(req.Element())
+
+	doc := etree.NewDocument()
+	doc.SetRoot(envelopeEl)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// ParseECPResponse is like ParseResponse for a response that an Enhanced
+// Client or Proxy posts to the ACS with the PAOS binding. The body of req is
+// a SOAP envelope holding the Response and, if the request had one, an
+// ecp:RelayState header, whose value is returned along with the assertion.
+func (sp *ServiceProvider) ParseECPResponse(req *http.Request, possibleRequestIDs []string) (*Assertion, string, error) {
+	now := TimeNow()
+	retErr := &InvalidResponseError{
+		Now: now,
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxECPResponseSize))
+	if err != nil {
+		retErr.PrivateErr = fmt.Errorf("cannot read response: %s", err)
+		return nil, "", retErr
+	}
+	retErr.Response = string(body)
+
+	responseBuf, relayState, err := parseECPEnvelope(body)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, "", retErr
+	}
+
+	assertion, _, err := sp.parseResponse(responseBuf, possibleRequestIDs, sp.clientIP(req), sp.forwardedScheme(req), now)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, relayState, nil
+}
+
+// parseECPEnvelope returns the Response carried in the SOAP envelope
+// envelopeBuf, as a document of its own, and the value of its ecp:RelayState
+// header, if any.
+func parseECPEnvelope(envelopeBuf []byte) ([]byte, string, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(envelopeBuf); err != nil {
+		return nil, "", err
+	}
+	envelopeEl := doc.Root()
+	if envelopeEl == nil || envelopeEl.Tag != "Envelope" {
+		return nil, "", errors.New("expected a SOAP Envelope")
+	}
+	bodyEl, err := findChild(envelopeEl, soapEnvelopeNamespace, "Body")
+	if err != nil {
+		return nil, "", err
+	}
+	if bodyEl == nil {
+		return nil, "", errors.New("SOAP Envelope does not contain a Body")
+	}
+	responseEl, err := findChild(bodyEl, "urn:oasis:names:tc:SAML:2.0:protocol", "Response")
+	if err != nil {
+		return nil, "", err
+	}
+	if responseEl == nil {
+		return nil, "", errors.New("SOAP Body does not contain a Response")
+	}
+
+	relayState := ""
+	if headerEl, err := findChild(envelopeEl, soapEnvelopeNamespace, "Header"); err != nil {
+		return nil, "", err
+	} else if headerEl != nil {
+		relayStateEl, err := findChild(headerEl, ECPService, "RelayState")
+		if err != nil {
+			return nil, "", err
+		}
+		if relayStateEl != nil {
+			relayState = strings.TrimSpace(relayStateEl.Text())
+		}
+	}
+
+	// The Response is moved to a document of its own, along with the
+	// namespace declarations of the envelope that it relies on.
+	ctx, err := etreeutils.NSBuildParentContext(responseEl)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, err = ctx.SubContext(responseEl)
+	if err != nil {
+		return nil, "", err
+	}
+	responseEl, err = etreeutils.NSDetatch(ctx, responseEl)
+	if err != nil {
+		return nil, "", err
+	}
+	responseDoc := etree.NewDocument()
+	responseDoc.SetRoot(responseEl)
+	responseBuf, err := responseDoc.WriteToBytes()
+	if err != nil {
+		return nil, "", err
+	}
+	return responseBuf, relayState, nil
+}
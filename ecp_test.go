@@ -0,0 +1,119 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"github.com/beevik/etree"
+	. "gopkg.in/check.v1"
+)
+
+func (test *ServiceProviderTest) TestIsECPRequest(c *C) {
+	req, _ := http.NewRequest("GET", "https://15661444.ngrok.io/", nil)
+	c.Assert(IsECPRequest(req), Equals, false)
+
+	req.Header.Set("Accept", "text/html; application/vnd.paos+xml")
+	req.Header.Set("PAOS", `ver="urn:liberty:paos:2003-08";"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"`)
+	c.Assert(IsECPRequest(req), Equals, true)
+
+	req.Header.Del("PAOS")
+	c.Assert(IsECPRequest(req), Equals, false)
+}
+
+func (test *ServiceProviderTest) TestCanProduceECPRequest(c *C) {
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		ECP:         true,
+	}
+	err := xml.Unmarshal([]byte(test.IDPMetadata), &s.IDPMetadata)
+	c.Assert(err, IsNil)
+
+	req, err := s.MakeECPAuthenticationRequest()
+	c.Assert(err, IsNil)
+	c.Assert(req.Destination, Equals, "https://idp.testshib.org/idp/profile/SAML2/SOAP/ECP")
+	c.Assert(req.ProtocolBinding, Equals, PAOSBinding)
+
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(req.PAOS("relayState"))
+	c.Assert(err, IsNil)
+	c.Assert(doc.Root().Tag, Equals, "Envelope")
+
+	paosRequestEl := doc.FindElement("./Envelope/Header/Request[@service]")
+	c.Assert(paosRequestEl, NotNil)
+	c.Assert(paosRequestEl.Space, Equals, "paos")
+	c.Assert(paosRequestEl.SelectAttrValue("responseConsumerURL", ""), Equals, "https://15661444.ngrok.io/saml2/acs")
+	c.Assert(paosRequestEl.SelectAttrValue("service", ""), Equals, ECPService)
+	c.Assert(paosRequestEl.SelectAttrValue("S:mustUnderstand", ""), Equals, "1")
+
+	ecpRequestEl := doc.FindElement("./Envelope/Header/Request[@IsPassive]")
+	c.Assert(ecpRequestEl, NotNil)
+	c.Assert(ecpRequestEl.Space, Equals, "ecp")
+	c.Assert(ecpRequestEl.SelectAttrValue("IsPassive", ""), Equals, "0")
+	c.Assert(ecpRequestEl.FindElement("./Issuer").Text(), Equals, "https://15661444.ngrok.io/saml2/metadata")
+
+	c.Assert(doc.FindElement("./Envelope/Header/RelayState").Text(), Equals, "relayState")
+	c.Assert(doc.FindElement("./Envelope/Body/AuthnRequest").SelectAttrValue("ID", ""), Equals, req.ID)
+
+	// the RelayState header is omitted if there is no relay state
+	doc = etree.NewDocument()
+	err = doc.ReadFromBytes(req.PAOS(""))
+	c.Assert(err, IsNil)
+	c.Assert(doc.FindElement("./Envelope/Header/RelayState"), IsNil)
+}
+
+func (test *ServiceProviderTest) TestMetadataWithECP(c *C) {
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:      mustParseURL("https://example.com/saml2/acs"),
+		ECP:         true,
+	}
+	c.Assert(s.Metadata().SPSSODescriptors[0].AssertionConsumerServices, DeepEquals, []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: "https://example.com/saml2/acs", Index: 1},
+		{Binding: PAOSBinding, Location: "https://example.com/saml2/acs", Index: 2},
+	})
+}
+
+func (test *ServiceProviderTest) TestCanParseECPResponse(c *C) {
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		ECP:         true,
+	}
+	err := xml.Unmarshal([]byte(test.IDPMetadata), &s.IDPMetadata)
+	c.Assert(err, IsNil)
+
+	response := test.SamlResponse[strings.Index(test.SamlResponse, "?>")+2:]
+	envelope := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/">` +
+		`<S:Header>` +
+		`<ecp:RelayState xmlns:ecp="urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp" S:actor="http://schemas.xmlsoap.org/soap/actor/next" S:mustUnderstand="1">relayState</ecp:RelayState>` +
+		`</S:Header>` +
+		`<S:Body>` + response + `</S:Body>` +
+		`</S:Envelope>`
+
+	req, _ := http.NewRequest("POST", "https://15661444.ngrok.io/saml2/acs", bytes.NewBufferString(envelope))
+	req.Header.Set("Content-Type", PAOSContentType)
+	assertion, relayState, err := s.ParseECPResponse(req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	c.Assert(err, IsNil)
+	c.Assert(relayState, Equals, "relayState")
+	c.Assert(assertion.Subject.NameID.Value, Equals, "_41bd295976dadd70e1480f318e772841")
+
+	req, _ = http.NewRequest("POST", "https://15661444.ngrok.io/saml2/acs", bytes.NewBufferString(
+		`<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body/></S:Envelope>`))
+	_, _, err = s.ParseECPResponse(req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	c.Assert(err.(*InvalidResponseError).PrivateErr, ErrorMatches, "SOAP Body does not contain a Response")
+
+	req, _ = http.NewRequest("POST", "https://15661444.ngrok.io/saml2/acs", bytes.NewBufferString(response))
+	_, _, err = s.ParseECPResponse(req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	c.Assert(err.(*InvalidResponseError).PrivateErr, ErrorMatches, "expected a SOAP Envelope")
+}
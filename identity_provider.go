@@ -2,15 +2,14 @@ package saml
 
 import (
 	"bytes"
-	"compress/flate"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -314,7 +313,7 @@ func NewIdpAuthnRequest(idp *IdentityProvider, r *http.Request) (*IdpAuthnReques
 		if err != nil {
 			return nil, fmt.Errorf("cannot decode request: %s", err)
 		}
-		req.RequestBuffer, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedRequest)))
+		req.RequestBuffer, err = inflate(compressedRequest)
 		if err != nil {
 			return nil, fmt.Errorf("cannot decompress request: %s", err)
 		}
@@ -599,7 +598,7 @@ func (DefaultAssertionMaker) MakeAssertion(req *IdpAuthnRequest, session *Sessio
 	}
 
 	req.Assertion = &Assertion{
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		ID:           NewID(),
 		IssueInstant: TimeNow(),
 		Version:      "2.0",
 		Issuer: Issuer{
@@ -840,7 +839,7 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 
 	response := &Response{
 		Destination:  req.ACSEndpoint.Location,
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		ID:           NewID(),
 		InResponseTo: req.Request.ID,
 		IssueInstant: TimeNow(),
 		Version:      "2.0",
@@ -887,3 +886,112 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 	req.ResponseEl = responseEl
 	return nil
 }
+
+// MakeAssertion returns an assertion issued by idp about the user identified
+// by subject, with attributes, for example those of an assertion received
+// from another IDP when idp is part of a SAML proxy. The Format, Value and
+// SPProvidedID of subject are used. If subject is nil, the assertion has no
+// NameID.
+//
+// The assertion is not yet addressed to a service provider. Pass it to
+// MakeResponse to do so. It may be modified before then, for example to
+// copy the AuthnStatements of the assertion it was made from.
+func (idp *IdentityProvider) MakeAssertion(attributes []Attribute, subject *NameID) *Assertion {
+	entityID := idp.MetadataURL.String()
+	now := TimeNow()
+	var nameID *NameID
+	if subject != nil {
+		nameID = &NameID{
+			Format:        subject.Format,
+			NameQualifier: entityID,
+			SPProvidedID:  subject.SPProvidedID,
+			Value:         subject.Value,
+		}
+	}
+	return &Assertion{
+		ID:           NewID(),
+		IssueInstant: now,
+		Version:      "2.0",
+		Issuer: Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  entityID,
+		},
+		Subject: &Subject{
+			NameID: nameID,
+			SubjectConfirmations: []SubjectConfirmation{
+				{
+					Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+					SubjectConfirmationData: &SubjectConfirmationData{
+						NotOnOrAfter: now.Add(MaxIssueDelay),
+					},
+				},
+			},
+		},
+		Conditions: &Conditions{
+			NotBefore:    now.Add(-1 * MaxClockSkew),
+			NotOnOrAfter: now.Add(MaxIssueDelay),
+		},
+		AuthnStatements: []AuthnStatement{
+			{
+				AuthnInstant: now,
+				AuthnContext: AuthnContext{
+					AuthnContextClassRef: &AuthnContextClassRef{
+						Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified",
+					},
+				},
+			},
+		},
+		AttributeStatements: []AttributeStatement{
+			{
+				Attributes: attributes,
+			},
+		},
+	}
+}
+
+// MakeResponse addresses assertion, typically made by MakeAssertion, to the
+// service provider of req and sets req.ResponseEl to a signed Response that
+// contains it. The assertion is signed, and encrypted if the metadata of the
+// service provider has an encryption certificate. req.ServiceProviderMetadata,
+// req.SPSSODescriptor and req.ACSEndpoint must be set, as they are by
+// Validate, and the Response is in response to req.Request.ID, if any. Call
+// req.WriteResponse to send the Response to the service provider.
+//
+// The audience, recipient and InResponseTo of assertion are set for req, so
+// a separate assertion must be made for each service provider.
+func (idp *IdentityProvider) MakeResponse(assertion *Assertion, req *IdpAuthnRequest) error {
+	if req.ServiceProviderMetadata == nil || req.SPSSODescriptor == nil || req.ACSEndpoint == nil {
+		return errors.New("the service provider and its ACS endpoint are not known")
+	}
+	spEntityID := req.ServiceProviderMetadata.EntityID
+
+	if assertion.Subject != nil {
+		if assertion.Subject.NameID != nil {
+			assertion.Subject.NameID.SPNameQualifier = spEntityID
+		}
+		for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
+			if data := subjectConfirmation.SubjectConfirmationData; data != nil {
+				data.InResponseTo = req.Request.ID
+				data.Recipient = req.ACSEndpoint.Location
+				if req.HTTPRequest != nil {
+					data.Address = req.HTTPRequest.RemoteAddr
+				}
+			}
+		}
+	}
+	if assertion.Conditions == nil {
+		assertion.Conditions = &Conditions{}
+	}
+	assertion.Conditions.AudienceRestrictions = []AudienceRestriction{
+		{
+			Audience: Audience{Value: spEntityID},
+		},
+	}
+	assertion.Signature = nil
+
+	req.IDP = idp
+	req.Assertion = assertion
+	req.AssertionEl = nil
+	req.ResponseEl = nil
+	return req.MakeResponse()
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/launchpadcentral/saml/testsaml"
 	"github.com/launchpadcentral/saml/xmlenc"
 	"github.com/dgrijalva/jwt-go"
+	dsig "github.com/russellhaering/goxmldsig"
 	. "gopkg.in/check.v1"
 )
 
@@ -1157,3 +1158,72 @@ func (test *IdentityProviderTest) TestNoDestination(c *C) {
 	err = req.MakeResponse()
 	c.Assert(err, IsNil)
 }
+
+func (test *IdentityProviderTest) TestMakeProxiedResponse(c *C) {
+	req := IdpAuthnRequest{
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+	c.Assert(req.Validate(), IsNil)
+
+	// the attributes and subject of an assertion from an upstream IDP
+	upstream := Assertion{
+		Subject: &Subject{
+			NameID: &NameID{
+				Format:        string(EmailAddressNameIDFormat),
+				NameQualifier: "https://upstream.example.com/metadata",
+				Value:         "alice@example.com",
+			},
+		},
+		AttributeStatements: []AttributeStatement{{
+			Attributes: []Attribute{{
+				Name:   "urn:oid:2.5.4.42",
+				Values: []AttributeValue{{Type: "xs:string", Value: "Alice"}},
+			}},
+		}},
+	}
+	assertion := test.IDP.MakeAssertion(upstream.AttributeStatements[0].Attributes, upstream.Subject.NameID)
+	c.Assert(test.IDP.MakeResponse(assertion, &req), IsNil)
+	c.Assert(assertion.Subject.NameID.NameQualifier, Equals, "https://idp.example.com/saml/metadata")
+	c.Assert(assertion.Subject.NameID.SPNameQualifier, Equals, "https://sp.example.com/saml2/metadata")
+
+	// the service provider has an encryption certificate
+	c.Assert(req.ResponseEl.FindElement("./EncryptedAssertion"), NotNil)
+	c.Assert(req.ResponseEl.FindElement("./Assertion"), IsNil)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	responseBuf, err := doc.WriteToBytes()
+	c.Assert(err, IsNil)
+
+	// the certificate of the IDP expired before TimeNow
+	Clock = dsig.NewFakeClockAt(test.Certificate.NotBefore)
+	httpReq := http.Request{PostForm: url.Values{}}
+	httpReq.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(responseBuf))
+	parsed, err := test.SP.ParseResponse(&httpReq, []string{"id-00020406080a0c0e10121416181a1c1e"})
+	if err != nil {
+		c.Assert(err.(*InvalidResponseError).PrivateErr, IsNil)
+	}
+	c.Assert(parsed.Subject.NameID.Value, Equals, "alice@example.com")
+	c.Assert(parsed.Subject.NameID.Format, Equals, string(EmailAddressNameIDFormat))
+	c.Assert(parsed.AttributeStatements[0].Attributes[0].Values[0].Value, Equals, "Alice")
+
+	// the service provider and its ACS endpoint must be known
+	err = test.IDP.MakeResponse(test.IDP.MakeAssertion(nil, upstream.Subject.NameID), &IdpAuthnRequest{})
+	c.Assert(err, ErrorMatches, "the service provider and its ACS endpoint are not known")
+
+	// an assertion without a NameID has none
+	assertion = test.IDP.MakeAssertion(upstream.AttributeStatements[0].Attributes, nil)
+	c.Assert(assertion.Subject.NameID, IsNil)
+	c.Assert(test.IDP.MakeResponse(assertion, &req), IsNil)
+}
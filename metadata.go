@@ -1,7 +1,14 @@
 package saml
 
 import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
+	"fmt"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/beevik/etree"
@@ -13,6 +20,13 @@ var HTTPPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
 // HTTPRedirectBinding is the official URN for the HTTP-Redirect binding (transport)
 var HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
 
+// PAOSBinding is the official URN for the reverse SOAP (PAOS) binding, which
+// is used by the Enhanced Client or Proxy (ECP) profile
+var PAOSBinding = "urn:oasis:names:tc:SAML:2.0:bindings:PAOS"
+
+// SOAPBinding is the official URN for the SOAP binding
+var SOAPBinding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+
 // EntitiesDescriptor represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.3.1
@@ -46,6 +60,7 @@ type EntityDescriptor struct {
 	ValidUntil                    time.Time     `xml:"validUntil,attr,omitempty"`
 	CacheDuration                 time.Duration `xml:"cacheDuration,attr,omitempty"`
 	Signature                     *etree.Element
+	Extensions                    *EntityExtensions
 	RoleDescriptors               []RoleDescriptor               `xml:"RoleDescriptor"`
 	IDPSSODescriptors             []IDPSSODescriptor             `xml:"IDPSSODescriptor"`
 	SPSSODescriptors              []SPSSODescriptor              `xml:"SPSSODescriptor"`
@@ -73,12 +88,14 @@ func (m EntityDescriptor) MarshalXML(e *xml.Encoder, start xml.StartElement) err
 	return e.Encode(aux)
 }
 
-// UnmarshalXML implements xml.Unmarshaler
+// UnmarshalXML implements xml.Unmarshaler. A cacheDuration that is not a
+// valid xsd:duration is ignored, as if it were not specified, rather than
+// making the whole metadata invalid.
 func (m *EntityDescriptor) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias EntityDescriptor
 	aux := &struct {
-		ValidUntil    RelaxedTime `xml:"validUntil,attr,omitempty"`
-		CacheDuration Duration    `xml:"cacheDuration,attr,omitempty"`
+		ValidUntil    RelaxedTime      `xml:"validUntil,attr,omitempty"`
+		CacheDuration optionalDuration `xml:"cacheDuration,attr,omitempty"`
 		*Alias
 	}{
 		Alias: (*Alias)(m),
@@ -91,6 +108,144 @@ func (m *EntityDescriptor) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 	return nil
 }
 
+// SigningCertificates returns the signing certificates of the
+// IDPSSODescriptors of the entity. See RoleDescriptor.SigningCertificates.
+func (m *EntityDescriptor) SigningCertificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for i := range m.IDPSSODescriptors {
+		descriptorCerts, err := m.IDPSSODescriptors[i].SigningCertificates()
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, descriptorCerts...)
+	}
+	return certs, nil
+}
+
+// EncryptionCertificates returns the encryption certificates of the
+// IDPSSODescriptors of the entity. See RoleDescriptor.EncryptionCertificates.
+func (m *EntityDescriptor) EncryptionCertificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for i := range m.IDPSSODescriptors {
+		descriptorCerts, err := m.IDPSSODescriptors[i].EncryptionCertificates()
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, descriptorCerts...)
+	}
+	return certs, nil
+}
+
+// RefreshInterval returns how long after now the metadata should be fetched
+// again, which is the smaller of CacheDuration and the time remaining until
+// ValidUntil, considering only those that are specified. If ValidUntil has
+// passed, it returns zero. It returns false if neither is specified, in
+// which case the interval is up to the caller.
+func (m *EntityDescriptor) RefreshInterval(now time.Time) (time.Duration, bool) {
+	var interval time.Duration
+	ok := false
+	if m.CacheDuration > 0 {
+		interval, ok = m.CacheDuration, true
+	}
+	if !m.ValidUntil.IsZero() {
+		untilValidUntil := m.ValidUntil.Sub(now)
+		if untilValidUntil < 0 {
+			untilValidUntil = 0
+		}
+		if !ok || untilValidUntil < interval {
+			interval, ok = untilValidUntil, true
+		}
+	}
+	return interval, ok
+}
+
+// EntityAttributeValues returns the values of the entity attributes named
+// name in the Extensions of the entity, such as the entity categories named
+// EntityCategoryAttributeName.
+func (m *EntityDescriptor) EntityAttributeValues(name string) []string {
+	if m.Extensions == nil || m.Extensions.EntityAttributes == nil {
+		return nil
+	}
+	var values []string
+	for _, attribute := range m.Extensions.EntityAttributes.Attributes {
+		if attribute.Name != name {
+			continue
+		}
+		for _, value := range attribute.Values {
+			values = append(values, value.Value)
+		}
+	}
+	return values
+}
+
+// EntityExtensions represents the Extensions element of an
+// EntityDescriptor. Of the extensions that federations use, those for
+// registration information and entity attributes are supported. Other
+// extensions are ignored.
+type EntityExtensions struct {
+	XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	RegistrationInfo *RegistrationInfo
+	EntityAttributes *EntityAttributes
+}
+
+// RegistrationInfo represents the mdrpi:RegistrationInfo element, which
+// identifies the federation that registered an entity.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/saml-metadata-rpi/v1.0/saml-metadata-rpi-v1.0.pdf §2.1
+type RegistrationInfo struct {
+	XMLName               xml.Name       `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationInfo"`
+	RegistrationAuthority string         `xml:"registrationAuthority,attr"`
+	RegistrationInstant   *time.Time     `xml:"registrationInstant,attr,omitempty"`
+	RegistrationPolicies  []LocalizedURI `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationPolicy"`
+}
+
+// EntityCategoryAttributeName is the name of the entity attribute whose
+// values are the entity categories of an entity, such as
+// "http://refeds.org/category/research-and-scholarship".
+const EntityCategoryAttributeName = "http://macedir.org/entity-category"
+
+// EntityAttributes represents the mdattr:EntityAttributes element, which
+// holds attributes that describe an entity, such as its entity categories.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-metadata-attr.pdf §2.3
+type EntityAttributes struct {
+	XMLName    xml.Name    `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+	Attributes []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+// MarshalXML implements xml.Marshaler. Unlike those of an Attribute in an
+// assertion, the optional attributes of the entity attributes and their
+// values, such as xsi:type, are omitted if empty, since federations
+// validate the metadata against the schema.
+func (m EntityAttributes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type entityAttributeValue struct {
+		Type  string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr,omitempty"`
+		Value string `xml:",chardata"`
+	}
+	type entityAttribute struct {
+		FriendlyName string                 `xml:",attr,omitempty"`
+		Name         string                 `xml:",attr"`
+		NameFormat   string                 `xml:",attr,omitempty"`
+		Values       []entityAttributeValue `xml:"AttributeValue"`
+	}
+	aux := struct {
+		XMLName    xml.Name          `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+		Attributes []entityAttribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+	}{}
+	for _, attribute := range m.Attributes {
+		auxAttribute := entityAttribute{
+			FriendlyName: attribute.FriendlyName,
+			Name:         attribute.Name,
+			NameFormat:   attribute.NameFormat,
+		}
+		for _, value := range attribute.Values {
+			auxAttribute.Values = append(auxAttribute.Values, entityAttributeValue{Type: value.Type, Value: value.Value})
+		}
+		aux.Attributes = append(aux.Attributes, auxAttribute)
+	}
+	return e.Encode(aux)
+}
+
 // Organization represents the SAML Organization object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.3.2.1
@@ -104,7 +259,7 @@ type Organization struct {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.2.4
 type LocalizedName struct {
-	Lang  string `xml:"xml lang,attr"`
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
 	Value string `xml:",chardata"`
 }
 
@@ -112,10 +267,41 @@ type LocalizedName struct {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.2.5
 type LocalizedURI struct {
-	Lang  string `xml:"xml lang,attr"`
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
 	Value string `xml:",chardata"`
 }
 
+// RoleExtensions represents the Extensions element of a role descriptor,
+// such as an SPSSODescriptor. Of the extensions that federations use, user
+// interface information is supported. Other extensions are ignored.
+type RoleExtensions struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	UIInfo  *UIInfo
+}
+
+// UIInfo represents the mdui:UIInfo element, which describes an entity to
+// users, for example on the consent screen of an IDP. Each of its elements
+// may be given in several languages.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-ui/v1.0/os/sstc-saml-metadata-ui-v1.0-os.pdf §2.1
+type UIInfo struct {
+	XMLName              xml.Name        `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo"`
+	DisplayNames         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui DisplayName"`
+	Descriptions         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui Description"`
+	Logos                []Logo          `xml:"urn:oasis:names:tc:SAML:metadata:ui Logo"`
+	InformationURLs      []LocalizedURI  `xml:"urn:oasis:names:tc:SAML:metadata:ui InformationURL"`
+	PrivacyStatementURLs []LocalizedURI  `xml:"urn:oasis:names:tc:SAML:metadata:ui PrivacyStatementURL"`
+}
+
+// Logo represents the mdui:Logo element, the URL of an image of Width by
+// Height pixels. Lang is empty if the logo does not depend on the language.
+type Logo struct {
+	Height int    `xml:"height,attr"`
+	Width  int    `xml:"width,attr"`
+	Lang   string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	URL    string `xml:",chardata"`
+}
+
 // ContactPerson represents the SAML element ContactPerson.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.3.2.2
@@ -138,11 +324,100 @@ type RoleDescriptor struct {
 	ProtocolSupportEnumeration string        `xml:"protocolSupportEnumeration,attr"`
 	ErrorURL                   string        `xml:"errorURL,attr,omitempty"`
 	Signature                  *etree.Element
+	Extensions                 *RoleExtensions
 	KeyDescriptors             []KeyDescriptor `xml:"KeyDescriptor,omitempty"`
 	Organization               *Organization   `xml:"Organization,omitempty"`
 	ContactPeople              []ContactPerson `xml:"ContactPerson,omitempty"`
 }
 
+// SigningCertificates returns the certificates of the KeyDescriptors whose
+// use is "signing" or unspecified, which means both signing and encryption.
+// It returns an error if any of them cannot be parsed.
+func (m *RoleDescriptor) SigningCertificates() ([]*x509.Certificate, error) {
+	return m.certificates("signing")
+}
+
+// EncryptionCertificates returns the certificates of the KeyDescriptors
+// whose use is "encryption" or unspecified, which means both signing and
+// encryption. It returns an error if any of them cannot be parsed.
+func (m *RoleDescriptor) EncryptionCertificates() ([]*x509.Certificate, error) {
+	return m.certificates("encryption")
+}
+
+// certificates returns the certificates of the KeyDescriptors whose use is
+// use or unspecified.
+func (m *RoleDescriptor) certificates(use string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, keyDescriptor := range m.KeyDescriptors {
+		if keyDescriptor.Use != use && keyDescriptor.Use != "" {
+			continue
+		}
+		if keyDescriptor.KeyInfo.Certificate == "" {
+			continue
+		}
+		cert, err := parseKeyInfoCertificate(keyDescriptor.KeyInfo.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// parseKeyInfoCertificate parses the base64 encoded body of an
+// X509Certificate element, which may be broken into lines. Certificates
+// are memoized by their body, since those of the IDP metadata are needed
+// to verify the signatures of every response.
+func parseKeyInfoCertificate(certStr string) (*x509.Certificate, error) {
+	if cert := keyInfoCertificates.get(certStr); cert != nil {
+		return cert, nil
+	}
+	certBytes, err := base64.StdEncoding.DecodeString(whitespaceRegexp.ReplaceAllString(certStr, ""))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	keyInfoCertificates.put(certStr, cert)
+	return cert, nil
+}
+
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+// maxCachedCertificates is the number of certificates that
+// parseKeyInfoCertificate memoizes. When it is reached, the cache is
+// emptied, so that the certificates of metadata that was replaced are not
+// kept forever.
+const maxCachedCertificates = 256
+
+// keyInfoCertificates memoizes the certificates parsed by
+// parseKeyInfoCertificate.
+var keyInfoCertificates = certificateCache{}
+
+// certificateCache maps the base64 encoded bodies of certificates to the
+// parsed certificates. It is safe for concurrent use.
+type certificateCache struct {
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func (c *certificateCache) get(certStr string) *x509.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.certs[certStr]
+}
+
+func (c *certificateCache) put(certStr string, cert *x509.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.certs == nil || len(c.certs) >= maxCachedCertificates {
+		c.certs = map[string]*x509.Certificate{}
+	}
+	c.certs[certStr] = cert
+}
+
 // KeyDescriptor represents the XMLSEC object of the same name
 type KeyDescriptor struct {
 	Use               string             `xml:"use,attr"`
@@ -284,3 +559,19 @@ type AffiliationDescriptor struct {
 	AffiliateMembers   []string        `xml:"AffiliateMember"`
 	KeyDescriptors     []KeyDescriptor `xml:"KeyDescriptor"`
 }
+
+// mdqSHA1Prefix is the prefix of the identifiers of the sha1 transform of
+// the Metadata Query Protocol.
+const mdqSHA1Prefix = "{sha1}"
+
+// MDQTransform returns the identifier of entityID under the sha1 transform
+// of the Metadata Query Protocol, which is "{sha1}" followed by the
+// lowercase hex encoded SHA-1 hash of entityID, for example
+// "{sha1}d7070df08eacb863523f9c79f8215dc969a7813d". The identifier must be
+// URL encoded when it is used in the path of a request.
+//
+// See https://datatracker.ietf.org/doc/draft-young-md-query-saml/ §2.1
+func MDQTransform(entityID string) string {
+	sum := sha1.Sum([]byte(entityID))
+	return mdqSHA1Prefix + hex.EncodeToString(sum[:])
+}
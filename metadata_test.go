@@ -1,6 +1,13 @@
 package saml
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
 	"time"
 
 	"encoding/xml"
@@ -49,7 +56,7 @@ func (s *MetadataTest) TestCanParseMetadata(c *C) {
 					AttributeConsumingService{
 						Index:        1,
 						IsDefault:    &True,
-						ServiceNames: []LocalizedName{{Value: "Required attributes"}},
+						ServiceNames: []LocalizedName{{Lang: "en", Value: "Required attributes"}},
 						RequestedAttributes: []RequestedAttribute{
 							{
 								Attribute: Attribute{
@@ -173,3 +180,188 @@ cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ==`,
 		"  </SPSSODescriptor>\n"+
 		"</EntityDescriptor>")
 }
+
+func (s *MetadataTest) TestRefreshInterval(c *C) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, ok := (&EntityDescriptor{}).RefreshInterval(now)
+	c.Assert(ok, Equals, false)
+
+	interval, ok := (&EntityDescriptor{CacheDuration: 12 * time.Hour}).RefreshInterval(now)
+	c.Assert(ok, Equals, true)
+	c.Assert(interval, Equals, 12*time.Hour)
+
+	interval, ok = (&EntityDescriptor{ValidUntil: now.Add(time.Hour)}).RefreshInterval(now)
+	c.Assert(ok, Equals, true)
+	c.Assert(interval, Equals, time.Hour)
+
+	// the smaller of the two is used
+	interval, _ = (&EntityDescriptor{CacheDuration: 12 * time.Hour, ValidUntil: now.Add(time.Hour)}).RefreshInterval(now)
+	c.Assert(interval, Equals, time.Hour)
+	interval, _ = (&EntityDescriptor{CacheDuration: 12 * time.Hour, ValidUntil: now.Add(48 * time.Hour)}).RefreshInterval(now)
+	c.Assert(interval, Equals, 12*time.Hour)
+
+	// metadata that is no longer valid should be refreshed at once
+	interval, ok = (&EntityDescriptor{CacheDuration: 12 * time.Hour, ValidUntil: now.Add(-time.Hour)}).RefreshInterval(now)
+	c.Assert(ok, Equals, true)
+	c.Assert(interval, Equals, time.Duration(0))
+}
+
+func (s *MetadataTest) TestIgnoresMalformedCacheDuration(c *C) {
+	metadata := EntityDescriptor{}
+	err := xml.Unmarshal([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata" cacheDuration="12 hours"/>`), &metadata)
+	c.Assert(err, IsNil)
+	c.Assert(metadata.EntityID, Equals, "https://idp.example.com/metadata")
+	c.Assert(metadata.CacheDuration, Equals, time.Duration(0))
+
+	err = xml.Unmarshal([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata" cacheDuration="PT12H"/>`), &metadata)
+	c.Assert(err, IsNil)
+	c.Assert(metadata.CacheDuration, Equals, 12*time.Hour)
+}
+
+func (s *MetadataTest) TestSigningAndEncryptionCertificates(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	makeCert := func(serialNumber int64) (*x509.Certificate, string) {
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(serialNumber),
+			NotBefore:    time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			NotAfter:     time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		certBuf, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+		c.Assert(err, IsNil)
+		cert, err := x509.ParseCertificate(certBuf)
+		c.Assert(err, IsNil)
+		return cert, base64.StdEncoding.EncodeToString(certBuf)
+	}
+	signingCert, signingCertStr := makeCert(1)
+	encryptionCert, encryptionCertStr := makeCert(2)
+	bothCert, bothCertStr := makeCert(3)
+
+	// certificates in metadata are often broken into lines
+	var lines []string
+	for len(bothCertStr) > 64 {
+		lines = append(lines, bothCertStr[:64])
+		bothCertStr = bothCertStr[64:]
+	}
+	bothCertStr = "\n" + strings.Join(append(lines, bothCertStr), "\n") + "\n"
+
+	metadata := EntityDescriptor{IDPSSODescriptors: []IDPSSODescriptor{{}}}
+	metadata.IDPSSODescriptors[0].KeyDescriptors = []KeyDescriptor{
+		{Use: "signing", KeyInfo: KeyInfo{Certificate: signingCertStr}},
+		{Use: "encryption", KeyInfo: KeyInfo{Certificate: encryptionCertStr}},
+		{KeyInfo: KeyInfo{Certificate: bothCertStr}},
+		{Use: "signing"},
+	}
+
+	certs, err := metadata.SigningCertificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 2)
+	c.Assert(certs[0].Equal(signingCert), Equals, true)
+	c.Assert(certs[1].Equal(bothCert), Equals, true)
+
+	certs, err = metadata.IDPSSODescriptors[0].EncryptionCertificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 2)
+	c.Assert(certs[0].Equal(encryptionCert), Equals, true)
+	c.Assert(certs[1].Equal(bothCert), Equals, true)
+
+	certs, err = (&EntityDescriptor{}).SigningCertificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 0)
+
+	metadata.IDPSSODescriptors[0].KeyDescriptors[0].KeyInfo.Certificate = "not base64!"
+	_, err = metadata.SigningCertificates()
+	c.Assert(err, ErrorMatches, "cannot parse certificate: .*")
+	certs, err = metadata.EncryptionCertificates()
+	c.Assert(err, IsNil)
+	c.Assert(certs, HasLen, 2)
+}
+
+func (s *MetadataTest) TestParseKeyInfoCertificateIsMemoized(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	certBuf, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	certStr := base64.StdEncoding.EncodeToString(certBuf)
+
+	cert, err := parseKeyInfoCertificate(certStr)
+	c.Assert(err, IsNil)
+	c.Assert(cert.Raw, DeepEquals, certBuf)
+	again, err := parseKeyInfoCertificate(certStr)
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, cert)
+
+	// the same certificate broken into lines is parsed as well
+	wrapped, err := parseKeyInfoCertificate(certStr[:64] + "\n" + certStr[64:])
+	c.Assert(err, IsNil)
+	c.Assert(wrapped.Equal(cert), Equals, true)
+
+	// errors are not memoized
+	_, err = parseKeyInfoCertificate("!" + certStr)
+	c.Assert(err, ErrorMatches, "cannot parse certificate: .*")
+	c.Assert(keyInfoCertificates.get("!"+certStr), IsNil)
+
+	// the cache is bounded
+	for i := 0; i < maxCachedCertificates; i++ {
+		keyInfoCertificates.put(fmt.Sprintf("cert%d", i), cert)
+	}
+	c.Assert(len(keyInfoCertificates.certs) <= maxCachedCertificates, Equals, true)
+}
+
+func (s *MetadataTest) TestEntityExtensions(c *C) {
+	buf := []byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:mdrpi="urn:oasis:names:tc:SAML:metadata:rpi" xmlns:mdattr="urn:oasis:names:tc:SAML:metadata:attribute" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" entityID="https://idp.example.edu/idp/shibboleth">
+  <md:Extensions>
+    <mdrpi:RegistrationInfo registrationAuthority="https://incommon.org" registrationInstant="2012-01-01T00:00:00Z">
+      <mdrpi:RegistrationPolicy xml:lang="en">http://www.incommon.org/federation/policy.html</mdrpi:RegistrationPolicy>
+    </mdrpi:RegistrationInfo>
+    <mdattr:EntityAttributes>
+      <saml:Attribute Name="http://macedir.org/entity-category-support" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">
+        <saml:AttributeValue>http://refeds.org/category/research-and-scholarship</saml:AttributeValue>
+      </saml:Attribute>
+      <saml:Attribute Name="urn:oasis:names:tc:SAML:attribute:assurance-certification" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">
+        <saml:AttributeValue>http://id.incommon.org/assurance/bronze</saml:AttributeValue>
+        <saml:AttributeValue>http://id.incommon.org/assurance/silver</saml:AttributeValue>
+      </saml:Attribute>
+    </mdattr:EntityAttributes>
+    <shibmd:Scope xmlns:shibmd="urn:mace:shibboleth:metadata:1.0" regexp="false">example.edu</shibmd:Scope>
+  </md:Extensions>
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+</md:EntityDescriptor>`)
+
+	entity := EntityDescriptor{}
+	c.Assert(xml.Unmarshal(buf, &entity), IsNil)
+	c.Assert(entity.Extensions, NotNil)
+	registrationInfo := entity.Extensions.RegistrationInfo
+	c.Assert(registrationInfo, NotNil)
+	c.Assert(registrationInfo.RegistrationAuthority, Equals, "https://incommon.org")
+	c.Assert(registrationInfo.RegistrationInstant.Equal(time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Assert(registrationInfo.RegistrationPolicies, DeepEquals, []LocalizedURI{{
+		Lang:  "en",
+		Value: "http://www.incommon.org/federation/policy.html",
+	}})
+	c.Assert(entity.EntityAttributeValues("http://macedir.org/entity-category-support"), DeepEquals,
+		[]string{"http://refeds.org/category/research-and-scholarship"})
+	c.Assert(entity.EntityAttributeValues("urn:oasis:names:tc:SAML:attribute:assurance-certification"), DeepEquals,
+		[]string{"http://id.incommon.org/assurance/bronze", "http://id.incommon.org/assurance/silver"})
+	c.Assert(entity.EntityAttributeValues(EntityCategoryAttributeName), IsNil)
+	c.Assert(len(entity.IDPSSODescriptors), Equals, 1)
+
+	// without Extensions
+	entity = EntityDescriptor{}
+	c.Assert(xml.Unmarshal([]byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/"/>`), &entity), IsNil)
+	c.Assert(entity.Extensions, IsNil)
+	c.Assert(entity.EntityAttributeValues(EntityCategoryAttributeName), IsNil)
+}
+
+func (s *MetadataTest) TestMDQTransform(c *C) {
+	c.Assert(MDQTransform("https://idp.example.com/metadata"), Equals,
+		"{sha1}d7070df08eacb863523f9c79f8215dc969a7813d")
+	c.Assert(MDQTransform("http://example.org/service"), Equals,
+		"{sha1}11d72e8cf351eb6c75c721e838f469677ab41bdb")
+}
@@ -0,0 +1,78 @@
+package saml
+
+import "time"
+
+// ParseStage identifies a stage of the validation of a response, whose
+// duration is reported to ServiceProvider.ObserveParseStage.
+type ParseStage string
+
+// Values for ParseStage
+const (
+	// ParseStageDecode is the parsing of the XML of the response and of its
+	// assertions, and the checks of the response that precede decryption.
+	ParseStageDecode ParseStage = "decode"
+
+	// ParseStageDecrypt is the decryption of encrypted assertions, including
+	// that of their keys.
+	ParseStageDecrypt ParseStage = "decrypt"
+
+	// ParseStageVerifySignature is the canonicalization and verification of
+	// the signatures of the response and its assertions.
+	ParseStageVerifySignature ParseStage = "verify_signature"
+
+	// ParseStageValidateConditions is the validation of the conditions,
+	// subject and statements of the assertions.
+	ParseStageValidateConditions ParseStage = "validate_conditions"
+)
+
+// parseStages are the values of ParseStage in the order in which they are
+// reported.
+var parseStages = []ParseStage{
+	ParseStageDecode,
+	ParseStageDecrypt,
+	ParseStageVerifySignature,
+	ParseStageValidateConditions,
+}
+
+// parseStageTimer accumulates the time spent in each ParseStage of the
+// validation of a response. The time between calls to begin is attributed
+// to the stage that was begun, so that stages which are interleaved, such
+// as the decryption and verification of several assertions, are summed.
+type parseStageTimer struct {
+	durations map[ParseStage]time.Duration
+	stage     ParseStage
+	start     time.Time
+}
+
+// begin ends the current stage, if any, and begins stage.
+func (t *parseStageTimer) begin(stage ParseStage) {
+	t.end()
+	t.stage = stage
+	t.start = time.Now()
+}
+
+// end ends the current stage, if any.
+func (t *parseStageTimer) end() {
+	if t.start.IsZero() {
+		return
+	}
+	if t.durations == nil {
+		t.durations = map[ParseStage]time.Duration{}
+	}
+	t.durations[t.stage] += time.Since(t.start)
+	t.start = time.Time{}
+}
+
+// report ends the current stage and calls observe, if it is not nil, with
+// the duration of each stage that was begun.
+func (t *parseStageTimer) report(observe func(stage ParseStage, duration time.Duration)) {
+	t.end()
+	if observe == nil {
+		return
+	}
+	for _, stage := range parseStages {
+		if duration, ok := t.durations[stage]; ok {
+			observe(stage, duration)
+		}
+	}
+}
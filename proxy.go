@@ -0,0 +1,50 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrProxyCountExhausted is returned by ReissueProxyRestriction when the
+// Count of the ProxyRestriction of an assertion is zero.
+var ErrProxyCountExhausted = errors.New("ProxyRestriction Count forbids issuing assertions on the basis of the assertion")
+
+// ReissueProxyRestriction returns the ProxyRestriction of an assertion that
+// a proxy issues to audience, the entity ID of a relying party, on the
+// basis of assertion, as section 2.5.1.6 of SAMLCore requires. It has the
+// same Audiences as that of assertion and a Count that is one less, so
+// that the restriction is honored by the proxies after this one.
+//
+// It returns nil if assertion does not have a ProxyRestriction, and an
+// error if it forbids issuing an assertion to audience, either because the
+// Count is zero or because audience is not one of the Audiences.
+func ReissueProxyRestriction(assertion *Assertion, audience string) (*ProxyRestriction, error) {
+	if assertion.Conditions == nil || assertion.Conditions.ProxyRestriction == nil {
+		return nil, nil
+	}
+	restriction := assertion.Conditions.ProxyRestriction
+
+	if restriction.Count != nil && *restriction.Count <= 0 {
+		return nil, ErrProxyCountExhausted
+	}
+	if len(restriction.Audiences) > 0 {
+		allowed := false
+		for _, a := range restriction.Audiences {
+			if a.Value == audience {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("ProxyRestriction does not allow issuing assertions to %q", audience)
+		}
+	}
+
+	rv := &ProxyRestriction{
+		Audiences: append([]Audience(nil), restriction.Audiences...),
+	}
+	if restriction.Count != nil {
+		count := *restriction.Count - 1
+		rv.Count = &count
+	}
+	return rv, nil
+}
@@ -0,0 +1,104 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// redirectSignatureHashes are the hash functions of the signature
+// algorithms supported by SignRedirectQuery.
+var redirectSignatureHashes = map[string]struct {
+	hash crypto.Hash
+	new  func() hash.Hash
+}{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1":        {crypto.SHA1, sha1.New},
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": {crypto.SHA256, sha256.New},
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha384": {crypto.SHA384, sha512.New384},
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": {crypto.SHA512, sha512.New},
+}
+
+// SignRedirectQuery returns the query parameters that carry message, the
+// XML of a SAML request or response, with the HTTP-Redirect binding and a
+// signature made with sp.Key. The message is sent as the SAMLResponse
+// parameter if its root element is a response, such as a Response or a
+// LogoutResponse, and as SAMLRequest otherwise. The RelayState parameter
+// is omitted if relayState is empty. sigAlg is the URI of an RSA signature
+// algorithm, such as "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256".
+//
+// As described in section 3.4.4.1 of SAMLBindings, message is DEFLATE
+// compressed with RedirectCompressionLevel and base64 encoded, and the
+// signature is computed over
+//
+//	SAMLRequest=value&RelayState=value&SigAlg=value
+//
+// where each value is URL encoded as it is by the Encode method of the
+// returned url.Values.
+func (sp *ServiceProvider) SignRedirectQuery(message, relayState, sigAlg string) (url.Values, error) {
+	if sp.Key == nil {
+		return nil, errors.New("cannot sign redirect query: Key must be specified")
+	}
+	sigHash, ok := redirectSignatureHashes[sigAlg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", sigAlg)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(message); err != nil {
+		return nil, fmt.Errorf("cannot parse message: %s", err)
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("cannot parse message: no root element")
+	}
+	parameter := "SAMLRequest"
+	if strings.HasSuffix(doc.Root().Tag, "Response") {
+		parameter = "SAMLResponse"
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, sp.redirectCompressionLevel())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(message)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	encodedMessage := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	signedQuery := parameter + "=" + url.QueryEscape(encodedMessage)
+	if relayState != "" {
+		signedQuery += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	signedQuery += "&SigAlg=" + url.QueryEscape(sigAlg)
+
+	h := sigHash.new()
+	h.Write([]byte(signedQuery))
+	signature, err := rsa.SignPKCS1v15(RandReader, sp.Key, sigHash.hash, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set(parameter, encodedMessage)
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	query.Set("SigAlg", sigAlg)
+	query.Set("Signature", base64.StdEncoding.EncodeToString(signature))
+	return query, nil
+}
@@ -0,0 +1,138 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	dsig "github.com/russellhaering/goxmldsig"
+	. "gopkg.in/check.v1"
+)
+
+func (test *ServiceProviderTest) TestSignRedirectQuery(c *C) {
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+	}
+	message := `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0"/>`
+	sigAlg := "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+
+	query, err := s.SignRedirectQuery(message, "relay state", sigAlg)
+	c.Assert(err, IsNil)
+	c.Assert(query.Get("RelayState"), Equals, "relay state")
+	c.Assert(query.Get("SigAlg"), Equals, sigAlg)
+
+	compressedMessage, err := base64.StdEncoding.DecodeString(query.Get("SAMLRequest"))
+	c.Assert(err, IsNil)
+	decodedMessage, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedMessage)))
+	c.Assert(err, IsNil)
+	c.Assert(string(decodedMessage), Equals, message)
+
+	// the signature covers the parameters in the order of the binding,
+	// not the order of the encoded query
+	signedQuery := "SAMLRequest=" + url.QueryEscape(query.Get("SAMLRequest")) +
+		"&RelayState=relay+state" +
+		"&SigAlg=http%3A%2F%2Fwww.w3.org%2F2001%2F04%2Fxmldsig-more%23rsa-sha256"
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	c.Assert(err, IsNil)
+	digest := sha256.Sum256([]byte(signedQuery))
+	err = rsa.VerifyPKCS1v15(&test.Key.PublicKey, crypto.SHA256, digest[:], signature)
+	c.Assert(err, IsNil)
+
+	query, err = s.SignRedirectQuery(`<samlp:LogoutResponse xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"/>`,
+		"", "http://www.w3.org/2000/09/xmldsig#rsa-sha1")
+	c.Assert(err, IsNil)
+	c.Assert(query.Get("SAMLRequest"), Equals, "")
+	c.Assert(query.Get("SAMLResponse"), Not(Equals), "")
+	_, hasRelayState := query["RelayState"]
+	c.Assert(hasRelayState, Equals, false)
+
+	_, err = s.SignRedirectQuery(message, "", "http://www.w3.org/2001/04/xmldsig-more#hmac-sha256")
+	c.Assert(err, ErrorMatches, "unsupported signature algorithm \"http://www.w3.org/2001/04/xmldsig-more#hmac-sha256\"")
+
+	_, err = s.SignRedirectQuery("not xml", "", sigAlg)
+	c.Assert(err, ErrorMatches, "cannot parse message: .*")
+
+	s.Key = nil
+	_, err = s.SignRedirectQuery(message, "", sigAlg)
+	c.Assert(err, ErrorMatches, "cannot sign redirect query: Key must be specified")
+}
+
+// verifyRedirectQuery asserts that redirectURL carries a SAMLRequest signed
+// with key as SignRedirectQuery signs it, and returns the decoded request.
+func verifyRedirectQuery(c *C, redirectURL *url.URL, key *rsa.PublicKey) string {
+	query := redirectURL.Query()
+	signedQuery := "SAMLRequest=" + url.QueryEscape(query.Get("SAMLRequest"))
+	if relayState := query.Get("RelayState"); relayState != "" {
+		signedQuery += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	signedQuery += "&SigAlg=" + url.QueryEscape(query.Get("SigAlg"))
+
+	sigHash, ok := redirectSignatureHashes[query.Get("SigAlg")]
+	c.Assert(ok, Equals, true)
+	h := sigHash.new()
+	h.Write([]byte(signedQuery))
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	c.Assert(err, IsNil)
+	c.Assert(rsa.VerifyPKCS1v15(key, sigHash.hash, h.Sum(nil), signature), IsNil)
+
+	compressedRequest, err := base64.StdEncoding.DecodeString(query.Get("SAMLRequest"))
+	c.Assert(err, IsNil)
+	decodedRequest, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedRequest)))
+	c.Assert(err, IsNil)
+	return string(decodedRequest)
+}
+
+func (test *ServiceProviderTest) TestSignsRedirectAuthenticationRequestQuery(c *C) {
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		SignRequest: true,
+	}
+	c.Assert(xml.Unmarshal([]byte(test.IDPMetadata), s.IDPMetadata), IsNil)
+
+	// the request is signed by the query rather than an enveloped signature
+	req, err := s.MakeAuthenticationRequestForBinding(HTTPRedirectBinding)
+	c.Assert(err, IsNil)
+	c.Assert(req.Signature, IsNil)
+
+	redirectURL, err := s.MakeRedirectAuthenticationRequest("relayState")
+	c.Assert(err, IsNil)
+	c.Assert(redirectURL.Query().Get("SigAlg"), Equals, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+	c.Assert(redirectURL.Query().Get("RelayState"), Equals, "relayState")
+	decodedRequest := verifyRedirectQuery(c, redirectURL, &test.Key.PublicKey)
+	c.Assert(decodedRequest, Matches, "<samlp:AuthnRequest .*")
+	c.Assert(strings.Contains(decodedRequest, "Signature"), Equals, false)
+
+	// an enveloped signature of a request made for another binding is
+	// replaced by that of the query
+	req, err = s.MakeAuthenticationRequest(s.GetSSOBindingLocation(HTTPRedirectBinding))
+	c.Assert(err, IsNil)
+	c.Assert(req.Signature, NotNil)
+	redirectURL, err = s.RedirectURL(req, "")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(verifyRedirectQuery(c, redirectURL, &test.Key.PublicKey), "Signature"), Equals, false)
+
+	s.SignatureMethod = dsig.RSASHA512SignatureMethod
+	redirectURL, err = s.MakeRedirectAuthenticationRequest("relayState")
+	c.Assert(err, IsNil)
+	c.Assert(redirectURL.Query().Get("SigAlg"), Equals, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512")
+	verifyRedirectQuery(c, redirectURL, &test.Key.PublicKey)
+
+	// unsigned requests have no signature parameters
+	s.SignRequest = false
+	redirectURL, err = s.MakeRedirectAuthenticationRequest("relayState")
+	c.Assert(err, IsNil)
+	c.Assert(redirectURL.Query().Get("SigAlg"), Equals, "")
+	c.Assert(redirectURL.Query().Get("Signature"), Equals, "")
+}
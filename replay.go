@@ -0,0 +1,80 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ReplayStore records the IDs of the assertions that ParseResponse has
+// accepted, so that an assertion that is posted a second time, for example
+// by someone who captured it, is rejected. Since a ServiceProvider may run
+// on several servers, a ReplayStore is typically backed by a shared
+// database, such as Redis. If it also implements io.Closer, the Close method
+// of a samlsp.Middleware closes it.
+type ReplayStore interface {
+	// Consume records that the assertion whose ID is id has been used. It
+	// returns ErrReplay if it already was, and any other error if the store
+	// could not be consulted. Once expires has passed, ParseResponse no
+	// longer accepts the assertion, so the store may forget it.
+	Consume(id string, expires time.Time) error
+}
+
+// ErrReplay is returned by a ReplayStore, and is the PrivateErr of the
+// InvalidResponseError returned by ParseResponse, when an assertion has
+// already been used.
+var ErrReplay = errors.New("assertion has already been used")
+
+// ReplayStoreError is the PrivateErr of the InvalidResponseError returned
+// by ParseResponse when the ReplayStore fails with an error other than
+// ErrReplay and ReplayStoreFailMode is ReplayStoreFailClosed.
+type ReplayStoreError struct {
+	AssertionID string
+	Err         error
+}
+
+func (e *ReplayStoreError) Error() string {
+	return fmt.Sprintf("cannot check assertion %s for replay: %s", e.AssertionID, e.Err)
+}
+
+// ReplayStoreFailMode determines how a ServiceProvider handles an
+// assertion when its ReplayStore cannot be consulted, for example because
+// the database behind it is down.
+type ReplayStoreFailMode int
+
+const (
+	// ReplayStoreFailClosed causes the assertion to be rejected with a
+	// ReplayStoreError, since it might be a replay.
+	ReplayStoreFailClosed ReplayStoreFailMode = iota
+
+	// ReplayStoreFailOpen causes the assertion to be accepted without
+	// replay protection, so that users can still log in while the store is
+	// unavailable.
+	ReplayStoreFailOpen
+)
+
+// consumeAssertion records in sp.ReplayStore that assertion has been used.
+// Replays and failures of the store are logged differently, so that an
+// outage of the store is not mistaken for an attack.
+func (sp *ServiceProvider) consumeAssertion(assertion *Assertion) error {
+	err := sp.ReplayStore.Consume(assertion.ID, assertion.IssueInstant.Add(MaxIssueDelay))
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrReplay:
+		if sp.Logger != nil {
+			sp.Logger.Printf("WARNING: assertion %s from %s has already been used", assertion.ID, assertion.Issuer.Value)
+		}
+		return ErrReplay
+	case sp.ReplayStoreFailMode == ReplayStoreFailOpen:
+		if sp.Logger != nil {
+			sp.Logger.Printf("ERROR: replay store: %s (accepting assertion %s without replay protection)", err, assertion.ID)
+		}
+		return nil
+	default:
+		if sp.Logger != nil {
+			sp.Logger.Printf("ERROR: replay store: %s (rejecting assertion %s)", err, assertion.ID)
+		}
+		return &ReplayStoreError{AssertionID: assertion.ID, Err: err}
+	}
+}
@@ -0,0 +1,158 @@
+package samlsp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/launchpadcentral/saml"
+)
+
+// IDPMetadataChange describes how the metadata of an IDP differs from the
+// metadata that it replaced, for example when it is refreshed. Certificates
+// are identified by their fingerprint, the hex encoded SHA-256 hash of the
+// DER encoded certificate.
+type IDPMetadataChange struct {
+	EntityID string
+
+	AddedSigningCertificates   []string
+	RemovedSigningCertificates []string
+
+	// SingleSignOnServices and SingleLogoutServices list the endpoints
+	// whose location has changed, by binding.
+	SingleSignOnServices []EndpointChange
+	SingleLogoutServices []EndpointChange
+
+	OldValidUntil time.Time
+	NewValidUntil time.Time
+}
+
+// EndpointChange describes the change of the location of an endpoint with
+// Binding. OldLocation is empty if the endpoint was added, and NewLocation
+// is empty if it was removed.
+type EndpointChange struct {
+	Binding     string
+	OldLocation string
+	NewLocation string
+}
+
+// SigningCertificatesChanged returns true if a signing certificate was added
+// or removed.
+func (c IDPMetadataChange) SigningCertificatesChanged() bool {
+	return len(c.AddedSigningCertificates) > 0 || len(c.RemovedSigningCertificates) > 0
+}
+
+// IsEmpty returns true if nothing that IDPMetadataChange describes has
+// changed.
+func (c IDPMetadataChange) IsEmpty() bool {
+	return !c.SigningCertificatesChanged() &&
+		len(c.SingleSignOnServices) == 0 &&
+		len(c.SingleLogoutServices) == 0 &&
+		c.OldValidUntil.Equal(c.NewValidUntil)
+}
+
+// DiffIDPMetadata returns the changes from oldEntity to newEntity.
+func DiffIDPMetadata(oldEntity, newEntity *saml.EntityDescriptor) IDPMetadataChange {
+	change := IDPMetadataChange{
+		EntityID:      newEntity.EntityID,
+		OldValidUntil: oldEntity.ValidUntil,
+		NewValidUntil: newEntity.ValidUntil,
+	}
+	change.AddedSigningCertificates, change.RemovedSigningCertificates = diffStrings(
+		signingCertificateFingerprints(oldEntity), signingCertificateFingerprints(newEntity))
+	change.SingleSignOnServices = diffEndpoints(
+		endpointLocations(oldEntity, singleSignOnServices), endpointLocations(newEntity, singleSignOnServices))
+	change.SingleLogoutServices = diffEndpoints(
+		endpointLocations(oldEntity, singleLogoutServices), endpointLocations(newEntity, singleLogoutServices))
+	return change
+}
+
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+// signingCertificateFingerprints returns the fingerprints of the
+// certificates in entity that can be used for signing, that is, those
+// whose use is "signing" or unspecified.
+func signingCertificateFingerprints(entity *saml.EntityDescriptor) map[string]bool {
+	fingerprints := map[string]bool{}
+	for _, idpSSODescriptor := range entity.IDPSSODescriptors {
+		for _, keyDescriptor := range idpSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use != "signing" && keyDescriptor.Use != "" {
+				continue
+			}
+			certStr := whitespaceRegexp.ReplaceAllString(keyDescriptor.KeyInfo.Certificate, "")
+			certBytes, err := base64.StdEncoding.DecodeString(certStr)
+			if err != nil || len(certBytes) == 0 {
+				continue
+			}
+			sum := sha256.Sum256(certBytes)
+			fingerprints[hex.EncodeToString(sum[:])] = true
+		}
+	}
+	return fingerprints
+}
+
+func singleSignOnServices(d *saml.IDPSSODescriptor) []saml.Endpoint { return d.SingleSignOnServices }
+func singleLogoutServices(d *saml.IDPSSODescriptor) []saml.Endpoint { return d.SingleLogoutServices }
+
+// endpointLocations returns the locations of the endpoints of entity that
+// services selects, by binding. If there are several endpoints with a
+// binding, the first is used, as GetSSOBindingLocation does.
+func endpointLocations(entity *saml.EntityDescriptor, services func(*saml.IDPSSODescriptor) []saml.Endpoint) map[string]string {
+	locations := map[string]string{}
+	for i := range entity.IDPSSODescriptors {
+		for _, endpoint := range services(&entity.IDPSSODescriptors[i]) {
+			if _, ok := locations[endpoint.Binding]; !ok {
+				locations[endpoint.Binding] = endpoint.Location
+			}
+		}
+	}
+	return locations
+}
+
+// diffStrings returns the sorted elements of newSet that are not in oldSet,
+// and those of oldSet that are not in newSet.
+func diffStrings(oldSet, newSet map[string]bool) (added []string, removed []string) {
+	for s := range newSet {
+		if !oldSet[s] {
+			added = append(added, s)
+		}
+	}
+	for s := range oldSet {
+		if !newSet[s] {
+			removed = append(removed, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// diffEndpoints returns the changes from the locations in oldLocations to
+// those in newLocations, ordered by binding.
+func diffEndpoints(oldLocations, newLocations map[string]string) []EndpointChange {
+	bindings := []string{}
+	for binding := range oldLocations {
+		bindings = append(bindings, binding)
+	}
+	for binding := range newLocations {
+		if _, ok := oldLocations[binding]; !ok {
+			bindings = append(bindings, binding)
+		}
+	}
+	sort.Strings(bindings)
+
+	var changes []EndpointChange
+	for _, binding := range bindings {
+		if oldLocations[binding] != newLocations[binding] {
+			changes = append(changes, EndpointChange{
+				Binding:     binding,
+				OldLocation: oldLocations[binding],
+				NewLocation: newLocations[binding],
+			})
+		}
+	}
+	return changes
+}
@@ -1,16 +1,26 @@
 package samlsp
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/launchpadcentral/saml"
+	"github.com/launchpadcentral/saml/logger"
 )
 
 // Middleware implements middleware than allows a web application
@@ -23,10 +33,12 @@ import (
 // the auth process if they do not have session credentials.
 //
 // When redirecting the user through the SAML auth flow, the middlware assigns
-// a temporary cookie with a random name beginning with "saml_". The value of
-// the cookie is a signed JSON Web Token containing the original URL requested
-// and the SAML request ID. The random part of the name corresponds to the
-// RelayState parameter passed through the SAML flow.
+// a temporary tracking cookie with a random name beginning with "saml_" (see
+// TrackingCookieName). The value of
+// the cookie is a signed JSON Web Token containing the original URL requested,
+// the SAML request ID and the RelayState given to HandleStartAuthFlow, if any.
+// The random part of the name is the RelayState parameter passed through the
+// SAML flow.
 //
 // When validating the SAML response, the RelayState is used to look up the
 // correct cookie, validate that the SAML request ID, and redirect the user
@@ -46,18 +58,275 @@ import (
 //
 // When issuing JSON Web Tokens, a signing key is required. Because the
 // SAML service provider already has a private key, we borrow that key
-// to sign the JWTs as well.
+// to sign the JWTs as well. If SessionEncryption is set, the session JWT
+// is also encrypted, so that the client cannot read the attributes.
+//
+// A single Middleware can serve several service providers (for example one
+// per tenant) by setting ServiceProviderResolver. When it is set, each
+// request is handled by the ServiceProvider it returns rather than by
+// ServiceProvider.
 type Middleware struct {
-	ServiceProvider   saml.ServiceProvider
-	AllowIDPInitiated bool
-	CookieName        string
-	CookieMaxAge      time.Duration
-	CookieDomain      string
-	RetryCount        int
+	ServiceProvider         saml.ServiceProvider
+	ServiceProviderResolver ServiceProviderResolver
+	AllowIDPInitiated       bool
+	CookieName              string
+	CookieMaxAge            time.Duration
+	CookieDomain            string
+	RetryCount              int
+
+	// Passive causes the authentication requests made by HandleStartAuthFlow
+	// to ask the IDP not to interact with the user, for example when logging
+	// in silently from an iframe. If the IDP responds that it cannot
+	// authenticate the user passively, the ACS starts the interactive flow
+	// for the same URL instead of failing.
+	Passive bool
+
+	// AuthnRequestBinding is the binding with which authentication requests
+	// are sent to the IDP, saml.HTTPRedirectBinding or saml.HTTPPostBinding.
+	// With the HTTP-POST binding the user's browser is sent a form that
+	// submits itself to the IDP, or that the user submits if scripts are
+	// disabled. If empty, or if the IDP does not support the binding,
+	// HTTP-Redirect is used if the IDP supports it and HTTP-POST otherwise.
+	AuthnRequestBinding string
+
+	// IDPMetadataPins, if not empty, lists the pins of the TLS certificates
+	// that FetchIDPMetadata accepts from the metadata server, as returned by
+	// SPKIPin. The fetch succeeds only if a certificate in the server's chain
+	// matches one of them, which protects the metadata, and therefore the
+	// IDP's signing certificate, from a compromised certificate authority.
+	// Redirects to another host are not followed.
+	IDPMetadataPins []string
+
+	// MaxMetadataEntities limits how many entities AddIDPMetadataByEntityID
+	// examines when searching aggregate metadata. If zero, there is no limit.
+	MaxMetadataEntities int
+
+	// DuplicateEntityIDs determines what AddIDPMetadata and
+	// AddIDPMetadataByEntityID do when aggregate metadata contains more than
+	// one entity with the same EntityID. By default the metadata is
+	// rejected.
+	DuplicateEntityIDs DuplicateEntityIDPolicy
+
+	// RequestTrackerMaxAge is how long a pending authentication request
+	// is tracked. If zero, 15 minutes is used.
+	RequestTrackerMaxAge time.Duration
+
+	// RestartExpiredRequests causes the ACS, when it receives a response
+	// that would be accepted but for the request it answers having expired
+	// after RequestTrackerMaxAge, to start the login flow again for the
+	// same URL rather than fail. This happens when a user leaves the IDP's
+	// login page open for a long time. Either way the ACS logs
+	// ErrRequestExpired. Expired requests are only recognized while the
+	// browser still sends their tracking cookies, so TrackingCookieMaxAge
+	// should be longer than RequestTrackerMaxAge.
+	RestartExpiredRequests bool
+
+	// RequestTrackerMaxCount is the largest number of pending requests that
+	// are honored at once. When more are presented to the ACS, the oldest
+	// are discarded. If zero, 10 is used.
+	RequestTrackerMaxCount int
+
+	// MaxRelayStateLength is the length, in bytes, of the longest RelayState
+	// that HandleStartAuthFlow keeps in a tracking cookie. If zero, 80 is
+	// used.
+	MaxRelayStateLength int
+
+	// MaxACSRequestSize is the size, in bytes, of the largest request body
+	// that the ACS reads, so that a huge SAMLResponse cannot exhaust memory.
+	// Larger requests are rejected with 413 Request Entity Too Large. If
+	// zero, 4 MB is used.
+	MaxACSRequestSize int64
+
+	// RelayStateStore, if set, keeps the RelayState values passed to
+	// HandleStartAuthFlow that are longer than MaxRelayStateLength. See
+	// NewMemoryRelayStateStore.
+	RelayStateStore RelayStateStore
+
+	// TrackingCookieName is the prefix of the names of the cookies that
+	// track pending authentication requests. If empty, "saml_" is used.
+	TrackingCookieName string
+
+	// TrackingCookieSameSite is the SameSite attribute of the tracking
+	// cookies. If empty, SameSiteNone is used so that the cookies are sent
+	// along with the IDP's cross-site POST to the ACS.
+	TrackingCookieSameSite SameSite
+
+	// TrackingCookieSecure controls the Secure attribute of the tracking
+	// cookies. If nil, the cookies are Secure, which browsers require of
+	// cookies with SameSite=None. It is ignored if RequireHTTPS is set.
+	TrackingCookieSecure *bool
+
+	// RequireHTTPS causes the session and tracking cookies to always be
+	// Secure, so that browsers never send them over plaintext HTTP. By
+	// default the session cookie is Secure only if the request that
+	// established the session was made over HTTPS, as determined by
+	// ServiceProvider.RequestScheme, which trusts the header named by
+	// ServiceProvider.ForwardedProtoHeader if it is set. See
+	// Options.RequireHTTPS.
+	RequireHTTPS bool
+
+	// TrackingCookieMaxAge is the Max-Age of the tracking cookies. If zero,
+	// RequestTrackerMaxAge is used. Tracked requests are not honored after
+	// RequestTrackerMaxAge regardless of this value.
+	TrackingCookieMaxAge time.Duration
+
+	// OnSuccess, if set, writes the response of the ACS once the session
+	// cookie has been set, in place of the default redirect. JSONRedirect
+	// can be used for flows driven by XMLHttpRequest.
+	OnSuccess SuccessHandler
+
+	// SuccessRedirectStatus is the status of the default redirect from the
+	// ACS to the original URL. If zero, 303 See Other is used, which tells
+	// the client to follow the redirect of the IDP's POST with a GET. It
+	// can be set to http.StatusFound for clients that expect the status of
+	// earlier versions.
+	SuccessRedirectStatus int
+
+	// SessionEncryption selects whether the session cookie is a signed JWT,
+	// whose claims the client can read, or is also encrypted. See the
+	// values of SessionEncryption. GetSession decrypts encrypted sessions,
+	// and treats sessions that cannot be decrypted as invalid.
+	SessionEncryption SessionEncryption
+
+	// SessionEncryptionKey is the AES key used when SessionEncryption is
+	// SessionEncryptedDirect.
+	SessionEncryptionKey []byte
+
+	// PreviousSessionKeys are keys that the ServiceProvider used before its
+	// current Key, for example before the key pair was rotated. Sessions
+	// and tracked requests made with one of them are still accepted, so
+	// that users are not sent through the login flow again, and logins in
+	// progress do not fail, during the rotation. A key can be
+	// removed once the sessions made with it have expired. Sessions made
+	// with any other key are treated as absent, and GetSession returns
+	// ErrSessionKeyRetired for them. It must not be modified while the
+	// Middleware is serving requests.
+	PreviousSessionKeys []*rsa.PrivateKey
+
+	// RefreshStaleMetadata, if true, fetches the IDP metadata again in the
+	// background when the ACS rejects a response with a
+	// saml.StaleMetadataError, that is, because the signing certificate in
+	// the metadata has expired. The response is rejected regardless, but
+	// the next login succeeds once the IDP publishes its new certificate.
+	// It has no effect unless the Middleware was created by New with an
+	// IDPMetadataURL.
+	RefreshStaleMetadata bool
+
+	// LogoutRedirectURL, if set, is the URL, such as a "logged out" page,
+	// to which Logout redirects the user's browser once the session has
+	// been removed.
+	LogoutRedirectURL string
+
+	// OnIDPMetadataChange, if set, is called when the metadata of an IDP is
+	// replaced by metadata that differs from it, for example when it is
+	// fetched again because of RefreshStaleMetadata. It can be used to
+	// audit changes of the IDP's certificates and endpoints.
+	OnIDPMetadataChange func(change IDPMetadataChange)
+
+	// AuthorizeLogin, if set, is called by the ACS once a response has been
+	// validated, with the entity ID of the IDP that issued the assertion.
+	// If it returns an error, the login is rejected with 403 Forbidden and
+	// the error is logged. It can be used when several IDPs are trusted to
+	// ensure that each user is authenticated by the IDP responsible for
+	// them, for example by the domain of their NameID.
+	AuthorizeLogin func(issuer string, assertion *saml.Assertion) error
+
+	// ClaimAttributeNames maps the claims returned by Claims to the names
+	// of the attributes that may hold them, in order of preference, to suit
+	// IDPs that use other names than the defaults. If nil,
+	// saml.DefaultClaimAttributeNames is used.
+	ClaimAttributeNames map[string][]string
+
+	// ctx is cancelled by Close to stop the background work of the
+	// Middleware. It is nil unless the Middleware was created by New.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// keyPairMu guards the Key and Certificate of ServiceProvider against
+	// ReloadKeyPair, and its IDP metadata against refreshes.
+	keyPairMu sync.RWMutex
+
+	// background tracks the goroutines that refresh the IDP metadata.
+	background sync.WaitGroup
+
+	// closeOnce ensures that Close closes the ReplayStore once, and
+	// closeErr is the error that it returned.
+	closeOnce sync.Once
+	closeErr  error
+
+	// idpMetadataURL and httpClient are those that New fetched the IDP
+	// metadata with, and are used to refresh it. refreshingMetadata is 1
+	// while a refresh is in progress.
+	idpMetadataURL     *url.URL
+	httpClient         *http.Client
+	refreshingMetadata int32
+}
+
+// SameSite is the value of the SameSite attribute of a cookie.
+type SameSite string
+
+// Values for SameSite
+const (
+	SameSiteNone   SameSite = "None"
+	SameSiteLax    SameSite = "Lax"
+	SameSiteStrict SameSite = "Strict"
+)
+
+// DuplicateEntityIDPolicy determines how AddIDPMetadata and
+// AddIDPMetadataByEntityID handle aggregate metadata in which several
+// EntityDescriptors share an EntityID, which makes it ambiguous which of
+// them is to be trusted.
+type DuplicateEntityIDPolicy int
+
+const (
+	// RejectDuplicateEntityIDs causes AddIDPMetadata to fail when the
+	// metadata contains duplicate EntityIDs, and AddIDPMetadataByEntityID
+	// to fail when it contains more than one entity with the EntityID.
+	RejectDuplicateEntityIDs DuplicateEntityIDPolicy = iota
+
+	// UseLastDuplicateEntityID causes AddIDPMetadata and
+	// AddIDPMetadataByEntityID to use the last of the IDP entities that
+	// share an EntityID, as earlier versions did.
+	UseLastDuplicateEntityID
+)
+
+// ServiceProviderResolver returns the ServiceProvider that should handle
+// the request r, for example by examining r.Host or r.URL.Path. The
+// returned ServiceProvider must be fully configured, including its Key,
+// Certificate, MetadataURL, AcsURL, IDPMetadata and Logger. Responses
+// received at its AcsURL are validated against its own entity ID.
+type ServiceProviderResolver func(r *http.Request) (*saml.ServiceProvider, error)
+
+// SuccessHandler writes the response to a successful login. redirectURI is
+// the URL that was originally requested, or "/" for IDP initiated logins,
+// and claims are the contents of the session that was established.
+type SuccessHandler func(w http.ResponseWriter, r *http.Request, redirectURI string, claims *TokenClaims)
+
+// JSONRedirect is a SuccessHandler that responds with status 200 and a JSON
+// object of the form {"redirect": "..."} rather than redirecting.
+func JSONRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, claims *TokenClaims) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Redirect string `json:"redirect"`
+	}{Redirect: redirectURI})
 }
 
 const defaultCookieMaxAge = time.Hour
 const defaultCookieName = "token"
+const defaultRequestTrackerMaxAge = 15 * time.Minute
+const defaultRequestTrackerMaxCount = 10
+
+// defaultMaxRelayStateLength is the largest RelayState that IDPs must
+// accept. See section 3.4.3 of SAMLBindings.
+const defaultMaxRelayStateLength = 80
+const defaultMaxACSRequestSize = 4 << 20
+const defaultTrackingCookieName = "saml_"
+
+// trackingKeySize is the number of random bytes of the key that is sent to
+// the IDP as the RelayState to identify a tracked request, and
+// trackingKeyLength is the length of its base64 encoding.
+const trackingKeySize = 42
+const trackingKeyLength = trackingKeySize / 3 * 4
 
 var jwtSigningMethod = jwt.SigningMethodHS256
 
@@ -69,29 +338,195 @@ func randomBytes(n int) []byte {
 	return rv
 }
 
+// Close stops the work that the Middleware does in the background, such as
+// retrying a metadata fetch, and releases its resources. Pending and later
+// calls to FetchIDPMetadata fail with context.Canceled, and Close waits for
+// the refreshes of the IDP metadata in progress to stop. If the ReplayStore
+// of m.ServiceProvider implements io.Closer, Close closes it and returns its
+// error. Close does not affect the handling of HTTP requests. It is safe to
+// call Close more than once.
+func (m *Middleware) Close() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.background.Wait()
+	m.closeOnce.Do(func() {
+		if closer, ok := m.ServiceProvider.ReplayStore.(io.Closer); ok {
+			m.closeErr = closer.Close()
+		}
+	})
+	return m.closeErr
+}
+
+// context returns the context that governs the background work of m.
+func (m *Middleware) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// serviceProvider returns the ServiceProvider that handles r. This is a
+// copy of m.ServiceProvider unless a ServiceProviderResolver is configured,
+// so that a request is handled with one key pair even if ReloadKeyPair is
+// called meanwhile.
+func (m *Middleware) serviceProvider(r *http.Request) (*saml.ServiceProvider, error) {
+	if m.ServiceProviderResolver == nil {
+		return m.defaultServiceProvider(), nil
+	}
+	return m.ServiceProviderResolver(r)
+}
+
+// defaultServiceProvider returns a copy of m.ServiceProvider.
+func (m *Middleware) defaultServiceProvider() *saml.ServiceProvider {
+	m.keyPairMu.RLock()
+	sp := m.ServiceProvider
+	m.keyPairMu.RUnlock()
+	return &sp
+}
+
+// ReloadKeyPair replaces the Key and Certificate of m.ServiceProvider, for
+// example when the certificate is rotated. Requests that are in progress
+// continue to use the previous pair, and those that start afterwards use
+// the new one. An error is returned, and nothing is changed, if key is not
+// the private key of cert.
+//
+// Because session and tracking cookies are signed with the key, they are
+// no longer valid once it changes, unless the previous key is in
+// PreviousSessionKeys. Otherwise users with a session are sent through the
+// login flow again, and logins in progress fail.
+//
+// ReloadKeyPair can be called from a signal handler or a file watcher, for
+// example:
+//
+//	sighup := make(chan os.Signal, 1)
+//	signal.Notify(sighup, syscall.SIGHUP)
+//	go func() {
+//		for range sighup {
+//			key, cert, err := loadKeyPair()
+//			if err == nil {
+//				err = m.ReloadKeyPair(key, cert)
+//			}
+//			if err != nil {
+//				log.Printf("cannot reload key pair: %s", err)
+//			}
+//		}
+//	}()
+//
+// It has no effect on the service providers returned by a
+// ServiceProviderResolver.
+func (m *Middleware) ReloadKeyPair(key *rsa.PrivateKey, cert *x509.Certificate) error {
+	if key == nil || cert == nil {
+		return errors.New("key and certificate must be specified")
+	}
+	certPublicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || certPublicKey.N.Cmp(key.PublicKey.N) != 0 || certPublicKey.E != key.PublicKey.E {
+		return errors.New("key does not match the certificate")
+	}
+
+	m.keyPairMu.Lock()
+	defer m.keyPairMu.Unlock()
+	m.ServiceProvider.Key = key
+	m.ServiceProvider.Certificate = cert
+	return nil
+}
+
+// logger returns the logger for messages that are not associated with a
+// particular ServiceProvider.
+func (m *Middleware) logger() logger.Interface {
+	if m.ServiceProvider.Logger == nil {
+		return logger.DefaultLogger
+	}
+	return m.ServiceProvider.Logger
+}
+
 // ServeHTTP implements http.Handler and serves the SAML-specific HTTP endpoints
 // on the URIs specified by m.ServiceProvider.MetadataURL and
 // m.ServiceProvider.AcsURL.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.HasSuffix(m.ServiceProvider.MetadataURL.Path, r.URL.Path) {
-		buf, _ := xml.MarshalIndent(m.ServiceProvider.Metadata(), "", "  ")
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		m.logger().Printf("ERROR: cannot resolve service provider: %s", err)
+		http.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+
+	if strings.HasSuffix(sp.MetadataURL.Path, r.URL.Path) {
+		buf, _ := xml.MarshalIndent(sp.Metadata(), "", "  ")
 		w.Header().Set("Content-Type", "application/samlmetadata+xml")
 		w.Write(buf)
 		return
 	}
 
-	if strings.HasSuffix(m.ServiceProvider.AcsURL.Path, r.URL.Path) {
-		r.ParseForm()
-		assertion, err := m.ServiceProvider.ParseResponse(r, m.getPossibleRequestIDs(r))
+	if strings.HasSuffix(sp.AcsURL.Path, r.URL.Path) {
+		m.pruneTrackedRequests(w, r)
+		if r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: r.Body, remaining: m.maxACSRequestSize()}
+		}
+		var assertion *saml.Assertion
+		var warnings []saml.Warning
+		if sp.ECP && strings.HasPrefix(r.Header.Get("Content-Type"), saml.PAOSContentType) {
+			// The RelayState of an ECP response is carried in the SOAP
+			// envelope, so it is made available to Authorize as if it
+			// had been posted.
+			var relayState string
+			assertion, relayState, err = sp.ParseECPResponse(r, m.getPossibleRequestIDs(r))
+			r.Form = url.Values{"RelayState": {relayState}}
+		} else {
+			if err := r.ParseForm(); err == errACSRequestTooLarge {
+				sp.Logger.Printf("ERROR: ACS request exceeds %d bytes", m.maxACSRequestSize())
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				sp.Logger.Printf("ERROR: cannot parse ACS request: %s", err)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			assertion, warnings, err = sp.ParseResponseWithWarnings(r, m.getPossibleRequestIDs(r))
+		}
+		for _, warning := range warnings {
+			sp.Logger.Printf("WARNING: %s", warning)
+		}
 		if err != nil {
 			if parseErr, ok := err.(*saml.InvalidResponseError); ok {
-				m.ServiceProvider.Logger.Printf("RESPONSE: ===\n%s\n===\nNOW: %s\nERROR: %s",
+				var expiredRequest jwt.MapClaims
+				if idErr, ok := parseErr.PrivateErr.(*saml.InResponseToError); ok {
+					if !sp.ECP || !strings.HasPrefix(r.Header.Get("Content-Type"), saml.PAOSContentType) {
+						expiredRequest = m.expiredRequest(r, sp, idErr.InResponseTo)
+					}
+				}
+				if expiredRequest != nil {
+					parseErr.PrivateErr = ErrRequestExpired
+				}
+				sp.Logger.Printf("RESPONSE: ===\n%s\n===\nNOW: %s\nERROR: %s",
 					parseErr.Response, parseErr.Now, parseErr.PrivateErr)
+				if _, ok := parseErr.PrivateErr.(*saml.StaleMetadataError); ok && m.RefreshStaleMetadata {
+					m.refreshIDPMetadata()
+				}
+				if parseErr.PrivateErr == saml.ErrNoPassive && m.Passive {
+					m.restartInteractiveAuthFlow(w, r, sp)
+					return
+				}
+				if expiredRequest != nil && m.RestartExpiredRequests {
+					redirectURI, _ := expiredRequest["uri"].(string)
+					relayState := m.trackedRelayState(sp, expiredRequest)
+					forceAuthn, _ := expiredRequest["force_authn"].(bool)
+					m.startAuthFlow(w, r, sp, relayState, redirectURI, m.Passive, forceAuthn)
+					return
+				}
 			}
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 
+		if m.AuthorizeLogin != nil {
+			if err := m.AuthorizeLogin(assertion.Issuer.Value, assertion); err != nil {
+				sp.Logger.Printf("login from %q rejected: %s", assertion.Issuer.Value, err)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
 		m.Authorize(w, r, assertion)
 		return
 	}
@@ -104,9 +539,35 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // session, then rather than serve the request, the middlware redirects the user
 // to start the SAML auth flow.
 func (m *Middleware) RequireAccount(handler http.Handler) http.Handler {
+	return m.RequireRecentAccount(handler, 0)
+}
+
+// RequireRecentAccount is like RequireAccount, but also requires that the
+// user authenticated to the IDP no more than maxSessionAge ago, as recorded
+// in the AuthnInstant of the session. It can protect sensitive routes more
+// strictly than the session cookie, whose expiry is CookieMaxAge. If the
+// session is older, the user's browser is sent to the IDP with ForceAuthn
+// set, so that the user authenticates again even if their session at the
+// IDP is still valid, and is returned to the original URL afterwards. If
+// maxSessionAge is zero, it behaves as RequireAccount.
+//
+// If the assertion that the IDP returns to such a request records an
+// AuthnInstant from before the request, the IDP did not honor ForceAuthn
+// and the ACS rejects it rather than start the flow again.
+func (m *Middleware) RequireRecentAccount(handler http.Handler, maxSessionAge time.Duration) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if m.IsAuthorized(r) {
-			handler.ServeHTTP(w, r)
+		if token := m.authorizeRequest(r); token != nil {
+			if maxSessionAge == 0 || !sessionOlderThan(token, maxSessionAge) {
+				handler.ServeHTTP(w, r.WithContext(WithToken(r.Context(), token)))
+				return
+			}
+			sp, err := m.serviceProvider(r)
+			if err != nil {
+				m.logger().Printf("ERROR: cannot resolve service provider: %s", err)
+				http.NotFoundHandler().ServeHTTP(w, r)
+				return
+			}
+			m.startAuthFlow(w, r, sp, "", r.URL.String(), false, true)
 			return
 		}
 
@@ -114,91 +575,498 @@ func (m *Middleware) RequireAccount(handler http.Handler) http.Handler {
 		// end up in a loop. This is a programming error, so we panic here. In
 		// general this means a 500 to the user, which is preferable to a
 		// redirect loop.
-		if r.URL.Path == m.ServiceProvider.AcsURL.Path {
+		if sp, err := m.serviceProvider(r); err == nil && r.URL.Path == sp.AcsURL.Path {
 			panic("don't wrap Middleware with RequireAccount")
 		}
 
-		binding := saml.HTTPRedirectBinding
-		bindingLocation := m.ServiceProvider.GetSSOBindingLocation(binding)
-		if bindingLocation == "" {
-			binding = saml.HTTPPostBinding
-			bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
-		}
+		m.HandleStartAuthFlow(w, r, "")
+	}
+	return http.HandlerFunc(fn)
+}
+
+// HandleStartAuthFlow initiates the SAML auth flow by redirecting (or
+// posting) the user's browser to the IDP. When the flow completes the
+// user is returned to the URL of r.
+//
+// The RelayState sent to the IDP is always the random key of the tracking
+// cookie. relayState, if not empty, is kept in the signed tracking cookie
+// instead, and is restored verbatim as the "RelayState" form value when
+// Authorize is invoked, so it is neither seen nor altered by the IDP.
+//
+// Values longer than MaxRelayStateLength are kept in RelayStateStore, and
+// an opaque token is kept in the tracking cookie instead. The value is then
+// restored as the "RelayState" form value once Authorize has found the
+// tracked request it belongs to, or is empty if the store no longer has it.
+// If RelayStateStore is nil, such values are rejected with a
+// StatusBadRequest response.
+func (m *Middleware) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request, relayState string) {
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		m.logger().Printf("ERROR: cannot resolve service provider: %s", err)
+		http.NotFoundHandler().ServeHTTP(w, r)
+		return
+	}
+	m.startAuthFlow(w, r, sp, relayState, r.URL.String(), m.Passive, false)
+}
 
-		req, err := m.ServiceProvider.MakeAuthenticationRequest(bindingLocation)
+// restartInteractiveAuthFlow starts the interactive auth flow for the
+// request tracked by the RelayState of r, after the IDP was unable to
+// authenticate the user passively. The new request carries the RelayState
+// of the caller, and its tracking cookie replaces that of the passive
+// request.
+func (m *Middleware) restartInteractiveAuthFlow(w http.ResponseWriter, r *http.Request, sp *saml.ServiceProvider) {
+	trackingKey := r.Form.Get("RelayState")
+	stateCookie, err := r.Cookie(m.stateCookieName(trackingKey))
+	if trackingKey == "" || err != nil {
+		sp.Logger.Printf("cannot find corresponding cookie: %s", m.stateCookieName(trackingKey))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	state, err := m.parseTrackingToken(sp, stateCookie.Value)
+	if err != nil || !state.Valid {
+		sp.Logger.Printf("Cannot decode state JWT: %s (%s)", err, stateCookie.Value)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	claims := state.Claims.(jwt.MapClaims)
+	redirectURI, _ := claims["uri"].(string)
+	relayState := m.trackedRelayState(sp, claims)
+	m.deleteTrackingCookie(w, sp, stateCookie.Name)
+	m.startAuthFlow(w, r, sp, relayState, redirectURI, false, false)
+}
+
+// startAuthFlow implements HandleStartAuthFlow. The user is returned to
+// redirectURI when the flow completes. If passive is true, the request asks
+// the IDP not to interact with the user. If forceAuthn is true, the request
+// asks the IDP to authenticate the user again, and the tracked request
+// records that the assertion must show that it did.
+func (m *Middleware) startAuthFlow(w http.ResponseWriter, r *http.Request, sp *saml.ServiceProvider, relayState string, redirectURI string, passive bool, forceAuthn bool) {
+	if passive {
+		passiveSP := *sp
+		isPassive := true
+		passiveSP.IsPassive = &isPassive
+		sp = &passiveSP
+	}
+	if forceAuthn {
+		forceAuthnSP := *sp
+		forceAuthnSP.ForceAuthn = &forceAuthn
+		sp = &forceAuthnSP
+	}
+
+	var relayStateToken string
+	if len(relayState) > m.maxRelayStateLength() {
+		if m.RelayStateStore == nil {
+			sp.Logger.Printf("ERROR: RelayState is %d bytes, which exceeds the limit of %d bytes",
+				len(relayState), m.maxRelayStateLength())
+			http.Error(w, "RelayState is too long", http.StatusBadRequest)
+			return
+		}
+		token, err := m.RelayStateStore.Put(relayState)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			sp.Logger.Printf("ERROR: cannot store RelayState: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		relayStateToken, relayState = token, ""
+	}
+
+	var req *saml.AuthnRequest
+	var err error
+	var binding string
+	if sp.ECP && saml.IsECPRequest(r) {
+		// The client is an Enhanced Client or Proxy, which relays the
+		// request to the IDP itself. See section 4.2 of SAMLProfiles.
+		binding = saml.PAOSBinding
+		req, err = sp.MakeECPAuthenticationRequest()
+	} else {
+		binding = m.authnRequestBinding(sp)
+		req, err = sp.MakeAuthenticationRequestForBinding(binding)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// relayState is limited to 80 bytes but also must be integrety protected.
-		// this means that we cannot use a JWT because it is way to long. Instead
-		// we set a cookie that corresponds to the state
-		relayState := base64.URLEncoding.EncodeToString(randomBytes(42))
+	// The RelayState is limited to 80 bytes, but must also be integrity
+	// protected, so a JWT is too long to be sent as the RelayState. Instead
+	// a random key is sent, and the JWT is kept in a cookie named after it.
+	trackingKey := base64.URLEncoding.EncodeToString(randomBytes(trackingKeySize))
 
-		secretBlock := x509.MarshalPKCS1PrivateKey(m.ServiceProvider.Key)
-		state := jwt.New(jwtSigningMethod)
-		claims := state.Claims.(jwt.MapClaims)
-		claims["id"] = req.ID
-		claims["uri"] = r.URL.String()
-		signedState, err := state.SignedString(secretBlock)
+	now := saml.TimeNow()
+	claims := jwt.MapClaims{}
+	claims["id"] = req.ID
+	claims["uri"] = redirectURI
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(m.requestTrackerMaxAge()).Unix()
+	if forceAuthn {
+		claims["force_authn"] = true
+	}
+	if relayState != "" {
+		claims["relay_state"] = relayState
+	}
+	if relayStateToken != "" {
+		claims["relay_state_token"] = relayStateToken
+	}
+	signedState, err := m.makeTrackingToken(sp, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.setTrackingCookie(w, sp, &http.Cookie{
+		Name:   m.stateCookieName(trackingKey),
+		Value:  signedState,
+		MaxAge: int(m.trackingCookieMaxAge().Seconds()),
+	})
+
+	if binding == saml.HTTPRedirectBinding {
+		redirectURL, err := sp.RedirectURL(req, trackingKey)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		w.Header().Add("Location", redirectURL.String())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	if binding == saml.PAOSBinding {
+		w.Header().Add("Content-type", saml.PAOSContentType)
+		w.Write(req.PAOS(trackingKey))
+		return
+	}
+	if binding == saml.HTTPPostBinding {
+		w.Header().Add("Content-Security-Policy", ""+
+			"default-src; "+
+			"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
+			"reflected-xss block; referrer no-referrer;")
+		w.Header().Add("Content-type", "text/html")
+		w.Write([]byte(`<!DOCTYPE html><html><body>`))
+		w.Write(req.Post(trackingKey))
+		w.Write([]byte(`</body></html>`))
+		return
+	}
+	panic("not reached")
+}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     fmt.Sprintf("saml_%s", relayState),
-			Value:    signedState,
-			MaxAge:   int(saml.MaxIssueDelay.Seconds()),
-			HttpOnly: true,
-			Secure:   r.URL.Scheme == "https",
-			Path:     m.ServiceProvider.AcsURL.Path,
-		})
+// authnRequestBinding returns the binding with which startAuthFlow sends
+// requests to the IDP of sp. See AuthnRequestBinding.
+func (m *Middleware) authnRequestBinding(sp *saml.ServiceProvider) string {
+	switch m.AuthnRequestBinding {
+	case saml.HTTPRedirectBinding, saml.HTTPPostBinding:
+		if sp.GetSSOBindingLocation(m.AuthnRequestBinding) != "" {
+			return m.AuthnRequestBinding
+		}
+	}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) != "" {
+		return saml.HTTPRedirectBinding
+	}
+	return saml.HTTPPostBinding
+}
 
-		if binding == saml.HTTPRedirectBinding {
-			redirectURL := req.Redirect(relayState)
-			w.Header().Add("Location", redirectURL.String())
-			w.WriteHeader(http.StatusFound)
-			return
+// makeTrackingToken returns claims signed with the key of sp, for a
+// tracking cookie. Like a session token, it names the key in its "kid"
+// header, so that it is still accepted after ReloadKeyPair if the key is
+// in PreviousSessionKeys.
+func (m *Middleware) makeTrackingToken(sp *saml.ServiceProvider, claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwtSigningMethod, claims)
+	token.Header["kid"] = sessionKeyID(sp.Key)
+	return token.SignedString(x509.MarshalPKCS1PrivateKey(sp.Key))
+}
+
+// parseTrackingToken parses value, a token made by makeTrackingToken. Like
+// jwt.Parse, it returns the token even if it is invalid, for example
+// because it has expired.
+func (m *Middleware) parseTrackingToken(sp *saml.ServiceProvider, value string) (*jwt.Token, error) {
+	jwtParser := jwt.Parser{
+		ValidMethods: []string{jwtSigningMethod.Name},
+	}
+	return jwtParser.Parse(value, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := m.sessionKey(sp, kid)
+		if err != nil {
+			return nil, err
 		}
-		if binding == saml.HTTPPostBinding {
-			w.Header().Add("Content-Security-Policy", ""+
-				"default-src; "+
-				"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
-				"reflected-xss block; referrer no-referrer;")
-			w.Header().Add("Content-type", "text/html")
-			w.Write([]byte(`<!DOCTYPE html><html><body>`))
-			w.Write(req.Post(relayState))
-			w.Write([]byte(`</body></html>`))
-			return
+		return x509.MarshalPKCS1PrivateKey(key), nil
+	})
+}
+
+// trackedRelayState returns the RelayState that was passed to
+// HandleStartAuthFlow for the request tracked by claims, fetching it from
+// RelayStateStore if it was kept there. If it is no longer in the store,
+// for example because it expired or another instance stored it, the miss is
+// logged and the RelayState is empty.
+func (m *Middleware) trackedRelayState(sp *saml.ServiceProvider, claims jwt.MapClaims) string {
+	token, _ := claims["relay_state_token"].(string)
+	if token == "" {
+		relayState, _ := claims["relay_state"].(string)
+		return relayState
+	}
+	if m.RelayStateStore != nil {
+		if value, ok := m.RelayStateStore.Get(token); ok {
+			return value
 		}
-		panic("not reached")
 	}
-	return http.HandlerFunc(fn)
+	sp.Logger.Printf("WARNING: the RelayState of request %v is no longer in the RelayStateStore", claims["id"])
+	return ""
 }
 
-func (m *Middleware) getPossibleRequestIDs(r *http.Request) []string {
-	rv := []string{}
+// stateCookieName returns the name of the cookie that tracks the request
+// whose random key, the RelayState sent to the IDP, is trackingKey.
+func (m *Middleware) stateCookieName(trackingKey string) string {
+	return m.trackingCookieName() + trackingKey
+}
+
+// setTrackingCookie sets cookie, scoped to the ACS of sp and with the
+// attributes configured for tracking cookies. The SameSite attribute is
+// written by hand because http.Cookie cannot express it in the versions of
+// Go we support.
+func (m *Middleware) setTrackingCookie(w http.ResponseWriter, sp *saml.ServiceProvider, cookie *http.Cookie) {
+	cookie.Path = sp.AcsURL.Path
+	cookie.HttpOnly = true
+	cookie.Secure = m.RequireHTTPS || m.TrackingCookieSecure == nil || *m.TrackingCookieSecure
+	if v := cookie.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; SameSite="+string(m.trackingCookieSameSite()))
+	}
+}
+
+// deleteTrackingCookie removes the tracking cookie with the given name.
+func (m *Middleware) deleteTrackingCookie(w http.ResponseWriter, sp *saml.ServiceProvider, name string) {
+	m.setTrackingCookie(w, sp, &http.Cookie{
+		Name:    name,
+		Expires: time.Unix(1, 0), // past time as close to epoch as possible, but not zero time.Time{}
+	})
+}
+
+func (m *Middleware) trackingCookieName() string {
+	if m.TrackingCookieName == "" {
+		return defaultTrackingCookieName
+	}
+	return m.TrackingCookieName
+}
+
+func (m *Middleware) trackingCookieSameSite() SameSite {
+	if m.TrackingCookieSameSite == "" {
+		return SameSiteNone
+	}
+	return m.TrackingCookieSameSite
+}
+
+func (m *Middleware) trackingCookieMaxAge() time.Duration {
+	if m.TrackingCookieMaxAge == 0 {
+		return m.requestTrackerMaxAge()
+	}
+	return m.TrackingCookieMaxAge
+}
+
+func (m *Middleware) requestTrackerMaxAge() time.Duration {
+	if m.RequestTrackerMaxAge == 0 {
+		return defaultRequestTrackerMaxAge
+	}
+	return m.RequestTrackerMaxAge
+}
+
+func (m *Middleware) maxRelayStateLength() int {
+	if m.MaxRelayStateLength == 0 {
+		return defaultMaxRelayStateLength
+	}
+	return m.MaxRelayStateLength
+}
+
+func (m *Middleware) maxACSRequestSize() int64 {
+	if m.MaxACSRequestSize == 0 {
+		return defaultMaxACSRequestSize
+	}
+	return m.MaxACSRequestSize
+}
+
+// errACSRequestTooLarge is returned when reading the body of an ACS
+// request that exceeds MaxACSRequestSize.
+var errACSRequestTooLarge = errors.New("ACS request body too large")
+
+// limitedBody is a request body that fails with errACSRequestTooLarge once
+// more than remaining bytes are read from it.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errACSRequestTooLarge
+	}
+	// read one byte past the limit to tell whether the body ends there
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, errACSRequestTooLarge
+	}
+	return n, err
+}
+
+func (m *Middleware) requestTrackerMaxCount() int {
+	if m.RequestTrackerMaxCount == 0 {
+		return defaultRequestTrackerMaxCount
+	}
+	return m.RequestTrackerMaxCount
+}
+
+// TrackedRequest is a pending authentication request, as recorded in a
+// cookie by HandleStartAuthFlow. ID is the ID of the AuthnRequest, URI is
+// the URL the user is returned to, and IssuedAt is the time the request was
+// made, in seconds since the epoch.
+type TrackedRequest struct {
+	CookieName string
+	ID         string
+	URI        string
+	IssuedAt   int64
+}
+
+// trackedRequestsByAge sorts tracked requests newest first.
+type trackedRequestsByAge []TrackedRequest
+
+func (a trackedRequestsByAge) Len() int           { return len(a) }
+func (a trackedRequestsByAge) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a trackedRequestsByAge) Less(i, j int) bool { return a[i].IssuedAt > a[j].IssuedAt }
+
+// getTrackedRequests returns the pending requests recorded in the cookies
+// of r, newest first and at most RequestTrackerMaxCount of them. It also
+// returns the names of the tracking cookies that are invalid, expired or
+// in excess of RequestTrackerMaxCount.
+func (m *Middleware) getTrackedRequests(r *http.Request) (tracked []TrackedRequest, stale []string) {
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		return nil, nil
+	}
 	for _, cookie := range r.Cookies() {
-		if !strings.HasPrefix(cookie.Name, "saml_") {
+		if !strings.HasPrefix(cookie.Name, m.trackingCookieName()) {
 			continue
 		}
-		m.ServiceProvider.Logger.Printf("getPossibleRequestIDs: cookie: %s", cookie.String())
+		sp.Logger.Printf("getTrackedRequests: cookie: %s", cookie.String())
 
-		jwtParser := jwt.Parser{
-			ValidMethods: []string{jwtSigningMethod.Name},
+		token, err := m.parseTrackingToken(sp, cookie.Value)
+		if err != nil {
+			sp.Logger.Printf("... invalid token %s", err)
+			stale = append(stale, cookie.Name)
+			continue
+		}
+		if !token.Valid {
+			sp.Logger.Printf("... invalid token")
+			stale = append(stale, cookie.Name)
+			continue
 		}
-		token, err := jwtParser.Parse(cookie.Value, func(t *jwt.Token) (interface{}, error) {
-			secretBlock := x509.MarshalPKCS1PrivateKey(m.ServiceProvider.Key)
-			return secretBlock, nil
+		claims := token.Claims.(jwt.MapClaims)
+		id, _ := claims["id"].(string)
+		uri, _ := claims["uri"].(string)
+		issuedAt, _ := claims["iat"].(float64)
+		tracked = append(tracked, TrackedRequest{
+			CookieName: cookie.Name,
+			ID:         id,
+			URI:        uri,
+			IssuedAt:   int64(issuedAt),
 		})
-		if err != nil || !token.Valid {
-			m.ServiceProvider.Logger.Printf("... invalid token %s", err)
+	}
+
+	sort.Stable(trackedRequestsByAge(tracked))
+	if maxCount := m.requestTrackerMaxCount(); len(tracked) > maxCount {
+		for _, t := range tracked[maxCount:] {
+			stale = append(stale, t.CookieName)
+		}
+		tracked = tracked[:maxCount]
+	}
+	return tracked, stale
+}
+
+// ErrRequestExpired is logged by the ACS in place of the reason a response
+// was rejected when the response is valid, except that the request it
+// answers is no longer tracked because RequestTrackerMaxAge has passed.
+// See RestartExpiredRequests.
+var ErrRequestExpired = errors.New("saml: the authentication request has expired")
+
+// expiredRequest returns the claims of the request tracked by a cookie of
+// r that has expired, but is otherwise valid, if its ID is inResponseTo and
+// the response posted to the ACS would be accepted as a response to it, and
+// nil otherwise. The response is validated again without the side effects
+// of ParseResponse, since it is rejected either way: ObserveParseStage and
+// Validators are not called and ReplayStore is not consulted.
+func (m *Middleware) expiredRequest(r *http.Request, sp *saml.ServiceProvider, inResponseTo string) jwt.MapClaims {
+	if inResponseTo == "" {
+		return nil
+	}
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, m.trackingCookieName()) {
+			continue
+		}
+		token, err := m.parseTrackingToken(sp, cookie.Value)
+		if validationErr, ok := err.(*jwt.ValidationError); !ok || validationErr.Errors != jwt.ValidationErrorExpired {
 			continue
 		}
 		claims := token.Claims.(jwt.MapClaims)
-		rv = append(rv, claims["id"].(string))
+		if id, _ := claims["id"].(string); id != inResponseTo {
+			continue
+		}
+		quietSP := *sp
+		quietSP.ObserveParseStage = nil
+		quietSP.Validators = nil
+		quietSP.ReplayStore = nil
+		if _, err := quietSP.ParseResponse(r, append(m.getPossibleRequestIDs(r), inResponseTo)); err != nil {
+			return nil
+		}
+		return claims
+	}
+	return nil
+}
+
+// pruneTrackedRequests deletes the tracking cookies of r that are invalid,
+// expired or in excess of RequestTrackerMaxCount. Tracking cookies are scoped
+// to the ACS path, so this happens when the browser returns to the ACS.
+func (m *Middleware) pruneTrackedRequests(w http.ResponseWriter, r *http.Request) {
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		return
+	}
+	_, stale := m.getTrackedRequests(r)
+	for _, name := range stale {
+		m.deleteTrackingCookie(w, sp, name)
+	}
+}
+
+// GetTrackedRequests returns the pending authentication requests recorded
+// in the tracking cookies of r, newest first. These are the requests that
+// the ACS accepts responses to. Tracking cookies are scoped to the path of
+// the ACS, so browsers only send them with requests to the ACS URL or to a
+// path below it, such as a support endpoint mounted at AcsURL.Path+"/debug".
+func (m *Middleware) GetTrackedRequests(r *http.Request) []TrackedRequest {
+	tracked, _ := m.getTrackedRequests(r)
+	return tracked
+}
+
+// ClearTrackedRequests deletes all the tracking cookies of r, including
+// those that are invalid or expired, for example to recover a browser that
+// is stuck in a redirect loop because of a stale tracking cookie. The next
+// request that requires an account starts a new authentication request. As
+// for GetTrackedRequests, r must be a request to the ACS URL or to a path
+// below it.
+func (m *Middleware) ClearTrackedRequests(w http.ResponseWriter, r *http.Request) {
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		return
+	}
+	for _, cookie := range r.Cookies() {
+		if strings.HasPrefix(cookie.Name, m.trackingCookieName()) {
+			m.deleteTrackingCookie(w, sp, cookie.Name)
+		}
+	}
+}
+
+func (m *Middleware) getPossibleRequestIDs(r *http.Request) []string {
+	rv := []string{}
+	tracked, _ := m.getTrackedRequests(r)
+	for _, t := range tracked {
+		rv = append(rv, t.ID)
 	}
 
 	// If IDP initiated requests are allowed, then we can expect an empty response ID.
@@ -209,59 +1077,164 @@ func (m *Middleware) getPossibleRequestIDs(r *http.Request) []string {
 	return rv
 }
 
+// TokenClaims are the claims of the session JWT. The Subject is the value
+// of the NameID from the assertion, the Issuer is the entity ID of the IDP
+// that issued it, and the NameID* claims hold the remaining parts of the
+// NameID, if present. AuthenticatingAuthorities
+// lists the AuthenticatingAuthority elements of the assertion's
+// AuthnStatements, which identify the upstream IDPs of a proxied login.
 type TokenClaims struct {
 	jwt.StandardClaims
-	Attributes map[string][]string `json:"attr"`
+	Attributes                map[string][]string `json:"attr"`
+	NameIDFormat              string              `json:"nameid_format,omitempty"`
+	NameQualifier             string              `json:"nameid_qualifier,omitempty"`
+	SPNameQualifier           string              `json:"nameid_sp_qualifier,omitempty"`
+	AuthenticatingAuthorities []string            `json:"authn_authorities,omitempty"`
+
+	// SessionNotOnOrAfter is the time, in seconds since the epoch, at which
+	// the IDP session ends. It is the earliest SessionNotOnOrAfter of the
+	// AuthnStatements in the assertion, or the expiry of the session cookie
+	// if the IDP did not specify one.
+	SessionNotOnOrAfter int64 `json:"session_not_on_or_after,omitempty"`
+
+	// AuthnInstant is the time, in seconds since the epoch, at which the
+	// user authenticated to the IDP. It is the latest AuthnInstant of the
+	// AuthnStatements in the assertion. See RequireRecentAccount.
+	AuthnInstant int64 `json:"authn_instant,omitempty"`
+
+	// AuthnContextLevel is the assurance level of the authentication, as
+	// determined by ServiceProvider.AuthnContextLevels. See
+	// AuthnContextLevelFromContext.
+	AuthnContextLevel int `json:"authn_level,omitempty"`
+
+	// IDPInitiated is true if the IDP sent the assertion unsolicited, rather
+	// than in response to an AuthnRequest of ours, which is possible only if
+	// AllowIDPInitiated is set. See IsIDPInitiated.
+	IDPInitiated bool `json:"idp_initiated,omitempty"`
+}
+
+// idpInitiated returns true if assertion was not issued in response to an
+// AuthnRequest, that is if none of its SubjectConfirmationData has an
+// InResponseTo. ParseResponse accepts such an assertion only if the empty
+// request ID is among the possible request IDs, which getPossibleRequestIDs
+// adds when AllowIDPInitiated is set.
+func idpInitiated(assertion *saml.Assertion) bool {
+	if assertion.Subject == nil {
+		return true
+	}
+	for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
+		if data := subjectConfirmation.SubjectConfirmationData; data != nil && data.InResponseTo != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// authnInstant returns the latest AuthnInstant of the AuthnStatements of
+// assertion, or the zero time if it has none.
+func authnInstant(assertion *saml.Assertion) time.Time {
+	var t time.Time
+	for _, authnStatement := range assertion.AuthnStatements {
+		if authnStatement.AuthnInstant.After(t) {
+			t = authnStatement.AuthnInstant
+		}
+	}
+	return t
+}
+
+// sessionOlderThan returns true if the user authenticated to the IDP more
+// than maxAge before now, according to claims. Sessions that do not record
+// when the user authenticated are considered too old.
+func sessionOlderThan(claims *TokenClaims, maxAge time.Duration) bool {
+	if claims.AuthnInstant == 0 {
+		return true
+	}
+	return saml.TimeNow().Sub(time.Unix(claims.AuthnInstant, 0)) > maxAge
 }
 
 // Authorize is invoked by ServeHTTP when we have a new, valid SAML assertion.
 // It sets a cookie that contains a signed JWT containing the assertion attributes.
-// It then redirects the user's browser to the original URL contained in RelayState.
+// It then redirects the user's browser to the original URL contained in RelayState,
+// or calls m.OnSuccess if it is set.
 func (m *Middleware) Authorize(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) {
-	secretBlock := x509.MarshalPKCS1PrivateKey(m.ServiceProvider.Key)
-
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		m.logger().Printf("ERROR: cannot resolve service provider: %s", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 	redirectURI := "/"
-	if r.Form.Get("RelayState") != "" {
-		stateCookie, err := r.Cookie(fmt.Sprintf("saml_%s", r.Form.Get("RelayState")))
+	if trackingKey := r.Form.Get("RelayState"); trackingKey != "" {
+		if len(trackingKey) != trackingKeyLength {
+			sp.Logger.Printf("RelayState is %d bytes, which is not the length of a tracking key",
+				len(trackingKey))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		stateCookie, err := r.Cookie(m.stateCookieName(trackingKey))
 		if err != nil {
-			m.ServiceProvider.Logger.Printf("cannot find corresponding cookie: %s", fmt.Sprintf("saml_%s", r.Form.Get("RelayState")))
+			sp.Logger.Printf("cannot find corresponding cookie: %s", m.stateCookieName(trackingKey))
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 
-		jwtParser := jwt.Parser{
-			ValidMethods: []string{jwtSigningMethod.Name},
-		}
-		state, err := jwtParser.Parse(stateCookie.Value, func(t *jwt.Token) (interface{}, error) {
-			return secretBlock, nil
-		})
+		state, err := m.parseTrackingToken(sp, stateCookie.Value)
 		if err != nil || !state.Valid {
-			m.ServiceProvider.Logger.Printf("Cannot decode state JWT: %s (%s)", err, stateCookie.Value)
+			sp.Logger.Printf("Cannot decode state JWT: %s (%s)", err, stateCookie.Value)
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 		claims := state.Claims.(jwt.MapClaims)
 		redirectURI = claims["uri"].(string)
 
-		// delete the cookie
-		stateCookie.Value = ""
-		stateCookie.Expires = time.Unix(1, 0) // past time as close to epoch as possible, but not zero time.Time{}
-		http.SetCookie(w, stateCookie)
+		if forceAuthn, _ := claims["force_authn"].(bool); forceAuthn {
+			requestedAt, _ := claims["iat"].(float64)
+			if authnInstant(assertion).Add(saml.MaxClockSkew).Unix() < int64(requestedAt) {
+				sp.Logger.Printf("ERROR: the IDP did not authenticate the user again as ForceAuthn requested (AuthnInstant %s)",
+					authnInstant(assertion))
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
+		m.deleteTrackingCookie(w, sp, stateCookie.Name)
+
+		r.Form.Set("RelayState", m.trackedRelayState(sp, claims))
 	}
 
 	now := saml.TimeNow()
 	claims := TokenClaims{}
-	claims.Audience = m.ServiceProvider.Metadata().EntityID
+	claims.Audience = sp.Metadata().EntityID
 	claims.IssuedAt = assertion.IssueInstant.Unix()
 	claims.ExpiresAt = now.Add(m.CookieMaxAge).Unix()
 	claims.NotBefore = now.Unix()
+	claims.Issuer = assertion.Issuer.Value
 	if sub := assertion.Subject; sub != nil {
 		if nameID := sub.NameID; nameID != nil {
 			claims.StandardClaims.Subject = nameID.Value
+			claims.NameIDFormat = nameID.Format
+			claims.NameQualifier = nameID.NameQualifier
+			claims.SPNameQualifier = nameID.SPNameQualifier
 		}
 	}
-	for _, attributeStatement := range assertion.AttributeStatements {
+	claims.SessionNotOnOrAfter = claims.ExpiresAt
+	if t := authnInstant(assertion); !t.IsZero() {
+		claims.AuthnInstant = t.Unix()
+	}
+	claims.AuthnContextLevel = sp.AuthnContextLevel(assertion)
+	claims.IDPInitiated = idpInitiated(assertion)
+	for _, authnStatement := range assertion.AuthnStatements {
+		if t := authnStatement.SessionNotOnOrAfter; t != nil && t.Unix() < claims.SessionNotOnOrAfter {
+			claims.SessionNotOnOrAfter = t.Unix()
+		}
+		for _, authenticatingAuthority := range authnStatement.AuthnContext.AuthenticatingAuthorities {
+			claims.AuthenticatingAuthorities = append(claims.AuthenticatingAuthorities, authenticatingAuthority.Value)
+		}
+	}
+	if len(assertion.AttributeStatements) > 0 {
 		claims.Attributes = map[string][]string{}
+	}
+	for _, attributeStatement := range assertion.AttributeStatements {
 		for _, attr := range attributeStatement.Attributes {
 			claimName := attr.FriendlyName
 			if claimName == "" {
@@ -272,8 +1245,7 @@ func (m *Middleware) Authorize(w http.ResponseWriter, r *http.Request, assertion
 			}
 		}
 	}
-	signedToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		claims).SignedString(secretBlock)
+	sessionToken, err := m.makeSessionToken(sp, &claims, false)
 	if err != nil {
 		panic(err)
 	}
@@ -281,14 +1253,53 @@ func (m *Middleware) Authorize(w http.ResponseWriter, r *http.Request, assertion
 	http.SetCookie(w, &http.Cookie{
 		Name:     m.CookieName,
 		Domain:   m.CookieDomain,
-		Value:    signedToken,
+		Value:    sessionToken,
 		MaxAge:   int(m.CookieMaxAge.Seconds()),
 		HttpOnly: true,
-		Secure:   r.URL.Scheme == "https",
+		Secure:   m.RequireHTTPS || sp.RequestScheme(r) == "https",
 		Path:     "/",
 	})
 
-	http.Redirect(w, r, redirectURI, http.StatusFound)
+	if m.OnSuccess != nil {
+		m.OnSuccess(w, r, redirectURI, &claims)
+		return
+	}
+	http.Redirect(w, r, redirectURI, m.successRedirectStatus())
+}
+
+// Logout ends the local session of the user by deleting the session
+// cookie, and then redirects the user's browser to LogoutRedirectURL if it
+// is set. Otherwise the caller writes the response. The IDP is not
+// contacted, so the user's session at the IDP, and at other service
+// providers, continues, and the next request that requires an account may
+// be authenticated again without the user's interaction.
+func (m *Middleware) Logout(w http.ResponseWriter, r *http.Request) {
+	// The cookie is deleted with the attributes that Authorize set it with,
+	// which depend on the service provider of r.
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		sp = m.defaultServiceProvider()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.CookieName,
+		Domain:   m.CookieDomain,
+		Value:    "",
+		MaxAge:   -1,
+		Expires:  time.Unix(1, 0), // past time as close to epoch as possible, but not zero time.Time{}
+		HttpOnly: true,
+		Secure:   m.RequireHTTPS || sp.RequestScheme(r) == "https",
+		Path:     "/",
+	})
+	if m.LogoutRedirectURL != "" {
+		http.Redirect(w, r, m.LogoutRedirectURL, http.StatusSeeOther)
+	}
+}
+
+func (m *Middleware) successRedirectStatus() int {
+	if m.SuccessRedirectStatus == 0 {
+		return http.StatusSeeOther
+	}
+	return m.SuccessRedirectStatus
 }
 
 // IsAuthorized is invoked by RequireAccount to determine if the request
@@ -303,27 +1314,18 @@ func (m *Middleware) Authorize(w http.ResponseWriter, r *http.Request, assertion
 // It is an error for this function to be invoked with a request containing
 // any headers starting with X-Saml. This function will panic if you do.
 func (m *Middleware) IsAuthorized(r *http.Request) bool {
-	cookie, err := r.Cookie(m.CookieName)
-	if err != nil {
-		return false
-	}
+	return m.authorizeRequest(r) != nil
+}
 
-	tokenClaims := TokenClaims{}
-	token, err := jwt.ParseWithClaims(cookie.Value, &tokenClaims, func(t *jwt.Token) (interface{}, error) {
-		secretBlock := x509.MarshalPKCS1PrivateKey(m.ServiceProvider.Key)
-		return secretBlock, nil
-	})
-	if err != nil || !token.Valid {
-		m.ServiceProvider.Logger.Printf("ERROR: invalid token: %s", err)
-		return false
-	}
-	if err := tokenClaims.StandardClaims.Valid(); err != nil {
-		m.ServiceProvider.Logger.Printf("ERROR: invalid token claims: %s", err)
-		return false
-	}
-	if tokenClaims.Audience != m.ServiceProvider.Metadata().EntityID {
-		m.ServiceProvider.Logger.Printf("ERROR: invalid audience: %s", err)
-		return false
+// authorizeRequest implements IsAuthorized, returning the claims of the
+// session token if the request is authorized and nil otherwise.
+func (m *Middleware) authorizeRequest(r *http.Request) *TokenClaims {
+	tokenClaims, err := m.GetSession(r)
+	if err != nil {
+		if err != ErrNoSession && err != ErrSessionKeyRetired {
+			m.logger().Printf("ERROR: %s", err)
+		}
+		return nil
 	}
 
 	// It is an error for the request to include any X-SAML* headers,
@@ -342,7 +1344,175 @@ func (m *Middleware) IsAuthorized(r *http.Request) bool {
 	}
 	r.Header.Set("X-Saml-Subject", tokenClaims.Subject)
 
-	return true
+	return tokenClaims
+}
+
+// ErrNoSession is returned by GetSession when the request does not have a
+// session cookie.
+var ErrNoSession = errors.New("saml: session cookie not present")
+
+// GetSession returns the claims of the session token of r if it is valid,
+// or an error describing why it is not. Unlike IsAuthorized, it does not
+// modify r, so it can be used to make authorization decisions outside of
+// RequireAccount.
+func (m *Middleware) GetSession(r *http.Request) (*TokenClaims, error) {
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve service provider: %s", err)
+	}
+
+	cookie, err := r.Cookie(m.CookieName)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	return m.parseSessionToken(sp, cookie.Value, false)
+}
+
+// Claims returns the contents of assertion as a map of claims in the style
+// of OpenID Connect, as saml.Assertion.Claims does, finding the attributes
+// with m.ClaimAttributeNames.
+func (m *Middleware) Claims(assertion *saml.Assertion) map[string]interface{} {
+	if m.ClaimAttributeNames == nil {
+		return assertion.Claims()
+	}
+	return assertion.ClaimsWithAttributeNames(m.ClaimAttributeNames)
+}
+
+// IssueToken returns the session of r, as found by GetSession, as a token
+// that API clients can send in an "Authorization: Bearer" header, for
+// example a single page application whose user has signed in with the
+// browser. The token has the same claims as the session, and so expires
+// with it. It is protected like the session cookie, as SessionEncryption
+// specifies, and can be checked with ValidateToken. It is marked as a token,
+// so that GetSession does not accept it as a session cookie, nor
+// ValidateToken a session cookie as a token.
+//
+// Tokens are signed with the key of the service provider of r, as returned
+// by ServiceProviderResolver if it is set.
+func (m *Middleware) IssueToken(r *http.Request) (string, error) {
+	tokenClaims, err := m.GetSession(r)
+	if err != nil {
+		return "", err
+	}
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve service provider: %s", err)
+	}
+	if sp.Key == nil {
+		return "", errors.New("cannot issue token: ServiceProvider.Key must be specified")
+	}
+	return m.makeSessionToken(sp, tokenClaims, true)
+}
+
+// ValidateToken returns the claims of tokenString, a token issued by
+// IssueToken, if it is valid, or an error describing why it is not. The
+// token is checked with the key of the service provider of r, the request
+// that carried it, so that the token of one tenant is not accepted by
+// another.
+func (m *Middleware) ValidateToken(r *http.Request, tokenString string) (*TokenClaims, error) {
+	sp, err := m.serviceProvider(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve service provider: %s", err)
+	}
+	if sp.Key == nil {
+		return nil, errors.New("cannot validate token: ServiceProvider.Key must be specified")
+	}
+	return m.parseSessionToken(sp, tokenString, true)
+}
+
+// apiTokenType is the "typ" header of the tokens made by IssueToken, which
+// distinguishes them from session cookies, so that neither is accepted in
+// place of the other.
+const apiTokenType = "api+jwt"
+
+// makeSessionToken returns tokenClaims signed with the key of sp, and
+// encrypted if m.SessionEncryption calls for it. If api is true, the token
+// is marked as one made by IssueToken rather than a session cookie.
+func (m *Middleware) makeSessionToken(sp *saml.ServiceProvider, tokenClaims *TokenClaims, api bool) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims)
+	token.Header["kid"] = sessionKeyID(sp.Key)
+	if api {
+		token.Header["typ"] = apiTokenType
+	}
+	signedToken, err := token.SignedString(x509.MarshalPKCS1PrivateKey(sp.Key))
+	if err != nil {
+		return "", err
+	}
+	return m.encodeSessionToken(sp, signedToken)
+}
+
+// parseSessionToken returns the claims of value, a token made by
+// makeSessionToken with the same api, if it is valid.
+func (m *Middleware) parseSessionToken(sp *saml.ServiceProvider, value string, api bool) (*TokenClaims, error) {
+	signedToken, err := m.decodeSessionToken(sp, value)
+	if err == ErrSessionKeyRetired {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+
+	tokenClaims := TokenClaims{}
+	token, err := jwt.ParseWithClaims(signedToken, &tokenClaims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := m.sessionKey(sp, kid)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS1PrivateKey(key), nil
+	})
+	if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Inner == ErrSessionKeyRetired {
+		return nil, ErrSessionKeyRetired
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if typ, _ := token.Header["typ"].(string); (typ == apiTokenType) != api {
+		return nil, fmt.Errorf("invalid token type: %s", typ)
+	}
+	if err := tokenClaims.StandardClaims.Valid(); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %s", err)
+	}
+	if tokenClaims.Audience != sp.Metadata().EntityID {
+		return nil, fmt.Errorf("invalid audience: %s", tokenClaims.Audience)
+	}
+	return &tokenClaims, nil
+}
+
+// ErrSessionKeyRetired is returned by GetSession when the session was made
+// with a key that is neither the current key of the ServiceProvider nor
+// one of PreviousSessionKeys. Like a missing session, it is not logged as
+// an error, and RequireAccount starts the login flow again.
+var ErrSessionKeyRetired = errors.New("saml: session was made with a retired key")
+
+// sessionKeyID returns the ID of key that is sent as the "kid" header of
+// the session tokens made with it, so that the key that verifies a token
+// is found without trying each one. It is derived from the public key.
+func sessionKeyID(key *rsa.PrivateKey) string {
+	sum := sha256.Sum256(key.PublicKey.N.Bytes())
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// sessionKey returns the key of sp, or the one of m.PreviousSessionKeys,
+// whose ID is kid, or ErrSessionKeyRetired if there is none. Tokens made
+// before key IDs were introduced have no kid, and are checked with the key
+// of sp.
+func (m *Middleware) sessionKey(sp *saml.ServiceProvider, kid string) (*rsa.PrivateKey, error) {
+	if kid == "" {
+		return sp.Key, nil
+	}
+	if sessionKeyID(sp.Key) == kid {
+		return sp.Key, nil
+	}
+	for _, key := range m.PreviousSessionKeys {
+		if sessionKeyID(key) == kid {
+			return key, nil
+		}
+	}
+	return nil, ErrSessionKeyRetired
 }
 
 // RequireAttribute returns a middleware function that requires that the
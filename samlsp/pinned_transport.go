@@ -0,0 +1,66 @@
+//go:build go1.8
+// +build go1.8
+
+package samlsp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+)
+
+// pinnedTransport returns a copy of rt whose TLS handshakes fail with
+// ErrMetadataPinMismatch unless the server presents a certificate that
+// matches one of m.IDPMetadataPins. Transports other than *http.Transport
+// are returned unchanged.
+func (m *Middleware) pinnedTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return rt
+	}
+
+	tlsConfig := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		tlsConfig = t.TLSClientConfig.Clone()
+	}
+	verifyPeerCertificate := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verifyPeerCertificate != nil {
+			if err := verifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if !m.matchesIDPMetadataPin(certs) {
+			return ErrMetadataPinMismatch
+		}
+		return nil
+	}
+
+	return &http.Transport{
+		Proxy:                  t.Proxy,
+		DialContext:            t.DialContext,
+		Dial:                   t.Dial,
+		TLSClientConfig:        tlsConfig,
+		TLSHandshakeTimeout:    t.TLSHandshakeTimeout,
+		DisableKeepAlives:      t.DisableKeepAlives,
+		DisableCompression:     t.DisableCompression,
+		MaxIdleConns:           t.MaxIdleConns,
+		MaxIdleConnsPerHost:    t.MaxIdleConnsPerHost,
+		IdleConnTimeout:        t.IdleConnTimeout,
+		ResponseHeaderTimeout:  t.ResponseHeaderTimeout,
+		ExpectContinueTimeout:  t.ExpectContinueTimeout,
+		ProxyConnectHeader:     t.ProxyConnectHeader,
+		MaxResponseHeaderBytes: t.MaxResponseHeaderBytes,
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !go1.8
+// +build !go1.8
+
+package samlsp
+
+import "net/http"
+
+// pinnedTransport returns rt, as tls.Config cannot check certificates
+// during the handshake before Go 1.8. The pins are still checked on each
+// response.
+func (m *Middleware) pinnedTransport(rt http.RoundTripper) http.RoundTripper {
+	return rt
+}
@@ -0,0 +1,94 @@
+package samlsp
+
+import (
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/launchpadcentral/saml"
+)
+
+// RelayStateStore keeps the RelayState values passed to HandleStartAuthFlow
+// that are longer than the IDP accepts, such as long return URLs. Such a
+// value is stored on the server and an opaque token that refers to it is
+// sent to the IDP as the RelayState instead.
+type RelayStateStore interface {
+	// Put stores value and returns the token that refers to it, which must
+	// be at most 80 bytes long and consist of letters, digits, '-' and '_'.
+	Put(value string) (token string, err error)
+
+	// Get returns the value stored for token and forgets it. It returns
+	// false if there is no such value, for example because it has expired.
+	Get(token string) (value string, ok bool)
+}
+
+// ErrRelayStateStoreFull is returned by the Put method of a RelayStateStore
+// made by NewMemoryRelayStateStore when it holds as many values as it can.
+var ErrRelayStateStoreFull = errors.New("saml: RelayState store is full")
+
+// maxMemoryRelayStates is how many values a RelayStateStore made by
+// NewMemoryRelayStateStore holds at most.
+const maxMemoryRelayStates = 10000
+
+// NewMemoryRelayStateStore returns a RelayStateStore that keeps values in
+// memory for maxAge. The values are not shared between processes, so it is
+// only suitable for a service that runs as a single instance. It holds at
+// most 10000 values, and Put returns ErrRelayStateStoreFull beyond that.
+func NewMemoryRelayStateStore(maxAge time.Duration) RelayStateStore {
+	return &memoryRelayStateStore{
+		maxAge:     maxAge,
+		maxEntries: maxMemoryRelayStates,
+		values:     map[string]memoryRelayState{},
+	}
+}
+
+type memoryRelayState struct {
+	value     string
+	expiresAt time.Time
+}
+
+type memoryRelayStateStore struct {
+	maxAge     time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	values     map[string]memoryRelayState
+	nextSweep  time.Time
+}
+
+func (s *memoryRelayStateStore) Put(value string) (string, error) {
+	token := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	now := saml.TimeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Expired values are removed at most once per maxAge, rather than on
+	// every call, so they are kept for no more than twice maxAge.
+	if !now.Before(s.nextSweep) {
+		for t, v := range s.values {
+			if !now.Before(v.expiresAt) {
+				delete(s.values, t)
+			}
+		}
+		s.nextSweep = now.Add(s.maxAge)
+	}
+	if len(s.values) >= s.maxEntries {
+		return "", ErrRelayStateStoreFull
+	}
+	s.values[token] = memoryRelayState{value: value, expiresAt: now.Add(s.maxAge)}
+	return token, nil
+}
+
+func (s *memoryRelayStateStore) Get(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[token]
+	if !ok {
+		return "", false
+	}
+	delete(s.values, token)
+	if !saml.TimeNow().Before(v.expiresAt) {
+		return "", false
+	}
+	return v.value, true
+}
@@ -3,14 +3,23 @@
 package samlsp
 
 import (
+	"bytes"
+	"context"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/launchpadcentral/saml"
@@ -30,6 +39,52 @@ type Options struct {
 	CookieMaxAge      time.Duration
 	ForceAuthn        bool
 	RetryCount        int
+
+	// ECP, if true, allows clients that use the ECP profile to sign in
+	// without a browser. See saml.ServiceProvider.ECP.
+	ECP bool
+
+	// IDPMetadataPins, if not empty, restricts the TLS certificates that
+	// are accepted when fetching IDPMetadataURL. See Middleware.IDPMetadataPins.
+	// A custom tls.Config can be used by setting the Transport of HTTPClient.
+	IDPMetadataPins []string
+
+	// EncryptionKey and EncryptionCertificate, if set, are used for
+	// encrypted assertions in place of Key and Certificate.
+	EncryptionKey         *rsa.PrivateKey
+	EncryptionCertificate *x509.Certificate
+
+	// SessionEncryption and SessionEncryptionKey select whether the session
+	// cookie is encrypted. See Middleware.SessionEncryption.
+	SessionEncryption    SessionEncryption
+	SessionEncryptionKey []byte
+
+	// PreviousSessionKeys are keys that were used before Key, whose
+	// sessions are still accepted. See Middleware.PreviousSessionKeys.
+	PreviousSessionKeys []*rsa.PrivateKey
+
+	ServiceProviderResolver ServiceProviderResolver
+
+	// RefreshIDPMetadata, if true, causes IDPMetadataURL to be fetched again
+	// in the background whenever the interval that the metadata specifies
+	// with its cacheDuration and validUntil elapses, or daily if it
+	// specifies neither, until the Middleware is closed.
+	RefreshIDPMetadata bool
+
+	// RequireHTTPS, if true, causes New to fail unless URL, and
+	// IDPMetadataURL if it is set, are https URLs, and causes cookies to be
+	// always Secure. See Middleware.RequireHTTPS. It can be left unset for
+	// local development over plaintext HTTP.
+	RequireHTTPS bool
+
+	// RefreshStaleMetadata, if true, fetches IDPMetadataURL again when a
+	// response is rejected because the metadata is stale. See
+	// Middleware.RefreshStaleMetadata.
+	RefreshStaleMetadata bool
+
+	// DuplicateEntityIDs determines whether IDP metadata that contains
+	// duplicate EntityIDs is rejected. See Middleware.DuplicateEntityIDs.
+	DuplicateEntityIDs DuplicateEntityIDPolicy
 }
 
 // New creates a new Middleware
@@ -44,14 +99,30 @@ func New(opts Options) (*Middleware, error) {
 		logr = logger.DefaultLogger
 	}
 
+	if opts.RequireHTTPS {
+		if opts.URL.Scheme != "https" {
+			return nil, fmt.Errorf("RequireHTTPS is set, but URL %s is not an https URL", opts.URL.String())
+		}
+		if opts.IDPMetadataURL != nil && opts.IDPMetadataURL.Scheme != "https" {
+			return nil, fmt.Errorf("RequireHTTPS is set, but IDPMetadataURL %s is not an https URL", opts.IDPMetadataURL.String())
+		}
+	}
+
 	if opts.RetryCount == 0 {
 		opts.RetryCount = 10
 	}
+	if opts.SessionEncryption == SessionEncryptedDirect {
+		if _, err := gcmEncryption(len(opts.SessionEncryptionKey)); err != nil {
+			return nil, err
+		}
+	}
+
 	cookieMaxAge := opts.CookieMaxAge
 	if opts.CookieMaxAge == 0 {
 		cookieMaxAge = defaultCookieMaxAge
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	m := &Middleware{
 		ServiceProvider: saml.ServiceProvider{
 			Key:          opts.Key,
@@ -62,12 +133,36 @@ func New(opts Options) (*Middleware, error) {
 			IDPMetadata:  opts.IDPMetadata,
 			ForceAuthn:   &opts.ForceAuthn,
 			IDPMetadatas: map[string]saml.EntityDescriptor{},
+			ECP:          opts.ECP,
+
+			EncryptionKey:         opts.EncryptionKey,
+			EncryptionCertificate: opts.EncryptionCertificate,
 		},
 		AllowIDPInitiated: opts.AllowIDPInitiated,
 		CookieName:        defaultCookieName,
 		CookieMaxAge:      cookieMaxAge,
 		CookieDomain:      opts.URL.Host,
 		RetryCount:        opts.RetryCount,
+		IDPMetadataPins:   opts.IDPMetadataPins,
+
+		SessionEncryption:    opts.SessionEncryption,
+		SessionEncryptionKey: opts.SessionEncryptionKey,
+		PreviousSessionKeys:  opts.PreviousSessionKeys,
+
+		ServiceProviderResolver: opts.ServiceProviderResolver,
+		RefreshStaleMetadata:    opts.RefreshStaleMetadata,
+		RequireHTTPS:            opts.RequireHTTPS,
+		DuplicateEntityIDs:      opts.DuplicateEntityIDs,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		idpMetadataURL: opts.IDPMetadataURL,
+		httpClient:     opts.HTTPClient,
+	}
+	if err := m.ServiceProvider.ValidateKeyPair(); err != nil {
+		cancel()
+		return nil, err
 	}
 
 	// fetch the IDP metadata if needed.
@@ -76,28 +171,52 @@ func New(opts Options) (*Middleware, error) {
 	}
 
 	if err := m.FetchIDPMetadata(opts.HTTPClient, opts.IDPMetadataURL); err != nil {
+		m.Close()
 		return nil, err
 	}
+	if opts.RefreshIDPMetadata {
+		m.background.Add(1)
+		go func() {
+			defer m.background.Done()
+			m.refreshIDPMetadataPeriodically()
+		}()
+	}
 
 	return m, nil
 }
 
 // AddIDPMetadata adds metadata information do the IDPMetadatas map and uses the EntityID as the key value.
+//
+// If metadata is an aggregate that contains more than one entity with the
+// same EntityID, an error is returned unless m.DuplicateEntityIDs is
+// UseLastDuplicateEntityID. The entities of aggregates nested within it are
+// included.
 func (m *Middleware) AddIDPMetadata(metadata []byte) error {
 	entity := &saml.EntityDescriptor{}
-	err := xml.Unmarshal(metadata, entity)
+	err := unmarshalMetadata(metadata, entity)
 
 	// this comparison is ugly, but it is how the error is generated in encoding/xml
 	if err != nil && err.Error() == "expected element type <EntityDescriptor> but have <EntitiesDescriptor>" {
 		entities := &saml.EntitiesDescriptor{}
-		if err := xml.Unmarshal(metadata, entities); err != nil {
+		if err := unmarshalMetadata(metadata, entities); err != nil {
 			return err
 		}
 
+		entityDescriptors := allEntityDescriptors(entities)
+		if m.DuplicateEntityIDs == RejectDuplicateEntityIDs {
+			seen := map[string]bool{}
+			for _, e := range entityDescriptors {
+				if seen[e.EntityID] {
+					return fmt.Errorf("metadata contains more than one entity with EntityID %q", e.EntityID)
+				}
+				seen[e.EntityID] = true
+			}
+		}
+
 		err = fmt.Errorf("no entity found with IDPSSODescriptor")
-		for _, e := range entities.EntityDescriptors {
-			if len(e.IDPSSODescriptors) > 0 {
-				entity = &e
+		for i := range entityDescriptors {
+			if len(entityDescriptors[i].IDPSSODescriptors) > 0 {
+				entity = &entityDescriptors[i]
 				err = nil
 			}
 		}
@@ -106,31 +225,239 @@ func (m *Middleware) AddIDPMetadata(metadata []byte) error {
 		return err
 	}
 
+	m.setIDPMetadata(entity)
+	return nil
+}
+
+// allEntityDescriptors returns the EntityDescriptors of entities, followed
+// by those of the EntitiesDescriptors nested within it, recursively.
+func allEntityDescriptors(entities *saml.EntitiesDescriptor) []saml.EntityDescriptor {
+	entityDescriptors := entities.EntityDescriptors
+	for i := range entities.EntitiesDescriptors {
+		entityDescriptors = append(entityDescriptors, allEntityDescriptors(&entities.EntitiesDescriptors[i])...)
+	}
+	return entityDescriptors
+}
+
+// setIDPMetadata adds entity to the IDPMetadatas map. The map is replaced
+// rather than modified, so that requests in progress, which hold a copy of
+// m.ServiceProvider, are not affected when the metadata is refreshed.
+//
+// If entity replaces metadata that differs from it, the change is passed
+// to m.OnIDPMetadataChange, and a warning is logged if the signing
+// certificates have changed.
+func (m *Middleware) setIDPMetadata(entity *saml.EntityDescriptor) {
+	m.keyPairMu.Lock()
+
 	// TODO keeping this only for making it backward compatible
 	m.ServiceProvider.IDPMetadata = entity
 
-	m.ServiceProvider.IDPMetadatas[entity.EntityID] = *entity
+	oldEntity, replaced := m.ServiceProvider.IDPMetadatas[entity.EntityID]
+	idpMetadatas := make(map[string]saml.EntityDescriptor, len(m.ServiceProvider.IDPMetadatas)+1)
+	for entityID, e := range m.ServiceProvider.IDPMetadatas {
+		idpMetadatas[entityID] = e
+	}
+	idpMetadatas[entity.EntityID] = *entity
+	m.ServiceProvider.IDPMetadatas = idpMetadatas
+	m.keyPairMu.Unlock()
 
+	if !replaced {
+		return
+	}
+	change := DiffIDPMetadata(&oldEntity, entity)
+	if change.IsEmpty() {
+		return
+	}
+	if change.SigningCertificatesChanged() {
+		m.logger().Printf("WARNING: the signing certificates of IDP %s have changed: added %v, removed %v",
+			entity.EntityID, change.AddedSigningCertificates, change.RemovedSigningCertificates)
+	}
+	if m.OnIDPMetadataChange != nil {
+		m.OnIDPMetadataChange(change)
+	}
+}
+
+// unmarshalMetadata parses the XML of metadata into v, like xml.Unmarshal,
+// except that documents in a charset other than UTF-8 are decoded with
+// saml.CharsetReader.
+func unmarshalMetadata(metadata []byte, v interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(metadata))
+	decoder.CharsetReader = saml.CharsetReader
+	return decoder.Decode(v)
+}
+
+// AddIDPMetadataByEntityID reads metadata, which may be a single
+// EntityDescriptor or an aggregate EntitiesDescriptor, and adds the IDP
+// whose entityID is entityID to the IDPMetadatas map. Unlike AddIDPMetadata,
+// the metadata is decoded one entity at a time and only the matching entity
+// is kept, so large aggregates can be searched without holding every entity
+// in memory.
+//
+// The whole of metadata is read, so that an error is returned if more than
+// one entity has the EntityID, unless m.DuplicateEntityIDs is
+// UseLastDuplicateEntityID, in which case the last of them is used. If
+// m.MaxMetadataEntities is non-zero, no more than that many entities are
+// examined: an error is returned if none of them matches, and otherwise
+// the entities that follow them are not read.
+func (m *Middleware) AddIDPMetadataByEntityID(metadata io.Reader, entityID string) error {
+	decoder := xml.NewDecoder(metadata)
+	decoder.CharsetReader = saml.CharsetReader
+	examined := 0
+	var entity *saml.EntityDescriptor
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != metadataNamespace || start.Name.Local != "EntityDescriptor" {
+			continue
+		}
+
+		if m.MaxMetadataEntities != 0 && examined >= m.MaxMetadataEntities {
+			if entity == nil {
+				return fmt.Errorf("no entity found with EntityID %q in the first %d entities", entityID, examined)
+			}
+			break
+		}
+		examined++
+
+		if !hasAttr(start, "entityID", entityID) {
+			if err := decoder.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if entity != nil && m.DuplicateEntityIDs == RejectDuplicateEntityIDs {
+			return fmt.Errorf("metadata contains more than one entity with EntityID %q", entityID)
+		}
+
+		entity = &saml.EntityDescriptor{}
+		if err := decoder.DecodeElement(entity, &start); err != nil {
+			return err
+		}
+		if len(entity.IDPSSODescriptors) == 0 {
+			return fmt.Errorf("entity %q does not have an IDPSSODescriptor", entityID)
+		}
+	}
+	if entity == nil {
+		return fmt.Errorf("no entity found with EntityID %q", entityID)
+	}
+
+	m.setIDPMetadata(entity)
 	return nil
 }
 
+const metadataNamespace = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+// hasAttr returns true if start has an attribute with the given local name
+// and value.
+func hasAttr(start xml.StartElement, name string, value string) bool {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == name && attr.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataRetryDelay is how long FetchIDPMetadata waits between attempts
+// when the server does not specify a Retry-After header.
+var metadataRetryDelay = 5 * time.Second
+
 // FetchIDPMetadata fetches the IdP Metadata from the given url.
+//
+// Requests that fail with a network error, a 429 or a 5xx status are retried
+// up to m.RetryCount times. If a 429 or 503 response includes a Retry-After
+// header, it determines how long to wait before the next attempt, up to a
+// minute. Any other status, such as 401 or 404, is returned immediately.
+//
+// If m.IDPMetadataPins is set and the server's certificate chain does not
+// match any of the pins, or the server redirects to another host,
+// ErrMetadataPinMismatch is returned immediately.
+//
+// If the Middleware is closed, FetchIDPMetadata stops and returns
+// context.Canceled.
 func (m *Middleware) FetchIDPMetadata(c *http.Client, iDPMetadataURL *url.URL) error {
+	data, err := m.fetchIDPMetadata(c, iDPMetadataURL)
+	if err != nil {
+		return err
+	}
+	return m.AddIDPMetadata(data)
+}
+
+// FetchIDPMetadataFromMDQ fetches the metadata of the IDP whose entityID is
+// entityID from mdqURL, the base URL of a server that implements the
+// Metadata Query Protocol, and adds it to the IDPMetadatas map. The entity
+// is requested by its MDQTransform identifier, as
+//
+//	<mdqURL>/entities/%7Bsha1%7D<hex digest>
+//
+// and an error is returned if the response does not describe it. Requests
+// are retried and pinned as they are by FetchIDPMetadata.
+func (m *Middleware) FetchIDPMetadataFromMDQ(c *http.Client, mdqURL *url.URL, entityID string) error {
+	entityURL, err := url.Parse(strings.TrimSuffix(mdqURL.String(), "/") +
+		"/entities/" + url.QueryEscape(saml.MDQTransform(entityID)))
+	if err != nil {
+		return err
+	}
+	data, err := m.fetchIDPMetadata(c, entityURL)
+	if err != nil {
+		return err
+	}
+	return m.AddIDPMetadataByEntityID(bytes.NewReader(data), entityID)
+}
+
+// fetchIDPMetadata implements FetchIDPMetadata, returning the metadata
+// rather than adding it.
+func (m *Middleware) fetchIDPMetadata(c *http.Client, iDPMetadataURL *url.URL) ([]byte, error) {
 	if c == nil {
 		c = http.DefaultClient
 	}
+	if len(m.IDPMetadataPins) > 0 {
+		c = m.pinnedClient(c)
+	}
 	req, err := http.NewRequest("GET", iDPMetadataURL.String(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Some providers (like OneLogin) do not work properly unless the User-Agent header is specified.
 	// Setting the user agent prevents the 403 Forbidden errors.
 	req.Header.Set("User-Agent", "Golang; github.com/launchpadcentral/saml")
+	ctx := m.context()
+	req = req.WithContext(ctx)
 
 	for i := 0; true; i++ {
+		retryDelay := metadataRetryDelay
 		resp, err := c.Do(req)
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		if err == nil && len(m.IDPMetadataPins) > 0 && (resp.TLS == nil || !m.matchesIDPMetadataPin(resp.TLS.PeerCertificates)) {
+			resp.Body.Close()
+			err = ErrMetadataPinMismatch
+		}
+		if urlErr, ok := err.(*url.Error); ok && urlErr.Err == ErrMetadataPinMismatch || err == ErrMetadataPinMismatch {
+			m.ServiceProvider.Logger.Printf("ERROR: %s: %s", iDPMetadataURL, ErrMetadataPinMismatch)
+			return nil, ErrMetadataPinMismatch
+		}
 		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
 			err = fmt.Errorf("%d %s", resp.StatusCode, resp.Status)
+			if !isTransientStatus(resp.StatusCode) {
+				return nil, err
+			}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+					retryDelay = d
+				}
+			}
 		}
 		var data []byte
 		if err == nil {
@@ -139,15 +466,174 @@ func (m *Middleware) FetchIDPMetadata(c *http.Client, iDPMetadataURL *url.URL) e
 		}
 		if err != nil {
 			if i > m.RetryCount {
-				return err
+				return nil, err
 			}
 			m.ServiceProvider.Logger.Printf("ERROR: %s: %s (will retry)", iDPMetadataURL, err)
-			time.Sleep(5 * time.Second)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 			continue
 		}
 
-		return m.AddIDPMetadata(data)
+		return data, nil
+	}
+
+	return nil, errors.New("metadata fetch retry limit is reached")
+}
+
+// defaultMetadataRefreshInterval is how often Options.RefreshIDPMetadata
+// refreshes metadata that specifies neither cacheDuration nor validUntil.
+var defaultMetadataRefreshInterval = 24 * time.Hour
+
+// minMetadataRefreshInterval is the shortest time between refreshes, so
+// that metadata with a very short cacheDuration, or whose validUntil has
+// passed, is not fetched continuously.
+var minMetadataRefreshInterval = time.Minute
+
+// metadataRefreshInterval returns how long to wait before the IDP metadata
+// is refreshed.
+func (m *Middleware) metadataRefreshInterval() time.Duration {
+	m.keyPairMu.RLock()
+	entity := m.ServiceProvider.IDPMetadata
+	m.keyPairMu.RUnlock()
+
+	interval := defaultMetadataRefreshInterval
+	if entity != nil {
+		if d, ok := entity.RefreshInterval(saml.TimeNow()); ok {
+			interval = d
+		}
+	}
+	if interval < minMetadataRefreshInterval {
+		interval = minMetadataRefreshInterval
+	}
+	return interval
+}
+
+// refreshIDPMetadataPeriodically fetches the IDP metadata from the URL it
+// was originally fetched from whenever metadataRefreshInterval elapses,
+// until m is closed.
+func (m *Middleware) refreshIDPMetadataPeriodically() {
+	ctx := m.context()
+	for {
+		timer := time.NewTimer(m.metadataRefreshInterval())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if err := m.FetchIDPMetadata(m.httpClient, m.idpMetadataURL); err != nil && ctx.Err() == nil {
+			m.logger().Printf("ERROR: cannot refresh IDP metadata from %s: %s", m.idpMetadataURL, err)
+		}
+	}
+}
+
+// refreshIDPMetadata fetches the IDP metadata from the URL it was
+// originally fetched from in the background, unless a refresh is already
+// in progress.
+func (m *Middleware) refreshIDPMetadata() {
+	if m.idpMetadataURL == nil || !atomic.CompareAndSwapInt32(&m.refreshingMetadata, 0, 1) {
+		return
 	}
+	m.logger().Printf("refreshing stale IDP metadata from %s", m.idpMetadataURL)
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		defer atomic.StoreInt32(&m.refreshingMetadata, 0)
+		if err := m.FetchIDPMetadata(m.httpClient, m.idpMetadataURL); err != nil {
+			m.logger().Printf("ERROR: cannot refresh IDP metadata from %s: %s", m.idpMetadataURL, err)
+		}
+	}()
+}
+
+// ErrMetadataPinMismatch is returned by FetchIDPMetadata when the TLS
+// certificates of the metadata server do not match IDPMetadataPins, or when
+// the server redirects to another host.
+var ErrMetadataPinMismatch = errors.New("the TLS certificate of the IDP metadata server does not match any of the pins")
+
+// SPKIPin returns the pin of cert for use in IDPMetadataPins, which is the
+// base64 encoded SHA-256 hash of its DER encoded SubjectPublicKeyInfo.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
 
-	return errors.New("metadata fetch retry limit is reached")
+// matchesIDPMetadataPin returns true if any of certs matches one of
+// m.IDPMetadataPins.
+func (m *Middleware) matchesIDPMetadataPin(certs []*x509.Certificate) bool {
+	for _, cert := range certs {
+		pin := SPKIPin(cert)
+		for _, expected := range m.IDPMetadataPins {
+			if subtle.ConstantTimeCompare([]byte(pin), []byte(expected)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pinnedClient returns a copy of c for fetching metadata when
+// m.IDPMetadataPins is set. Its transport, if it is an *http.Transport,
+// completes TLS handshakes only with servers whose certificates match the
+// pins, so that no request is sent to any other. It does not follow
+// redirects to another host or scheme, which the pins of that host might
+// not cover. The pins are checked again on each response, which covers
+// other transports.
+func (m *Middleware) pinnedClient(c *http.Client) *http.Client {
+	checkRedirect := c.CheckRedirect
+	return &http.Client{
+		Transport: m.pinnedTransport(c.Transport),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host || req.URL.Scheme != via[0].URL.Scheme {
+				return ErrMetadataPinMismatch
+			}
+			if checkRedirect != nil {
+				return checkRedirect(req, via)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+		Jar:     c.Jar,
+		Timeout: c.Timeout,
+	}
+}
+
+// isTransientStatus returns true if a request that failed with statusCode
+// might succeed if it is retried.
+func isTransientStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// maxRetryAfter is the longest FetchIDPMetadata waits between attempts,
+// whatever the Retry-After header of the server asks for.
+const maxRetryAfter = time.Minute
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date, and limits it to maxRetryAfter. It
+// returns false if value is empty or cannot be parsed.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		if seconds > int(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := t.Sub(saml.TimeNow())
+		if d < 0 {
+			d = 0
+		}
+		if d > maxRetryAfter {
+			d = maxRetryAfter
+		}
+		return d, true
+	}
+	return 0, false
 }
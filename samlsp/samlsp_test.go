@@ -1,14 +1,28 @@
 package samlsp
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"runtime"
 	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
 
+	"github.com/launchpadcentral/saml"
+	"github.com/launchpadcentral/saml/logger"
 	. "gopkg.in/check.v1"
 )
 
@@ -578,3 +592,570 @@ MUsphIQXHXtrx4Z3qRgE/uZ8z98LA35XfA==
 	_, err := New(Options{IDPMetadataURL: &u})
 	c.Assert(err, IsNil)
 }
+
+const minimalIDPMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`
+
+func (test *ParseTest) TestFetchIDPMetadataDoesNotRetryNotFound(c *C) {
+	requestCount := 0
+	client := &http.Client{Transport: mockTransport(func(req *http.Request) (*http.Response, error) {
+		requestCount++
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Status:     "404 Not Found",
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})}
+
+	u := mustParseURL("https://idp.example.com/metadata")
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Logger:       logger.DefaultLogger,
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+		RetryCount: 10,
+	}
+	err := m.FetchIDPMetadata(client, &u)
+	c.Assert(err, ErrorMatches, "404 404 Not Found")
+	c.Assert(requestCount, Equals, 1)
+}
+
+func (test *ParseTest) TestFetchIDPMetadataFromMDQ(c *C) {
+	var requestedPath string
+	body := minimalIDPMetadata
+	client := &http.Client{Transport: mockTransport(func(req *http.Request) (*http.Response, error) {
+		requestedPath = req.URL.EscapedPath()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	})}
+
+	u := mustParseURL("https://mdq.example.com/global/")
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Logger:       logger.DefaultLogger,
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+	}
+	err := m.FetchIDPMetadataFromMDQ(client, &u, "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+	c.Assert(requestedPath, Equals, "/global/entities/%7Bsha1%7Dd7070df08eacb863523f9c79f8215dc969a7813d")
+	c.Assert(m.ServiceProvider.IDPMetadatas["https://idp.example.com/metadata"].IDPSSODescriptors, HasLen, 1)
+
+	// the response must describe the entity that was requested
+	body = strings.Replace(minimalIDPMetadata, "https://idp.example.com/metadata", "https://imposter.example.com/metadata", 1)
+	m.ServiceProvider.IDPMetadatas = map[string]saml.EntityDescriptor{}
+	err = m.FetchIDPMetadataFromMDQ(client, &u, "https://idp.example.com/metadata")
+	c.Assert(err, ErrorMatches, `no entity found with EntityID "https://idp.example.com/metadata"`)
+	c.Assert(m.ServiceProvider.IDPMetadatas, HasLen, 0)
+}
+
+func (test *ParseTest) TestFetchIDPMetadataRetriesServiceUnavailable(c *C) {
+	requestCount := 0
+	client := &http.Client{Transport: mockTransport(func(req *http.Request) (*http.Response, error) {
+		requestCount++
+		if requestCount == 1 {
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Status:     "503 Service Unavailable",
+				Header:     http.Header{"Retry-After": {"0"}},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(minimalIDPMetadata)),
+		}, nil
+	})}
+
+	u := mustParseURL("https://idp.example.com/metadata")
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Logger:       logger.DefaultLogger,
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+		RetryCount: 10,
+	}
+	err := m.FetchIDPMetadata(client, &u)
+	c.Assert(err, IsNil)
+	c.Assert(requestCount, Equals, 2)
+	c.Assert(m.ServiceProvider.IDPMetadata.EntityID, Equals, "https://idp.example.com/metadata")
+}
+
+func (test *ParseTest) TestParseRetryAfter(c *C) {
+	d, ok := parseRetryAfter("30")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, 30*time.Second)
+
+	// the delay is limited to a minute
+	d, ok = parseRetryAfter("120")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Minute)
+	d, ok = parseRetryAfter("99999999999")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Minute)
+
+	saml.TimeNow = func() time.Time {
+		rv, _ := time.Parse(http.TimeFormat, "Tue, 01 Dec 2015 01:57:09 GMT")
+		return rv
+	}
+	d, ok = parseRetryAfter("Tue, 01 Dec 2015 01:57:39 GMT")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, 30*time.Second)
+	d, ok = parseRetryAfter("Wed, 02 Dec 2015 01:57:09 GMT")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Minute)
+
+	_, ok = parseRetryAfter("")
+	c.Assert(ok, Equals, false)
+	_, ok = parseRetryAfter("soon")
+	c.Assert(ok, Equals, false)
+}
+
+// aggregateMetadata returns an EntitiesDescriptor containing n entities. The
+// entity at index idpIndex is an IDP with entityID
+// "https://idp.example.com/metadata"; the others are service providers.
+func aggregateMetadata(n int, idpIndex int) string {
+	buf := bytes.NewBufferString(`<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" Name="aggregate">`)
+	for i := 0; i < n; i++ {
+		if i == idpIndex {
+			buf.WriteString(strings.Replace(minimalIDPMetadata, ` xmlns="urn:oasis:names:tc:SAML:2.0:metadata"`, "", 1))
+			continue
+		}
+		fmt.Fprintf(buf, `<EntityDescriptor entityID="https://sp%d.example.com/metadata">`+
+			`<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">`+
+			`<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp%d.example.com/acs" index="1"/>`+
+			`</SPSSODescriptor></EntityDescriptor>`, i, i)
+	}
+	buf.WriteString(`</EntitiesDescriptor>`)
+	return buf.String()
+}
+
+func (test *ParseTest) TestAddIDPMetadataByEntityID(c *C) {
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+	}
+
+	err := m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(100, 50)), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadata.EntityID, Equals, "https://idp.example.com/metadata")
+	c.Assert(m.ServiceProvider.IDPMetadata.IDPSSODescriptors[0].SingleSignOnServices[0].Location, Equals, "https://idp.example.com/sso")
+	c.Assert(m.ServiceProvider.IDPMetadatas, HasLen, 1)
+
+	// a single EntityDescriptor
+	m.ServiceProvider.IDPMetadatas = map[string]saml.EntityDescriptor{}
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(minimalIDPMetadata), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadatas, HasLen, 1)
+
+	// the rest of the metadata is read after the match
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(10, 0)+"<<<"), "https://idp.example.com/metadata")
+	c.Assert(err, NotNil)
+
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(10, 5)), "https://other.example.com/metadata")
+	c.Assert(err, ErrorMatches, "no entity found with EntityID \"https://other.example.com/metadata\"")
+
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(10, 5)), "https://sp1.example.com/metadata")
+	c.Assert(err, ErrorMatches, "entity \"https://sp1.example.com/metadata\" does not have an IDPSSODescriptor")
+
+	m.MaxMetadataEntities = 5
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(10, 5)), "https://idp.example.com/metadata")
+	c.Assert(err, ErrorMatches, "no entity found with EntityID \"https://idp.example.com/metadata\" in the first 5 entities")
+	m.MaxMetadataEntities = 6
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(10, 5)), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+
+	// decoding stops after MaxMetadataEntities, so trailing garbage is not
+	// seen
+	m.MaxMetadataEntities = 1
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(aggregateMetadata(10, 0)+"<<<"), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+}
+
+func (test *ParseTest) TestAddIDPMetadataDuplicateEntityIDs(c *C) {
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+	}
+
+	// two IDPs that share an EntityID but not an SSO endpoint
+	imposter := strings.Replace(strings.Replace(minimalIDPMetadata,
+		` xmlns="urn:oasis:names:tc:SAML:2.0:metadata"`, "", 1),
+		"https://idp.example.com/sso", "https://imposter.example.com/sso", 1)
+	metadata := strings.Replace(aggregateMetadata(3, 1), "</EntitiesDescriptor>", imposter+"</EntitiesDescriptor>", 1)
+
+	err := m.AddIDPMetadata([]byte(metadata))
+	c.Assert(err, ErrorMatches, "metadata contains more than one entity with EntityID \"https://idp.example.com/metadata\"")
+	c.Assert(m.ServiceProvider.IDPMetadatas, HasLen, 0)
+	c.Assert(m.ServiceProvider.IDPMetadata, IsNil)
+
+	m.DuplicateEntityIDs = UseLastDuplicateEntityID
+	err = m.AddIDPMetadata([]byte(metadata))
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadatas["https://idp.example.com/metadata"].IDPSSODescriptors[0].SingleSignOnServices[0].Location,
+		Equals, "https://imposter.example.com/sso")
+
+	// aggregates without duplicates are accepted either way
+	m.DuplicateEntityIDs = RejectDuplicateEntityIDs
+	err = m.AddIDPMetadata([]byte(aggregateMetadata(3, 1)))
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadatas["https://idp.example.com/metadata"].IDPSSODescriptors[0].SingleSignOnServices[0].Location,
+		Equals, "https://idp.example.com/sso")
+
+	// the duplicate may be in a nested aggregate
+	nested := strings.Replace(aggregateMetadata(3, 1), "</EntitiesDescriptor>",
+		`<EntitiesDescriptor Name="nested">`+imposter+"</EntitiesDescriptor></EntitiesDescriptor>", 1)
+	err = m.AddIDPMetadata([]byte(nested))
+	c.Assert(err, ErrorMatches, "metadata contains more than one entity with EntityID \"https://idp.example.com/metadata\"")
+
+	// AddIDPMetadataByEntityID reads on after the first match to find the
+	// duplicate
+	m.ServiceProvider.IDPMetadatas = map[string]saml.EntityDescriptor{}
+	m.ServiceProvider.IDPMetadata = nil
+	for _, metadata := range []string{metadata, nested} {
+		err = m.AddIDPMetadataByEntityID(strings.NewReader(metadata), "https://idp.example.com/metadata")
+		c.Assert(err, ErrorMatches, "metadata contains more than one entity with EntityID \"https://idp.example.com/metadata\"")
+		c.Assert(m.ServiceProvider.IDPMetadatas, HasLen, 0)
+	}
+
+	// unless the duplicate is beyond MaxMetadataEntities
+	m.MaxMetadataEntities = 3
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(metadata), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadatas["https://idp.example.com/metadata"].IDPSSODescriptors[0].SingleSignOnServices[0].Location,
+		Equals, "https://idp.example.com/sso")
+	m.MaxMetadataEntities = 0
+
+	m.DuplicateEntityIDs = UseLastDuplicateEntityID
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(nested), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadatas["https://idp.example.com/metadata"].IDPSSODescriptors[0].SingleSignOnServices[0].Location,
+		Equals, "https://imposter.example.com/sso")
+}
+
+func (test *ParseTest) TestAddIDPMetadataLatin1(c *C) {
+	metadata := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" + strings.Replace(minimalIDPMetadata,
+		"</IDPSSODescriptor>",
+		"</IDPSSODescriptor>\n  <Organization><OrganizationDisplayName xml:lang=\"de\">Universit\xe4t</OrganizationDisplayName></Organization>", 1)
+
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+	}
+	err := m.AddIDPMetadata([]byte(metadata))
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadata.Organization.OrganizationDisplayNames[0].Value, Equals, "Universität")
+
+	m.ServiceProvider.IDPMetadatas = map[string]saml.EntityDescriptor{}
+	err = m.AddIDPMetadataByEntityID(strings.NewReader(metadata), "https://idp.example.com/metadata")
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadata.Organization.OrganizationDisplayNames[0].Value, Equals, "Universität")
+
+	err = m.AddIDPMetadata([]byte(strings.Replace(metadata, "ISO-8859-1", "KOI8-R", 1)))
+	c.Assert(err, ErrorMatches, `.*unsupported charset "KOI8-R"`)
+}
+
+// The following benchmarks compare the cost of finding one IDP in a large
+// aggregate. Run them with -benchmem to compare allocations.
+
+func BenchmarkAddIDPMetadata(b *testing.B) {
+	metadata := []byte(aggregateMetadata(5000, 4999))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := &Middleware{ServiceProvider: saml.ServiceProvider{IDPMetadatas: map[string]saml.EntityDescriptor{}}}
+		if err := m.AddIDPMetadata(metadata); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddIDPMetadataByEntityID(b *testing.B) {
+	metadata := []byte(aggregateMetadata(5000, 4999))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := &Middleware{ServiceProvider: saml.ServiceProvider{IDPMetadatas: map[string]saml.EntityDescriptor{}}}
+		if err := m.AddIDPMetadataByEntityID(bytes.NewReader(metadata), "https://idp.example.com/metadata"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func (test *ParseTest) TestFetchIDPMetadataEnforcesPins(c *C) {
+	requestCount := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Write([]byte(minimalIDPMetadata))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	serverCert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	c.Assert(err, IsNil)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	u := mustParseURL(server.URL)
+
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Logger:       logger.DefaultLogger,
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+		RetryCount:      10,
+		IDPMetadataPins: []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", SPKIPin(serverCert)},
+	}
+	err = m.FetchIDPMetadata(client, &u)
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.IDPMetadata.EntityID, Equals, "https://idp.example.com/metadata")
+
+	requestCount = 0
+	m.IDPMetadataPins = []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+	err = m.FetchIDPMetadata(client, &u)
+	c.Assert(err, Equals, ErrMetadataPinMismatch)
+	// the handshake fails, so no request reaches the server
+	c.Assert(requestCount, Equals, 0)
+
+	plainServer := httptest.NewServer(handler)
+	defer plainServer.Close()
+	u = mustParseURL(plainServer.URL)
+	m.IDPMetadataPins = []string{SPKIPin(serverCert)}
+	err = m.FetchIDPMetadata(client, &u)
+	c.Assert(err, Equals, ErrMetadataPinMismatch)
+
+	// redirects to another host are not followed
+	redirectServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plainServer.URL, http.StatusFound)
+	}))
+	defer redirectServer.Close()
+	u = mustParseURL(redirectServer.URL)
+	requestCount = 0
+	err = m.FetchIDPMetadata(client, &u)
+	c.Assert(err, Equals, ErrMetadataPinMismatch)
+	c.Assert(requestCount, Equals, 0)
+}
+
+func (test *ParseTest) TestCloseCancelsFetchIDPMetadata(c *C) {
+	requested := make(chan struct{}, 10)
+	client := &http.Client{Transport: mockTransport(func(req *http.Request) (*http.Response, error) {
+		requested <- struct{}{}
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Header:     http.Header{"Retry-After": {"3600"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})}
+
+	u := mustParseURL("https://idp.example.com/metadata")
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Logger:       logger.DefaultLogger,
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+		RetryCount: 10,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	goroutines := runtime.NumGoroutine()
+	done := make(chan error)
+	go func() {
+		done <- m.FetchIDPMetadata(client, &u)
+	}()
+	<-requested
+
+	c.Assert(m.Close(), IsNil)
+	select {
+	case err := <-done:
+		c.Assert(err, Equals, context.Canceled)
+	case <-time.After(5 * time.Second):
+		c.Fatal("FetchIDPMetadata did not return after Close")
+	}
+	c.Assert(runtime.NumGoroutine() <= goroutines, Equals, true)
+
+	// Close may be called again, and later fetches fail immediately.
+	c.Assert(m.Close(), IsNil)
+	err := m.FetchIDPMetadata(client, &u)
+	c.Assert(err, Equals, context.Canceled)
+}
+
+type closingReplayStore struct {
+	closed int
+}
+
+func (s *closingReplayStore) Consume(id string, expires time.Time) error {
+	return nil
+}
+
+func (s *closingReplayStore) Close() error {
+	s.closed++
+	return errors.New("cannot close")
+}
+
+func (test *ParseTest) TestCloseClosesReplayStore(c *C) {
+	store := &closingReplayStore{}
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{ReplayStore: store}}
+	c.Assert(m.Close(), ErrorMatches, "cannot close")
+	c.Assert(store.closed, Equals, 1)
+
+	// the store is closed once
+	c.Assert(m.Close(), ErrorMatches, "cannot close")
+	c.Assert(store.closed, Equals, 1)
+}
+
+func (test *ParseTest) TestIDPMetadataChange(c *C) {
+	metadata := func(validUntil, cert, ssoLocation, sloLocation string) []byte {
+		return []byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="https://idp.example.com/metadata" validUntil="` + validUntil + `">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + cert + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo></KeyDescriptor>
+    <KeyDescriptor use="encryption"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + cert + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo></KeyDescriptor>
+    <SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="` + sloLocation + `"/>
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="` + ssoLocation + `"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`)
+	}
+	fingerprint := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+
+	var changes []IDPMetadataChange
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Logger:       logger.DefaultLogger,
+			IDPMetadatas: map[string]saml.EntityDescriptor{},
+		},
+		OnIDPMetadataChange: func(change IDPMetadataChange) {
+			changes = append(changes, change)
+		},
+	}
+
+	// adding metadata for a new IDP is not a change
+	err := m.AddIDPMetadata(metadata("2017-01-01T00:00:00Z", "b2xk", "https://idp.example.com/sso", "https://idp.example.com/slo"))
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 0)
+
+	// neither is adding the same metadata again
+	err = m.AddIDPMetadata(metadata("2017-01-01T00:00:00Z", "b2xk", "https://idp.example.com/sso", "https://idp.example.com/slo"))
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 0)
+
+	err = m.AddIDPMetadata(metadata("2018-01-01T00:00:00Z", "bmV3", "https://idp.example.com/sso2", "https://idp.example.com/slo"))
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []IDPMetadataChange{{
+		EntityID:                   "https://idp.example.com/metadata",
+		AddedSigningCertificates:   []string{fingerprint("new")},
+		RemovedSigningCertificates: []string{fingerprint("old")},
+		SingleSignOnServices: []EndpointChange{{
+			Binding:     "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
+			OldLocation: "https://idp.example.com/sso",
+			NewLocation: "https://idp.example.com/sso2",
+		}},
+		OldValidUntil: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		NewValidUntil: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+	}})
+	c.Assert(changes[0].SigningCertificatesChanged(), Equals, true)
+	c.Assert(m.ServiceProvider.IDPMetadata.IDPSSODescriptors[0].SingleSignOnServices[0].Location, Equals, "https://idp.example.com/sso2")
+}
+
+func (test *ParseTest) TestDiffIDPMetadataEndpoints(c *C) {
+	oldEntity := &saml.EntityDescriptor{IDPSSODescriptors: []saml.IDPSSODescriptor{{
+		SingleSignOnServices: []saml.Endpoint{
+			{Binding: saml.HTTPPostBinding, Location: "https://idp.example.com/sso/post"},
+		},
+	}}}
+	newEntity := &saml.EntityDescriptor{IDPSSODescriptors: []saml.IDPSSODescriptor{{
+		SingleSignOnServices: []saml.Endpoint{
+			{Binding: saml.HTTPRedirectBinding, Location: "https://idp.example.com/sso/redirect"},
+		},
+	}}}
+	change := DiffIDPMetadata(oldEntity, newEntity)
+	c.Assert(change.SingleSignOnServices, DeepEquals, []EndpointChange{
+		{Binding: saml.HTTPPostBinding, OldLocation: "https://idp.example.com/sso/post"},
+		{Binding: saml.HTTPRedirectBinding, NewLocation: "https://idp.example.com/sso/redirect"},
+	})
+	c.Assert(change.SigningCertificatesChanged(), Equals, false)
+	c.Assert(change.IsEmpty(), Equals, false)
+	c.Assert(DiffIDPMetadata(newEntity, newEntity).IsEmpty(), Equals, true)
+}
+
+func (test *ParseTest) TestNewRequireHTTPS(c *C) {
+	_, err := New(Options{URL: mustParseURL("http://sp.example.com/"), RequireHTTPS: true})
+	c.Assert(err, ErrorMatches, "RequireHTTPS is set, but URL http://sp.example.com/ is not an https URL")
+
+	idpMetadataURL := mustParseURL("http://idp.example.com/metadata")
+	_, err = New(Options{URL: mustParseURL("https://sp.example.com/"), IDPMetadataURL: &idpMetadataURL, RequireHTTPS: true})
+	c.Assert(err, ErrorMatches, "RequireHTTPS is set, but IDPMetadataURL http://idp.example.com/metadata is not an https URL")
+
+	m, err := New(Options{URL: mustParseURL("https://sp.example.com/"), RequireHTTPS: true})
+	c.Assert(err, IsNil)
+	c.Assert(m.RequireHTTPS, Equals, true)
+	m.Close()
+
+	// plaintext HTTP is allowed unless RequireHTTPS is set
+	m, err = New(Options{URL: mustParseURL("http://localhost:8000/")})
+	c.Assert(err, IsNil)
+	c.Assert(m.RequireHTTPS, Equals, false)
+	m.Close()
+}
+
+func (test *ParseTest) TestRefreshIDPMetadata(c *C) {
+	defer func(d time.Duration) { minMetadataRefreshInterval = d }(minMetadataRefreshInterval)
+	minMetadataRefreshInterval = time.Millisecond
+
+	var requestCount int32
+	client := &http.Client{Transport: mockTransport(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requestCount, 1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body: ioutil.NopCloser(strings.NewReader(
+				`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata" cacheDuration="PT0.01S">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`)),
+		}, nil
+	})}
+
+	u := mustParseURL("https://idp.example.com/metadata")
+	m, err := New(Options{IDPMetadataURL: &u, HTTPClient: client, RefreshIDPMetadata: true})
+	c.Assert(err, IsNil)
+	c.Assert(m.metadataRefreshInterval(), Equals, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&requestCount) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(atomic.LoadInt32(&requestCount) >= 3, Equals, true)
+
+	// closing the Middleware stops the refreshes
+	m.Close()
+	n := atomic.LoadInt32(&requestCount)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&requestCount), Equals, n)
+}
+
+func (test *ParseTest) TestMetadataRefreshInterval(c *C) {
+	m := &Middleware{}
+	c.Assert(m.metadataRefreshInterval(), Equals, defaultMetadataRefreshInterval)
+
+	m.ServiceProvider.IDPMetadata = &saml.EntityDescriptor{CacheDuration: time.Second}
+	c.Assert(m.metadataRefreshInterval(), Equals, minMetadataRefreshInterval)
+
+	m.ServiceProvider.IDPMetadata = &saml.EntityDescriptor{CacheDuration: 12 * time.Hour}
+	c.Assert(m.metadataRefreshInterval(), Equals, 12*time.Hour)
+}
@@ -0,0 +1,181 @@
+package samlsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/launchpadcentral/saml"
+)
+
+// SessionEncryption selects how the session cookie is protected.
+type SessionEncryption string
+
+// Values for SessionEncryption
+const (
+	// SessionSigned stores the session as a signed JWT. The claims cannot
+	// be modified by the client, but they can be read. This is the default.
+	SessionSigned SessionEncryption = ""
+
+	// SessionEncryptedRSA stores the signed JWT encrypted as a JWE, with a
+	// random content key that is encrypted with RSA-OAEP to the key of the
+	// service provider.
+	SessionEncryptedRSA SessionEncryption = "RSA-OAEP"
+
+	// SessionEncryptedDirect stores the signed JWT encrypted as a JWE with
+	// Middleware.SessionEncryptionKey, which must be 16, 24 or 32 bytes
+	// long. This produces smaller cookies than SessionEncryptedRSA.
+	SessionEncryptedDirect SessionEncryption = "dir"
+)
+
+// jweHeader is the protected header of a session JWE.
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	ContentType string `json:"cty"`
+	KeyID       string `json:"kid,omitempty"`
+}
+
+// errInvalidSessionEncryptionKey is returned when SessionEncryptionKey is
+// not a valid AES key.
+var errInvalidSessionEncryptionKey = errors.New("session encryption key must be 16, 24 or 32 bytes long")
+
+// gcmEncryption returns the name of the JWE content encryption algorithm
+// for a key of length keyLen, which is the "enc" header of the token.
+func gcmEncryption(keyLen int) (string, error) {
+	switch keyLen {
+	case 16, 24, 32:
+		return fmt.Sprintf("A%dGCM", keyLen*8), nil
+	}
+	return "", errInvalidSessionEncryptionKey
+}
+
+// encodeSessionToken returns the value of the session cookie that holds
+// signedToken, encrypting it if m.SessionEncryption calls for it.
+func (m *Middleware) encodeSessionToken(sp *saml.ServiceProvider, signedToken string) (string, error) {
+	var cek, encryptedKey []byte
+	switch m.SessionEncryption {
+	case SessionSigned:
+		return signedToken, nil
+	case SessionEncryptedDirect:
+		cek = m.SessionEncryptionKey
+	case SessionEncryptedRSA:
+		cek = randomBytes(32)
+		var err error
+		encryptedKey, err = rsa.EncryptOAEP(sha1.New(), saml.RandReader, &sp.Key.PublicKey, cek, nil)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unknown session encryption %q", m.SessionEncryption)
+	}
+
+	enc, err := gcmEncryption(len(cek))
+	if err != nil {
+		return "", err
+	}
+	headerFields := jweHeader{
+		Algorithm:   string(m.SessionEncryption),
+		Encryption:  enc,
+		ContentType: "JWT",
+	}
+	if m.SessionEncryption == SessionEncryptedRSA {
+		headerFields.KeyID = sessionKeyID(sp.Key)
+	}
+	headerBuf, err := json.Marshal(headerFields)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString(headerBuf)
+
+	aead, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	iv := randomBytes(aead.NonceSize())
+	sealed := aead.Seal(nil, iv, []byte(signedToken), []byte(header))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	return strings.Join([]string{
+		header,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decodeSessionToken returns the signed JWT held in the session cookie
+// value, decrypting it if m.SessionEncryption calls for it. A token that
+// was not protected as m.SessionEncryption requires is rejected.
+func (m *Middleware) decodeSessionToken(sp *saml.ServiceProvider, value string) (string, error) {
+	if m.SessionEncryption == SessionSigned {
+		return value, nil
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 5 {
+		return "", errors.New("token is not encrypted")
+	}
+	var decoded [5][]byte
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return "", fmt.Errorf("cannot decode encrypted token: %s", err)
+		}
+	}
+	header := jweHeader{}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return "", fmt.Errorf("cannot decode encrypted token header: %s", err)
+	}
+	if header.Algorithm != string(m.SessionEncryption) {
+		return "", fmt.Errorf("unexpected token key management algorithm %q", header.Algorithm)
+	}
+
+	var cek []byte
+	switch m.SessionEncryption {
+	case SessionEncryptedDirect:
+		cek = m.SessionEncryptionKey
+	case SessionEncryptedRSA:
+		key, err := m.sessionKey(sp, header.KeyID)
+		if err != nil {
+			return "", err
+		}
+		cek, err = rsa.DecryptOAEP(sha1.New(), saml.RandReader, key, decoded[1], nil)
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt token key: %s", err)
+		}
+	default:
+		return "", fmt.Errorf("unknown session encryption %q", m.SessionEncryption)
+	}
+	if enc, err := gcmEncryption(len(cek)); err != nil || enc != header.Encryption {
+		return "", fmt.Errorf("unexpected token encryption %q", header.Encryption)
+	}
+
+	aead, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	if len(decoded[2]) != aead.NonceSize() {
+		return "", errors.New("invalid token initialization vector")
+	}
+	plaintext, err := aead.Open(nil, decoded[2], append(decoded[3], decoded[4]...), []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt token: %s", err)
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
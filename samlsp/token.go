@@ -0,0 +1,92 @@
+package samlsp
+
+import (
+	"context"
+	"time"
+
+	"github.com/launchpadcentral/saml"
+)
+
+type tokenContextKey struct{}
+
+// WithToken returns a new context with token associated with it.
+// RequireAccount uses this to make the session token available to the
+// wrapped handler.
+func WithToken(ctx context.Context, token *TokenClaims) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+// Token returns the session token associated with ctx, or nil if there is
+// no token.
+func Token(ctx context.Context) *TokenClaims {
+	token, _ := ctx.Value(tokenContextKey{}).(*TokenClaims)
+	return token
+}
+
+// NameIDFromContext returns the NameID of the authenticated user, or nil
+// if ctx has no session token or the assertion did not contain a NameID.
+//
+// For persistent NameIDs this, rather than any attribute, is the stable
+// identifier for the user.
+func NameIDFromContext(ctx context.Context) *saml.NameID {
+	token := Token(ctx)
+	if token == nil || token.Subject == "" {
+		return nil
+	}
+	return &saml.NameID{
+		Value:           token.Subject,
+		Format:          token.NameIDFormat,
+		NameQualifier:   token.NameQualifier,
+		SPNameQualifier: token.SPNameQualifier,
+	}
+}
+
+// SessionNotOnOrAfterFromContext returns the time at which the IDP session
+// of the authenticated user ends, so that the application can arrange to
+// authenticate the user again beforehand. If the IDP did not specify it, the
+// expiry of the session cookie is returned. It returns the zero time if ctx
+// has no session token.
+func SessionNotOnOrAfterFromContext(ctx context.Context) time.Time {
+	token := Token(ctx)
+	if token == nil || token.SessionNotOnOrAfter == 0 {
+		return time.Time{}
+	}
+	return time.Unix(token.SessionNotOnOrAfter, 0)
+}
+
+// IssuerFromContext returns the entity ID of the IDP that authenticated the
+// user, or "" if ctx has no session token. The metadata of the IDP can be
+// found with ServiceProvider.IDPMetadataByEntityID.
+func IssuerFromContext(ctx context.Context) string {
+	token := Token(ctx)
+	if token == nil {
+		return ""
+	}
+	return token.Issuer
+}
+
+// AuthnContextLevelFromContext returns the assurance level with which the
+// user authenticated, as determined by ServiceProvider.AuthnContextLevels
+// from the AuthnContextClassRef of the assertion, so that the application
+// can require a stronger authentication for some operations. It returns 0
+// if ctx has no session token or the level is unknown.
+func AuthnContextLevelFromContext(ctx context.Context) int {
+	token := Token(ctx)
+	if token == nil {
+		return 0
+	}
+	return token.AuthnContextLevel
+}
+
+// IsIDPInitiated returns true if the session was established by an
+// assertion that the IDP sent unsolicited, rather than in response to an
+// AuthnRequest, so that the application can, for example, require an
+// additional step before sensitive operations. It returns false if ctx has
+// no session token.
+func IsIDPInitiated(ctx context.Context) bool {
+	token := Token(ctx)
+	if token == nil {
+		return false
+	}
+	return token.IDPInitiated
+}
@@ -0,0 +1,376 @@
+// Package samltest provides a mock identity provider for black-box tests of
+// service providers, such as applications protected by samlsp.Middleware.
+package samltest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/launchpadcentral/saml"
+	"github.com/launchpadcentral/saml/logger"
+)
+
+// Failure is a failure that an IDP simulates in the responses that it
+// sends.
+type Failure int
+
+const (
+	// NoFailure causes an IDP to send valid responses.
+	NoFailure Failure = iota
+
+	// BadSignature causes an IDP to sign responses with a key other than
+	// the one in its metadata, so that their signatures do not verify.
+	BadSignature
+
+	// ExpiredAssertion causes an IDP to send assertions that were issued
+	// and expired an hour ago.
+	ExpiredAssertion
+
+	// NoPassive causes an IDP to send responses without an assertion, with
+	// the NoPassive status that an IDP returns when it cannot authenticate
+	// the user without interacting with them.
+	NoPassive
+)
+
+// IDP is a mock identity provider that runs on an httptest.Server. It
+// serves its metadata at MetadataURL and accepts AuthnRequests at SSOURL,
+// with the HTTP-Redirect and HTTP-POST bindings, from the service providers
+// that were added with AddServiceProvider. Without prompting, it logs in
+// the user that Session describes, and sends a signed response with the
+// HTTP-POST binding to the assertion consumer service of the SP.
+//
+// The fields may be changed between requests, but not during one.
+type IDP struct {
+	Server           *httptest.Server
+	IdentityProvider *saml.IdentityProvider
+	Key              *rsa.PrivateKey
+	Certificate      *x509.Certificate
+
+	// Session is the session of the user that the IDP logs in. The
+	// attributes of the assertion are made from it as they are by
+	// saml.DefaultAssertionMaker.
+	Session saml.Session
+
+	// Attributes are added to the assertion, each with the basic name
+	// format and with its name as its FriendlyName as well.
+	Attributes map[string][]string
+
+	// Encrypt causes the assertions to be encrypted with the encryption
+	// certificate in the metadata of the SP. Otherwise they are only
+	// signed.
+	Encrypt bool
+
+	// Failure is the failure that the IDP simulates. By default, it sends
+	// valid responses.
+	Failure Failure
+
+	mu               sync.Mutex
+	serviceProviders map[string]*saml.EntityDescriptor
+	badKey           *rsa.PrivateKey
+	badCertificate   *x509.Certificate
+}
+
+// NewIDP starts a new IDP with a newly generated key pair that logs in a
+// user named "alice". The IDP must be closed when it is no longer used.
+func NewIDP() (*IDP, error) {
+	key, certificate, err := NewKeyPair("idp.example.com")
+	if err != nil {
+		return nil, err
+	}
+
+	idp := &IDP{
+		Key:         key,
+		Certificate: certificate,
+		Session: saml.Session{
+			NameID:         "alice",
+			UserName:       "alice",
+			UserEmail:      "alice@example.com",
+			UserCommonName: "Alice Smith",
+			UserSurname:    "Smith",
+			UserGivenName:  "Alice",
+		},
+		serviceProviders: map[string]*saml.EntityDescriptor{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		idp.IdentityProvider.ServeMetadata(w, r)
+	})
+	mux.HandleFunc("/sso", idp.serveSSO)
+	idp.Server = httptest.NewServer(mux)
+
+	metadataURL, _ := url.Parse(idp.Server.URL + "/metadata")
+	ssoURL, _ := url.Parse(idp.Server.URL + "/sso")
+	idp.IdentityProvider = &saml.IdentityProvider{
+		Key:                     key,
+		Logger:                  logger.DefaultLogger,
+		Certificate:             certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: idp,
+		SessionProvider:         idp,
+		AssertionMaker:          idp,
+	}
+	return idp, nil
+}
+
+// Close shuts down the server of the IDP.
+func (idp *IDP) Close() {
+	idp.Server.Close()
+}
+
+// MetadataURL returns the URL of the metadata of the IDP, such as for
+// samlsp.Options.IDPMetadataURL.
+func (idp *IDP) MetadataURL() *url.URL {
+	u := idp.IdentityProvider.MetadataURL
+	return &u
+}
+
+// Metadata returns the metadata of the IDP, such as for
+// samlsp.Options.IDPMetadata.
+func (idp *IDP) Metadata() *saml.EntityDescriptor {
+	return idp.IdentityProvider.Metadata()
+}
+
+// AddServiceProvider allows the SP whose metadata is md to send requests to
+// the IDP.
+func (idp *IDP) AddServiceProvider(md *saml.EntityDescriptor) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.serviceProviders[md.EntityID] = md
+}
+
+// GetServiceProvider implements saml.ServiceProviderProvider. Unless
+// Encrypt is set, the certificates are removed from the metadata, so that
+// the assertions are not encrypted.
+func (idp *IDP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	idp.mu.Lock()
+	md, ok := idp.serviceProviders[serviceProviderID]
+	idp.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if idp.Encrypt {
+		return md, nil
+	}
+
+	rv := *md
+	rv.SPSSODescriptors = append([]saml.SPSSODescriptor(nil), md.SPSSODescriptors...)
+	for i := range rv.SPSSODescriptors {
+		rv.SPSSODescriptors[i].KeyDescriptors = nil
+	}
+	return &rv, nil
+}
+
+// GetSession implements saml.SessionProvider, returning Session.
+func (idp *IDP) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	session := idp.Session
+	session.ID = fmt.Sprintf("%x", randomBytes(16))
+	session.Index = session.ID
+	session.CreateTime = saml.TimeNow()
+	session.ExpireTime = session.CreateTime.Add(time.Hour)
+	return &session
+}
+
+// MakeAssertion implements saml.AssertionMaker, adding Attributes to the
+// assertion of saml.DefaultAssertionMaker and simulating
+// ExpiredAssertion.
+func (idp *IDP) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		return err
+	}
+	assertion := req.Assertion
+
+	names := []string{}
+	for name := range idp.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attribute := saml.Attribute{
+			FriendlyName: name,
+			Name:         name,
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+		}
+		for _, value := range idp.Attributes[name] {
+			attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+		}
+		assertion.AttributeStatements[0].Attributes = append(assertion.AttributeStatements[0].Attributes, attribute)
+	}
+
+	if idp.Failure == ExpiredAssertion {
+		past := saml.TimeNow().Add(-time.Hour)
+		assertion.IssueInstant = past
+		assertion.Conditions.NotBefore = past
+		assertion.Conditions.NotOnOrAfter = past.Add(saml.MaxIssueDelay)
+		for _, confirmation := range assertion.Subject.SubjectConfirmations {
+			confirmation.SubjectConfirmationData.NotOnOrAfter = past.Add(saml.MaxIssueDelay)
+		}
+	}
+	return nil
+}
+
+// serveSSO is like saml.IdentityProvider.ServeSSO, but simulates
+// BadSignature and NoPassive.
+func (idp *IDP) serveSSO(w http.ResponseWriter, r *http.Request) {
+	identityProvider := idp.IdentityProvider
+	if idp.Failure == BadSignature {
+		key, certificate, err := idp.badKeyPair()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		signer := *identityProvider
+		signer.Key = key
+		signer.Certificate = certificate
+		identityProvider = &signer
+	}
+	if idp.Failure != NoPassive {
+		identityProvider.ServeSSO(w, r)
+		return
+	}
+
+	req, err := saml.NewIdpAuthnRequest(identityProvider, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := saml.Response{
+		Destination:  req.ACSEndpoint.Location,
+		ID:           saml.NewID(),
+		InResponseTo: req.Request.ID,
+		IssueInstant: saml.TimeNow(),
+		Version:      "2.0",
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  identityProvider.MetadataURL.String(),
+		},
+		Status: saml.Status{
+			StatusCode: saml.StatusCode{
+				Value:      saml.StatusResponder,
+				StatusCode: &saml.StatusCode{Value: saml.StatusNoPassive},
+			},
+		},
+	}
+	req.ResponseEl = response.Element()
+	if err := req.WriteResponse(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// badKeyPair returns the key pair with which responses are signed to
+// simulate BadSignature, generating it the first time.
+func (idp *IDP) badKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	if idp.badKey == nil {
+		key, certificate, err := NewKeyPair("idp.example.com")
+		if err != nil {
+			return nil, nil, err
+		}
+		idp.badKey, idp.badCertificate = key, certificate
+	}
+	return idp.badKey, idp.badCertificate, nil
+}
+
+// maxForms is the number of HTML forms that Login submits before it gives
+// up.
+const maxForms = 5
+
+var (
+	formActionRegexp = regexp.MustCompile(`<form method="post" action="([^"]*)"`)
+	formInputRegexp  = regexp.MustCompile(`<input type="hidden" name="([^"]*)" value="([^"]*)"`)
+)
+
+// Login requests u with client, and follows the SAML login flow that it
+// begins to the end, as a browser would: it follows the redirects and
+// submits the HTML forms with which the SP sends the AuthnRequest and the
+// IDP sends the response. It returns the last response, which is usually
+// that of u once the user is logged in. client must have a cookie jar, so
+// that the SP can recognize the user.
+func (idp *IDP) Login(client *http.Client, u string) (*http.Response, error) {
+	if client.Jar == nil {
+		return nil, errors.New("client must have a cookie jar")
+	}
+	resp, err := client.Get(u)
+	for i := 0; ; i++ {
+		if err != nil {
+			return nil, err
+		}
+		var body []byte
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		action := formActionRegexp.FindSubmatch(body)
+		if action == nil || !bytes.Contains(body, []byte(`name="SAML`)) {
+			return resp, nil
+		}
+		if i >= maxForms {
+			return nil, fmt.Errorf("more than %d forms were submitted", maxForms)
+		}
+		form := url.Values{}
+		for _, input := range formInputRegexp.FindAllSubmatch(body, -1) {
+			form.Set(html.UnescapeString(string(input[1])), html.UnescapeString(string(input[2])))
+		}
+		resp, err = client.PostForm(html.UnescapeString(string(action[1])), form)
+	}
+}
+
+// NewKeyPair returns a new 2048 bit RSA key and a self-signed certificate
+// for it, whose common name is commonName, that is valid for a day. It can
+// be used for the SP under test.
+func NewKeyPair(commonName string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(randomBytes(16)),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certificate, nil
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
@@ -0,0 +1,126 @@
+package samltest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/launchpadcentral/saml/samlsp"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type IDPTest struct {
+	IDP    *IDP
+	App    *httptest.Server
+	Client *http.Client
+	LogBuf *bytes.Buffer
+}
+
+var _ = Suite(&IDPTest{})
+
+func (test *IDPTest) SetUpTest(c *C) {
+	var err error
+	test.IDP, err = NewIDP()
+	c.Assert(err, IsNil)
+	test.IDP.Attributes = map[string][]string{"Department": {"Engineering"}}
+
+	// the application under test, whose /hello route is protected
+	mux := http.NewServeMux()
+	test.App = httptest.NewServer(mux)
+	appURL, err := url.Parse(test.App.URL)
+	c.Assert(err, IsNil)
+
+	key, certificate, err := NewKeyPair("sp.example.com")
+	c.Assert(err, IsNil)
+	test.LogBuf = &bytes.Buffer{}
+	m, err := samlsp.New(samlsp.Options{
+		URL:            *appURL,
+		Key:            key,
+		Certificate:    certificate,
+		IDPMetadataURL: test.IDP.MetadataURL(),
+		Logger:         log.New(test.LogBuf, "", 0),
+	})
+	c.Assert(err, IsNil)
+	test.IDP.AddServiceProvider(m.ServiceProvider.Metadata())
+
+	mux.Handle("/saml/", m)
+	mux.Handle("/hello", m.RequireAccount(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := samlsp.Token(r.Context())
+		fmt.Fprintf(w, "Hello, %s from %s!", token.Subject, token.Attributes["Department"][0])
+	})))
+
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, IsNil)
+	test.Client = &http.Client{Jar: jar}
+}
+
+func (test *IDPTest) TearDownTest(c *C) {
+	test.App.Close()
+	test.IDP.Close()
+}
+
+func (test *IDPTest) login(c *C) (int, string) {
+	resp, err := test.IDP.Login(test.Client, test.App.URL+"/hello")
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, string(body)
+}
+
+func (test *IDPTest) TestLogin(c *C) {
+	status, body := test.login(c)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "Hello, alice from Engineering!")
+
+	// the session cookie is set, so the IDP is not asked again
+	test.IDP.Failure = NoPassive
+	resp, err := test.Client.Get(test.App.URL + "/hello")
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (test *IDPTest) TestLoginEncrypted(c *C) {
+	test.IDP.Encrypt = true
+	status, body := test.login(c)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "Hello, alice from Engineering!")
+}
+
+func (test *IDPTest) TestFailures(c *C) {
+	for failure, expected := range map[Failure]string{
+		BadSignature:     "cannot validate signature on Response: .*",
+		ExpiredAssertion: "assertion invalid: expired on .*",
+		NoPassive:        "the IDP cannot authenticate the user passively",
+	} {
+		test.LogBuf.Reset()
+		test.IDP.Failure = failure
+		status, _ := test.login(c)
+		c.Assert(status, Equals, http.StatusForbidden)
+		c.Assert(test.LogBuf.String(), Matches, "(?s).*"+expected+".*")
+	}
+}
+
+func (test *IDPTest) TestLoginFormPostFails(c *C) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/form", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<form method="post" action="%s/acs">`+
+			`<input type="hidden" name="SAMLResponse" value="x" /></form>`, closed.URL)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	_, err := test.IDP.Login(test.Client, server.URL+"/form")
+	c.Assert(err, NotNil)
+}
@@ -441,11 +441,17 @@ type Assertion struct {
 	Signature    *etree.Element
 	Subject      *Subject
 	Conditions   *Conditions
-	// Advice *Advice
+	Advice       *Advice
 	// Statements []Statement
 	AuthnStatements []AuthnStatement `xml:"AuthnStatement"`
 	// AuthzDecisionStatements []AuthzDecisionStatement
 	AttributeStatements []AttributeStatement `xml:"AttributeStatement"`
+
+	// ResponseConsent is the Consent attribute of the Response that carried
+	// the assertion, as returned by ServiceProvider.ParseResponse. It is not
+	// part of the assertion itself, and so is only covered by a signature
+	// if the Response is signed.
+	ResponseConsent string `xml:"-"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -465,6 +471,9 @@ func (a *Assertion) Element() *etree.Element {
 	if a.Conditions != nil {
 		el.AddChild(a.Conditions.Element())
 	}
+	if a.Advice != nil {
+		el.AddChild(a.Advice.Element())
+	}
 	for _, authnStatement := range a.AuthnStatements {
 		el.AddChild(authnStatement.Element())
 	}
@@ -494,6 +503,37 @@ func (a *Assertion) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	return nil
 }
 
+// Advice represents the SAML element Advice. It carries additional information
+// from the issuer, typically the assertions of upstream IDPs when the issuer is
+// acting as a proxy.
+//
+// Advice is informational only. The signature on the enclosing assertion covers
+// the Advice, but the signatures and conditions of the assertions it contains
+// are not validated, so they must not be used to authenticate anyone.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.6.1
+type Advice struct {
+	XMLName          xml.Name    `xml:"urn:oasis:names:tc:SAML:2.0:assertion Advice"`
+	AssertionIDRefs  []string    `xml:"urn:oasis:names:tc:SAML:2.0:assertion AssertionIDRef"`
+	AssertionURIRefs []string    `xml:"urn:oasis:names:tc:SAML:2.0:assertion AssertionURIRef"`
+	Assertions       []Assertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *Advice) Element() *etree.Element {
+	el := etree.NewElement("saml:Advice")
+	for _, assertionIDRef := range a.AssertionIDRefs {
+		el.CreateElement("saml:AssertionIDRef").SetText(assertionIDRef)
+	}
+	for _, assertionURIRef := range a.AssertionURIRefs {
+		el.CreateElement("saml:AssertionURIRef").SetText(assertionURIRef)
+	}
+	for _, assertion := range a.Assertions {
+		el.AddChild(assertion.Element())
+	}
+	return el
+}
+
 // Subject represents the SAML element Subject.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.4.1
@@ -622,6 +662,7 @@ func (s *SubjectConfirmationData) MarshalXML(e *xml.Encoder, start xml.StartElem
 func (s *SubjectConfirmationData) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias SubjectConfirmationData
 	aux := &struct {
+		NotBefore    RelaxedTime `xml:",attr"`
 		NotOnOrAfter RelaxedTime `xml:",attr"`
 		*Alias
 	}{
@@ -630,6 +671,7 @@ func (s *SubjectConfirmationData) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 	if err := d.DecodeElement(&aux, &start); err != nil {
 		return err
 	}
+	s.NotBefore = time.Time(aux.NotBefore)
 	s.NotOnOrAfter = time.Time(aux.NotOnOrAfter)
 	return nil
 }
@@ -740,9 +782,20 @@ func (a *OneTimeUse) Element() *etree.Element {
 // ProxyRestriction represents the SAML element ProxyRestriction.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.5.1.6
+//
+// An assertion with a ProxyRestriction limits the assertions that a proxy,
+// a relying party that acts as an IDP in turn, may issue on the basis of
+// it. A service provider that does not issue assertions can ignore it. See
+// ReissueProxyRestriction.
 type ProxyRestriction struct {
-	Count     *int
-	Audiences []Audience
+	// Count, if set, is the number of further proxies through which
+	// assertions may be issued. If it is zero, no assertion may be issued
+	// on the basis of the assertion.
+	Count *int `xml:",attr"`
+
+	// Audiences, if not empty, are the only relying parties to which
+	// assertions may be issued on the basis of the assertion.
+	Audiences []Audience `xml:"Audience"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -799,7 +852,8 @@ func (a *AuthnStatement) MarshalXML(e *xml.Encoder, start xml.StartElement) erro
 func (a *AuthnStatement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias AuthnStatement
 	aux := &struct {
-		AuthnInstant RelaxedTime `xml:",attr"`
+		AuthnInstant        RelaxedTime  `xml:",attr"`
+		SessionNotOnOrAfter *RelaxedTime `xml:",attr"`
 		*Alias
 	}{
 		Alias: (*Alias)(a),
@@ -808,6 +862,11 @@ func (a *AuthnStatement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) er
 		return err
 	}
 	a.AuthnInstant = time.Time(aux.AuthnInstant)
+	a.SessionNotOnOrAfter = nil
+	if aux.SessionNotOnOrAfter != nil {
+		t := time.Time(*aux.SessionNotOnOrAfter)
+		a.SessionNotOnOrAfter = &t
+	}
 	return nil
 }
 
@@ -838,7 +897,7 @@ type AuthnContext struct {
 	AuthnContextClassRef *AuthnContextClassRef
 	//AuthnContextDecl          *AuthnContextDecl        ... TODO
 	//AuthnContextDeclRef       *AuthnContextDeclRef     ... TODO
-	//AuthenticatingAuthorities []AuthenticatingAuthority... TODO
+	AuthenticatingAuthorities []AuthenticatingAuthority `xml:"AuthenticatingAuthority"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -847,6 +906,25 @@ func (a *AuthnContext) Element() *etree.Element {
 	if a.AuthnContextClassRef != nil {
 		el.AddChild(a.AuthnContextClassRef.Element())
 	}
+	for _, authenticatingAuthority := range a.AuthenticatingAuthorities {
+		el.AddChild(authenticatingAuthority.Element())
+	}
+	return el
+}
+
+// AuthenticatingAuthority represents the SAML element AuthenticatingAuthority.
+// It identifies an authority, other than the issuer, that took part in
+// authenticating the subject, such as an upstream IDP in a proxied login.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.2.2
+type AuthenticatingAuthority struct {
+	Value string `xml:",chardata"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *AuthenticatingAuthority) Element() *etree.Element {
+	el := etree.NewElement("saml:AuthenticatingAuthority")
+	el.SetText(a.Value)
 	return el
 }
 
@@ -884,9 +962,9 @@ func (a *AttributeStatement) Element() *etree.Element {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.3.1
 type Attribute struct {
-	FriendlyName string           `xml:",attr"`
+	FriendlyName string           `xml:",attr,omitempty"`
 	Name         string           `xml:",attr"`
-	NameFormat   string           `xml:",attr"`
+	NameFormat   string           `xml:",attr,omitempty"`
 	Values       []AttributeValue `xml:"AttributeValue"`
 }
 
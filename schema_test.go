@@ -34,3 +34,118 @@ func (test *SchemaTest) TestAttributeXMLRoundTrip(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(actual, DeepEquals, expected)
 }
+
+func (test *SchemaTest) TestAssertionAdviceXMLRoundTrip(c *C) {
+	input := `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" Version="2.0" ID="outer" IssueInstant="2015-12-01T01:57:09Z">` +
+		`<saml:Issuer>https://proxy.example.com/</saml:Issuer>` +
+		`<saml:Advice>` +
+		`<saml:AssertionIDRef>ref</saml:AssertionIDRef>` +
+		`<saml:Assertion Version="2.0" ID="inner" IssueInstant="2015-12-01T01:57:08Z">` +
+		`<saml:Issuer>https://upstream.example.com/</saml:Issuer>` +
+		`<saml:AttributeStatement><saml:Attribute Name="uid"><saml:AttributeValue>alice</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>` +
+		`</saml:Assertion>` +
+		`</saml:Advice>` +
+		`</saml:Assertion>`
+
+	var assertion Assertion
+	err := xml.Unmarshal([]byte(input), &assertion)
+	c.Assert(err, IsNil)
+	c.Assert(assertion.Advice, NotNil)
+	c.Assert(assertion.Advice.AssertionIDRefs, DeepEquals, []string{"ref"})
+	c.Assert(assertion.Advice.Assertions, HasLen, 1)
+	c.Assert(assertion.Advice.Assertions[0].Issuer.Value, Equals, "https://upstream.example.com/")
+	c.Assert(assertion.Advice.Assertions[0].AttributeStatements[0].Attributes[0].Values[0].Value, Equals, "alice")
+
+	doc := etree.NewDocument()
+	doc.SetRoot(assertion.Element())
+	x, err := doc.WriteToBytes()
+	c.Assert(err, IsNil)
+
+	var actual Assertion
+	err = xml.Unmarshal(x, &actual)
+	c.Assert(err, IsNil)
+	c.Assert(actual.Advice, DeepEquals, assertion.Advice)
+}
+
+func (test *SchemaTest) TestAuthenticatingAuthorities(c *C) {
+	for _, authorities := range [][]string{nil, {"https://a.example.com/"}, {"https://a.example.com/", "https://b.example.com/"}} {
+		input := `<saml:AuthnContext xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` +
+			`<saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:Password</saml:AuthnContextClassRef>`
+		for _, authority := range authorities {
+			input += `<saml:AuthenticatingAuthority>` + authority + `</saml:AuthenticatingAuthority>`
+		}
+		input += `</saml:AuthnContext>`
+
+		var authnContext AuthnContext
+		err := xml.Unmarshal([]byte(input), &authnContext)
+		c.Assert(err, IsNil)
+		c.Assert(authnContext.AuthenticatingAuthorities, HasLen, len(authorities))
+		for i, authority := range authorities {
+			c.Assert(authnContext.AuthenticatingAuthorities[i].Value, Equals, authority)
+		}
+
+		doc := etree.NewDocument()
+		doc.SetRoot(authnContext.Element())
+		x, err := doc.WriteToBytes()
+		c.Assert(err, IsNil)
+		var actual AuthnContext
+		err = xml.Unmarshal(x, &actual)
+		c.Assert(err, IsNil)
+		c.Assert(actual, DeepEquals, authnContext)
+	}
+}
+
+func (test *SchemaTest) TestProxyRestriction(c *C) {
+	input := `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" Version="2.0" ID="id" IssueInstant="2015-12-01T01:57:09Z">` +
+		`<saml:Issuer>https://idp.example.com/</saml:Issuer>` +
+		`<saml:Conditions NotBefore="2015-12-01T01:57:09Z" NotOnOrAfter="2015-12-01T02:57:09Z">` +
+		`<saml:ProxyRestriction Count="2">` +
+		`<saml:Audience>https://proxy.example.com/</saml:Audience>` +
+		`<saml:Audience>https://sp.example.com/</saml:Audience>` +
+		`</saml:ProxyRestriction>` +
+		`</saml:Conditions>` +
+		`</saml:Assertion>`
+
+	var assertion Assertion
+	err := xml.Unmarshal([]byte(input), &assertion)
+	c.Assert(err, IsNil)
+	restriction := assertion.Conditions.ProxyRestriction
+	c.Assert(restriction, NotNil)
+	c.Assert(*restriction.Count, Equals, 2)
+	c.Assert(restriction.Audiences, DeepEquals, []Audience{
+		{Value: "https://proxy.example.com/"},
+		{Value: "https://sp.example.com/"},
+	})
+
+	doc := etree.NewDocument()
+	doc.SetRoot(assertion.Element())
+	x, err := doc.WriteToBytes()
+	c.Assert(err, IsNil)
+	var actual Assertion
+	err = xml.Unmarshal(x, &actual)
+	c.Assert(err, IsNil)
+	c.Assert(actual.Conditions.ProxyRestriction, DeepEquals, restriction)
+
+	// a proxy passes on the audiences and one less than the count,
+	reissued, err := ReissueProxyRestriction(&assertion, "https://sp.example.com/")
+	c.Assert(err, IsNil)
+	c.Assert(*reissued.Count, Equals, 1)
+	c.Assert(reissued.Audiences, DeepEquals, restriction.Audiences)
+	c.Assert(*restriction.Count, Equals, 2)
+
+	// may not issue assertions to other audiences,
+	_, err = ReissueProxyRestriction(&assertion, "https://other.example.com/")
+	c.Assert(err, ErrorMatches, `ProxyRestriction does not allow issuing assertions to "https://other.example.com/"`)
+
+	// nor any once the count is exhausted,
+	zero := 0
+	restriction.Count = &zero
+	_, err = ReissueProxyRestriction(&assertion, "https://sp.example.com/")
+	c.Assert(err, Equals, ErrProxyCountExhausted)
+
+	// and is not restricted by an assertion without a ProxyRestriction.
+	assertion.Conditions.ProxyRestriction = nil
+	reissued, err = ReissueProxyRestriction(&assertion, "https://other.example.com/")
+	c.Assert(err, IsNil)
+	c.Assert(reissued, IsNil)
+}
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree"
@@ -37,6 +42,7 @@ const (
 	TransientNameIDFormat    NameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
 	EmailAddressNameIDFormat NameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:emailAddress"
 	PersistentNameIDFormat   NameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	EntityNameIDFormat       NameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
 )
 
 // ServiceProvider implements SAML Service provider.
@@ -55,6 +61,29 @@ type ServiceProvider struct {
 	// Certificate is the RSA public part of Key.
 	Certificate *x509.Certificate
 
+	// EncryptionKey is the RSA private key we use to decrypt assertions. If
+	// nil, Key is used.
+	EncryptionKey *rsa.PrivateKey
+
+	// EncryptionCertificate is the RSA public part of EncryptionKey, which
+	// the metadata advertises for encrypting assertions. If nil, Certificate
+	// is used.
+	EncryptionCertificate *x509.Certificate
+
+	// KeyTransportAlgorithms lists the algorithms with which the IDP may
+	// encrypt the keys of encrypted assertions, such as RSA-OAEP-MGF1P or
+	// RSA-1.5. They are advertised in the metadata, and ParseResponse rejects
+	// assertions encrypted with any other. If empty,
+	// DefaultKeyTransportAlgorithms is used.
+	KeyTransportAlgorithms []string
+
+	// DataEncryptionAlgorithms lists the algorithms with which the IDP may
+	// encrypt assertions, such as AES-128-CBC or AES-256-GCM. They are
+	// advertised in the metadata, and ParseResponse rejects assertions
+	// encrypted with any other. If empty, DefaultDataEncryptionAlgorithms is
+	// used.
+	DataEncryptionAlgorithms []string
+
 	// MetadataURL is the full URL to the metadata endpoint on this host,
 	// i.e. https://example.com/saml/metadata
 	MetadataURL url.URL
@@ -63,26 +92,333 @@ type ServiceProvider struct {
 	// on this host, i.e. https://example.com/saml/acs
 	AcsURL url.URL
 
+	// AllowedACSURLs lists other URLs of the ACS that ParseResponse accepts
+	// as the Destination of a Response and the Recipient of an assertion,
+	// for example the public URL of an SP behind a proxy or load balancer
+	// whose AcsURL is an internal one. AcsURL is always accepted.
+	AllowedACSURLs []url.URL
+
 	// IDPMetadata is the metadata from the identity provider.
 	IDPMetadata *EntityDescriptor
 
-	// IDPMetadata is the metadata from the identity provider.
+	// IDPMetadatas holds the metadata of identity providers, by entity ID.
 	IDPMetadatas map[string]EntityDescriptor
 
 	// AuthnNameIDFormat is the format used in the NameIDPolicy for
 	// authentication requests
 	AuthnNameIDFormat NameIDFormat
 
+	// NameIDFormats lists, in order of preference, the NameID formats that
+	// the metadata declares we accept. If empty, DefaultNameIDFormats is
+	// used.
+	NameIDFormats []NameIDFormat
+
+	// MetadataExtensions, if set, are the Extensions of the metadata, such
+	// as the registration information and entity categories that
+	// federations require.
+	MetadataExtensions *EntityExtensions
+
+	// UIInfo, if set, describes the service provider to users, for example
+	// with its name and logo on the consent screen of the IDP. It is
+	// included in the Extensions of the SPSSODescriptor of the metadata.
+	UIInfo *UIInfo
+
+	// AttributeConsumingServices, if set, declare in the metadata the
+	// attributes that the service provider requests from the IDP, and
+	// whether each is required. The NameFormat of a RequestedAttribute
+	// that does not specify one is URIAttributeNameFormat, since IDPs such
+	// as Shibboleth map a requested attribute only if its Name and
+	// NameFormat match those of an attribute they release.
+	AttributeConsumingServices []AttributeConsumingService
+
 	// MetadataValidDuration is a duration used to calculate validUntil
 	// attribute in the metadata endpoint
 	MetadataValidDuration time.Duration
 
+	// MetadataValidUntil, if not zero, is the validUntil attribute of the
+	// metadata in place of the time MetadataValidDuration from now. Setting
+	// it makes the metadata the same each time it is generated from the
+	// same configuration. See MetadataXML.
+	MetadataValidUntil time.Time
+
 	// Logger is used to log messages for example in the event of errors
 	Logger logger.Interface
 
+	// LogAuthnRequests causes each AuthnRequest that is made, whatever the
+	// binding it is sent with, to be logged to Logger as XML with the prefix
+	// "DEBUG:", so that what was sent can be compared with what an IDP
+	// rejects. The requests contain the user's login hint, if
+	// AuthnRequestSubject is set, so it is meant for diagnosis rather than
+	// for normal operation.
+	LogAuthnRequests bool
+
 	// ForceAuthn allows you to force re-authentication of users even if the user
 	// has a SSO session at the IdP.
 	ForceAuthn *bool
+
+	// IsPassive asks the IdP to authenticate the user without interacting
+	// with them. If the IdP cannot, ParseResponse fails with ErrNoPassive.
+	IsPassive *bool
+
+	// PreviousIDPCertificates lists signing certificates of the IDP that are
+	// no longer in IDPMetadata, but that ParseResponse still accepts for a
+	// while after the IDP rolls over its key, so that responses that were
+	// signed with the previous key just before the rollover are not
+	// rejected. The certificate in IDPMetadata is always tried first.
+	PreviousIDPCertificates []PreviousIDPCertificate
+
+	// AuthnRequestSubject, if set, is sent as the NameID of the Subject of
+	// authentication requests, naming the user that is expected to sign in.
+	// Most IDPs ignore it, but ADFS and a few others use it as a login hint,
+	// for example to prefill the user name. Since it names a particular
+	// user, it is usually set on a copy of the ServiceProvider that is used
+	// for a single request. If nil, the Subject is omitted.
+	AuthnRequestSubject *NameID
+
+	// AuthnRequestConsent, if set, is the Consent attribute of
+	// authentication requests, such as
+	// "urn:oasis:names:tc:SAML:2.0:consent:obtained", which indicates that
+	// the user has consented to the request. Any URI is sent verbatim. If
+	// empty, the attribute is omitted.
+	AuthnRequestConsent string
+
+	// RedirectCompressionLevel is the DEFLATE compression level, as defined
+	// by compress/flate, of the messages that are sent with the
+	// HTTP-Redirect binding. If nil, flate.BestCompression is used, which
+	// keeps the URLs of large requests within the length that IDPs and
+	// proxies accept. flate.DefaultCompression or flate.BestSpeed are
+	// faster.
+	RedirectCompressionLevel *int
+
+	// SignRequest causes authentication requests to be signed using Key,
+	// and the metadata to specify AuthnRequestsSigned="true".
+	// Requests are always signed when the IDP metadata specifies
+	// WantAuthnRequestsSigned="true", regardless of this setting. Requests
+	// sent with the HTTP-Redirect binding are signed as SignRedirectQuery
+	// describes, and others with an enveloped signature.
+	SignRequest bool
+
+	// SignatureMethod is the URI of the algorithm with which requests are
+	// signed, such as dsig.RSASHA512SignatureMethod. If empty,
+	// dsig.RSASHA256SignatureMethod is used.
+	SignatureMethod string
+
+	// UseACSIndex lists, by entity ID, the IDPs to which authentication
+	// requests refer to our assertion consumer service by its index in our
+	// metadata, rather than specifying AssertionConsumerServiceURL and
+	// ProtocolBinding. Some IDPs, such as certain ADFS configurations,
+	// reject requests that specify both. It is keyed by entity ID because
+	// IDPMetadata, the IDP that requests are sent to, may be replaced by
+	// the metadata of another IDP, for example by samlsp.
+	UseACSIndex map[string]bool
+
+	// AllowedSignatureMethods, if not empty, lists the signature algorithms
+	// that ParseResponse accepts on the Response and Assertion. For example,
+	// set it to StrongSignatureMethods to reject RSA-SHA1 signatures.
+	AllowedSignatureMethods []string
+
+	// AllowedDigestMethods, if not empty, lists the digest algorithms that
+	// ParseResponse accepts in the references of signatures. For example,
+	// set it to StrongDigestMethods to reject SHA-1 digests.
+	AllowedDigestMethods []string
+
+	// IDGenerator, if set, returns the IDs of authentication requests, for
+	// example to satisfy an IDP that requires IDs to start with "_". The IDs
+	// must be valid XML NCNames, that is, start with a letter or "_" and
+	// contain only letters, digits, ".", "-" and "_". They must also be
+	// unique and unpredictable. If nil, NewID is used.
+	IDGenerator func() string
+
+	// IDPrefix, if set, replaces the "id-" prefix of the IDs that NewID
+	// returns, for IDPs that only accept IDs of a certain form, such as
+	// "_" followed by hex digits. The IDs must still be valid XML NCNames,
+	// so the prefix must start with a letter or "_". It is ignored if
+	// IDGenerator is set.
+	IDPrefix string
+
+	// Clock, if set, determines the IssueInstant of authentication requests.
+	// If nil, TimeNow is used.
+	Clock *dsig.Clock
+
+	// AllowedAudiences lists the audiences that ParseResponse accepts in the
+	// AudienceRestriction of an assertion, for example both our previous and
+	// our current entity ID while the IDP is being migrated from one to the
+	// other. If empty, only our entity ID, MetadataURL, is accepted. If set,
+	// it should usually include MetadataURL.
+	AllowedAudiences []string
+
+	// MultipleAssertions determines how ParseResponse treats responses that
+	// contain more than one assertion. By default they are rejected.
+	MultipleAssertions MultipleAssertionsPolicy
+
+	// NameIDFormatPolicy determines whether ParseResponse checks the Format
+	// of the NameID in the assertion against AuthnNameIDFormat. By default
+	// it is not checked.
+	NameIDFormatPolicy NameIDFormatPolicy
+
+	// SubjectConfirmationNotBefore determines how ParseResponse treats a
+	// bearer SubjectConfirmationData with a NotBefore attribute, which the
+	// Web Browser SSO profile forbids. By default the assertion is accepted
+	// with a WarningSubjectConfirmationNotBefore.
+	SubjectConfirmationNotBefore SubjectConfirmationNotBeforePolicy
+
+	// ValidateIssuerFormat causes ParseResponse to reject a Response or
+	// Assertion whose Issuer has a Format other than EntityNameIDFormat. The
+	// Issuer must always be exactly the EntityID of IDPMetadata, whose
+	// certificate is the one used to verify the signature.
+	ValidateIssuerFormat bool
+
+	// RequireAssertionIssuer causes ParseResponse to reject assertions that
+	// do not have an Issuer of their own. By default the Issuer of the
+	// Response is used for such assertions. See ParseResponse.
+	RequireAssertionIssuer bool
+
+	// RejectXMLComments causes ParseResponse to reject responses that
+	// contain XML comments. Otherwise comments are removed before the
+	// signatures are checked, as the canonicalization algorithms require,
+	// and are ignored when the text of elements such as the NameID is read.
+	// A comment therefore cannot change the value that was signed.
+	RejectXMLComments bool
+
+	// RequireUTCTimestamps causes ParseResponse to reject responses with an
+	// IssueInstant, NotBefore, NotOnOrAfter, AuthnInstant or
+	// SessionNotOnOrAfter that is not an xs:dateTime in UTC, such as
+	// "2015-12-01T01:57:09Z". By default timestamps with a time zone offset
+	// or without a time zone, as ADFS sends, are accepted, and those without
+	// a time zone are interpreted as UTC. See TimestampError.
+	RequireUTCTimestamps bool
+
+	// AllowMissingAuthnStatement causes ParseResponse to accept assertions
+	// without an AuthnStatement. By default they are rejected with
+	// ErrNoAuthnStatement, because an assertion that carries only attributes
+	// does not record that the user authenticated, and so cannot be used to
+	// log them in. It should only be set for uses other than login.
+	AllowMissingAuthnStatement bool
+
+	// AuthnContextLevels maps the AuthnContextClassRefs with which the IDP
+	// may authenticate users to assurance levels, such as 1, 2 and 3 for
+	// AL1, AL2 and AL3, where a higher level is a stronger authentication.
+	// Class refs that are not listed have level 0. See AuthnContextLevel.
+	AuthnContextLevels map[string]int
+
+	// MinAuthnContextLevel, if positive, causes ParseResponse to reject
+	// assertions whose AuthnContextLevel is lower with an
+	// AuthnContextLevelError. Assertions whose class refs are not in
+	// AuthnContextLevels are therefore rejected.
+	MinAuthnContextLevel int
+
+	// AllowMissingConditions causes ParseResponse to accept assertions
+	// without a Conditions element. By default they are rejected with
+	// ErrNoConditions, because such an assertion has neither a validity
+	// period nor an AudienceRestriction, so it could have been issued to
+	// any service provider. If it is set, the audience is not checked for
+	// such assertions, which are limited only by the expiry of the
+	// SubjectConfirmationData and by MaxIssueDelay. It should only be set
+	// for IDPs that are known to omit the Conditions.
+	AllowMissingConditions bool
+
+	// ValidateSubjectAddress causes ParseResponse to reject assertions whose
+	// SubjectConfirmationData has an Address other than the IP address of
+	// the client that posted the response. An Address that is not present
+	// is not checked. It is off by default because many IDPs omit the
+	// Address, and because the IDP and the SP can see the client at
+	// different addresses, for example behind NAT or a VPN.
+	ValidateSubjectAddress bool
+
+	// ClientIPHeader is the header of the request that holds the IP address
+	// of the client for ValidateSubjectAddress, such as "X-Forwarded-For"
+	// when the SP is behind a reverse proxy. The first address in the
+	// header is used. If empty, the address of RemoteAddr is used.
+	//
+	// The header must only be set if every request passes through a proxy
+	// that overwrites it, since clients can otherwise send any address
+	// they like and so defeat the check.
+	ClientIPHeader string
+
+	// ForwardedProtoHeader is the header of the request that holds the
+	// scheme, "https" or "http", of the connection between the client and a
+	// reverse proxy in front of the SP, such as "X-Forwarded-Proto". If it
+	// is set, a Response whose Destination, or an assertion whose
+	// Recipient, is AcsURL or one of AllowedACSURLs with its scheme replaced
+	// by that of the header is accepted, and RequestScheme uses the header.
+	// If empty, the scheme is determined by the request itself, and the
+	// Destination and Recipient must match exactly.
+	//
+	// As with ClientIPHeader, the header must only be set if every request
+	// passes through a proxy that overwrites it, since clients can
+	// otherwise send any scheme they like.
+	ForwardedProtoHeader string
+
+	// ECP causes the metadata to advertise AcsURL with the PAOS binding as
+	// well, as IDPs require of service providers that support Enhanced
+	// Clients or Proxies. See MakeECPAuthenticationRequest.
+	ECP bool
+
+	// ObserveParseStage, if set, is called as ParseResponse returns, once
+	// for each stage of the validation of the response that was reached,
+	// with the time spent in it. It can be used to record whether decoding,
+	// decryption or signature verification dominates the latency of the
+	// ACS. It is called for rejected responses as well.
+	ObserveParseStage func(stage ParseStage, duration time.Duration)
+
+	// ReplayStore, if set, records the IDs of the assertions that
+	// ParseResponse accepts, once they have passed every other check, and
+	// ParseResponse rejects assertions that it has seen before with
+	// ErrReplay.
+	ReplayStore ReplayStore
+
+	// ReplayStoreFailMode determines whether ParseResponse rejects or
+	// accepts assertions when ReplayStore fails. By default they are
+	// rejected.
+	ReplayStoreFailMode ReplayStoreFailMode
+
+	// Validators are called in order with the assertion once ParseResponse
+	// has validated it, to apply policies of the application, such as
+	// requiring an attribute. If one returns an error, the assertion is
+	// rejected with it as the PrivateErr of an InvalidResponseError, and
+	// the remaining validators are not called.
+	Validators []func(assertion *Assertion) error
+
+	// Transformers are called in order with the assertion after the
+	// Validators accept it, and before ParseResponse returns it, so that
+	// they can modify it, for example to normalize the values of its
+	// attributes before a session is created from them.
+	Transformers []func(assertion *Assertion)
+}
+
+// nameIDFormats returns the NameID formats that our metadata declares.
+func (sp *ServiceProvider) nameIDFormats() []NameIDFormat {
+	if len(sp.NameIDFormats) == 0 {
+		return DefaultNameIDFormats
+	}
+	return sp.NameIDFormats
+}
+
+// acsIndex is the index of the assertion consumer service in our metadata.
+const acsIndex = 1
+
+// ecpACSIndex is the index of the assertion consumer service with the PAOS
+// binding in our metadata, if sp.ECP is set.
+const ecpACSIndex = 2
+
+// assertionConsumerServices returns the assertion consumer services that
+// our metadata advertises.
+func (sp *ServiceProvider) assertionConsumerServices() []IndexedEndpoint {
+	assertionConsumerServices := []IndexedEndpoint{
+		IndexedEndpoint{
+			Binding:  HTTPPostBinding,
+			Location: sp.AcsURL.String(),
+			Index:    acsIndex,
+		},
+	}
+	if sp.ECP {
+		assertionConsumerServices = append(assertionConsumerServices, IndexedEndpoint{
+			Binding:  PAOSBinding,
+			Location: sp.AcsURL.String(),
+			Index:    ecpACSIndex,
+		})
+	}
+	return assertionConsumerServices
 }
 
 // MaxIssueDelay is the longest allowed time between when a SAML assertion is
@@ -101,6 +437,49 @@ const DefaultValidDuration = time.Hour * 24 * 2
 // DefaultCacheDuration is how long we ask the IDP to cache the SP metadata.
 const DefaultCacheDuration = time.Hour * 24 * 1
 
+// encryptionKey returns the key used to decrypt assertions.
+func (sp *ServiceProvider) encryptionKey() *rsa.PrivateKey {
+	if sp.EncryptionKey != nil {
+		return sp.EncryptionKey
+	}
+	return sp.Key
+}
+
+// DefaultNameIDFormats are the NameID formats that are declared in the
+// metadata if ServiceProvider.NameIDFormats is empty.
+var DefaultNameIDFormats = []NameIDFormat{
+	TransientNameIDFormat,
+	EmailAddressNameIDFormat,
+}
+
+// DefaultKeyTransportAlgorithms are the key transport algorithms that are
+// used if ServiceProvider.KeyTransportAlgorithms is empty.
+var DefaultKeyTransportAlgorithms = []string{
+	"http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p",
+}
+
+// DefaultDataEncryptionAlgorithms are the data encryption algorithms that
+// are used if ServiceProvider.DataEncryptionAlgorithms is empty.
+var DefaultDataEncryptionAlgorithms = []string{
+	"http://www.w3.org/2001/04/xmlenc#aes128-cbc",
+	"http://www.w3.org/2001/04/xmlenc#aes192-cbc",
+	"http://www.w3.org/2001/04/xmlenc#aes256-cbc",
+}
+
+func (sp *ServiceProvider) keyTransportAlgorithms() []string {
+	if len(sp.KeyTransportAlgorithms) == 0 {
+		return DefaultKeyTransportAlgorithms
+	}
+	return sp.KeyTransportAlgorithms
+}
+
+func (sp *ServiceProvider) dataEncryptionAlgorithms() []string {
+	if len(sp.DataEncryptionAlgorithms) == 0 {
+		return DefaultDataEncryptionAlgorithms
+	}
+	return sp.DataEncryptionAlgorithms
+}
+
 // Metadata returns the service provider metadata
 func (sp *ServiceProvider) Metadata() *EntityDescriptor {
 	validDuration := DefaultValidDuration
@@ -108,17 +487,46 @@ func (sp *ServiceProvider) Metadata() *EntityDescriptor {
 		validDuration = sp.MetadataValidDuration
 	}
 
-	authnRequestsSigned := false
+	validUntil := TimeNow().Add(validDuration)
+	if !sp.MetadataValidUntil.IsZero() {
+		validUntil = sp.MetadataValidUntil
+	}
+
+	encryptionCertificate := sp.Certificate
+	if sp.EncryptionCertificate != nil {
+		encryptionCertificate = sp.EncryptionCertificate
+	}
+
+	nameIDFormats := sp.nameIDFormats()
+
+	var encryptionMethods []EncryptionMethod
+	for _, algorithm := range sp.dataEncryptionAlgorithms() {
+		encryptionMethods = append(encryptionMethods, EncryptionMethod{Algorithm: algorithm})
+	}
+	for _, algorithm := range sp.keyTransportAlgorithms() {
+		encryptionMethods = append(encryptionMethods, EncryptionMethod{Algorithm: algorithm})
+	}
+
+	assertionConsumerServices := sp.assertionConsumerServices()
+
+	var extensions *RoleExtensions
+	if sp.UIInfo != nil {
+		extensions = &RoleExtensions{UIInfo: sp.UIInfo}
+	}
+
+	authnRequestsSigned := sp.SignRequest
 	wantAssertionsSigned := true
 	return &EntityDescriptor{
 		EntityID:   sp.MetadataURL.String(),
-		ValidUntil: TimeNow().Add(validDuration),
+		ValidUntil: validUntil,
+		Extensions: sp.MetadataExtensions,
 
 		SPSSODescriptors: []SPSSODescriptor{
 			SPSSODescriptor{
 				SSODescriptor: SSODescriptor{
 					RoleDescriptor: RoleDescriptor{
 						ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+						Extensions:                 extensions,
 						KeyDescriptors: []KeyDescriptor{
 							{
 								Use: "signing",
@@ -129,53 +537,401 @@ func (sp *ServiceProvider) Metadata() *EntityDescriptor {
 							{
 								Use: "encryption",
 								KeyInfo: KeyInfo{
-									Certificate: base64.StdEncoding.EncodeToString(sp.Certificate.Raw),
-								},
-								EncryptionMethods: []EncryptionMethod{
-									{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
-									{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
-									{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
-									{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
+									Certificate: base64.StdEncoding.EncodeToString(encryptionCertificate.Raw),
 								},
+								EncryptionMethods: encryptionMethods,
 							},
 						},
 					},
+					NameIDFormats: nameIDFormats,
 				},
 				AuthnRequestsSigned:  &authnRequestsSigned,
 				WantAssertionsSigned: &wantAssertionsSigned,
 
-				AssertionConsumerServices: []IndexedEndpoint{
-					IndexedEndpoint{
-						Binding:  HTTPPostBinding,
-						Location: sp.AcsURL.String(),
-						Index:    1,
-					},
-				},
+				AssertionConsumerServices:  assertionConsumerServices,
+				AttributeConsumingServices: sp.attributeConsumingServices(),
 			},
 		},
 	}
 }
 
+// attributeConsumingServices returns a copy of sp.AttributeConsumingServices
+// in which each RequestedAttribute has a NameFormat.
+func (sp *ServiceProvider) attributeConsumingServices() []AttributeConsumingService {
+	var rv []AttributeConsumingService
+	for _, attributeConsumingService := range sp.AttributeConsumingServices {
+		requestedAttributes := make([]RequestedAttribute, len(attributeConsumingService.RequestedAttributes))
+		copy(requestedAttributes, attributeConsumingService.RequestedAttributes)
+		for i := range requestedAttributes {
+			if requestedAttributes[i].NameFormat == "" {
+				requestedAttributes[i].NameFormat = URIAttributeNameFormat
+			}
+		}
+		attributeConsumingService.RequestedAttributes = requestedAttributes
+		rv = append(rv, attributeConsumingService)
+	}
+	return rv
+}
+
+// MetadataXML returns the metadata returned by Metadata as canonical XML,
+// for example to be committed to a repository of configuration. The
+// attributes of each element are sorted, namespace declarations first, and
+// the elements are indented by two spaces, so that metadata generated from
+// the same configuration is byte for byte identical. Since the validUntil
+// attribute otherwise depends on the current time, MetadataValidUntil
+// should be set as well.
+func (sp *ServiceProvider) MetadataXML() ([]byte, error) {
+	buf, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil, err
+	}
+	sortAttrs(doc.Root())
+	doc.Indent(2)
+	return doc.WriteToBytes()
+}
+
+// sortAttrs sorts the attributes of el and its descendants in canonical
+// order.
+func sortAttrs(el *etree.Element) {
+	sort.Sort(canonicalAttrs(el.Attr))
+	for _, child := range el.ChildElements() {
+		sortAttrs(child)
+	}
+}
+
+// canonicalAttrs sorts attributes with the namespace declarations first,
+// the default one before those with a prefix, followed by the other
+// attributes ordered by prefix and name.
+type canonicalAttrs []etree.Attr
+
+func (a canonicalAttrs) Len() int      { return len(a) }
+func (a canonicalAttrs) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a canonicalAttrs) Less(i, j int) bool {
+	iDecl := a[i].Space == "xmlns" || (a[i].Space == "" && a[i].Key == "xmlns")
+	jDecl := a[j].Space == "xmlns" || (a[j].Space == "" && a[j].Key == "xmlns")
+	if iDecl != jDecl {
+		return iDecl
+	}
+	if iDecl {
+		// the default namespace declaration has no prefix and sorts first
+		return a[i].Space < a[j].Space || (a[i].Space == a[j].Space && a[i].Key < a[j].Key)
+	}
+	if a[i].Space != a[j].Space {
+		return a[i].Space < a[j].Space
+	}
+	return a[i].Key < a[j].Key
+}
+
+// ValidateMetadata checks that the metadata returned by Metadata is
+// structurally valid, so that common mistakes that would cause an IDP to
+// reject it, such as a missing certificate or an empty ACS URL, can be
+// caught before the metadata is published. It does not perform full XML
+// schema validation.
+func (sp *ServiceProvider) ValidateMetadata() error {
+	if sp.Certificate == nil {
+		return errors.New("metadata: Certificate must be specified")
+	}
+
+	buf, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		return fmt.Errorf("metadata: cannot marshal: %s", err)
+	}
+	metadata := EntityDescriptor{}
+	if err := xml.Unmarshal(buf, &metadata); err != nil {
+		return fmt.Errorf("metadata: cannot unmarshal: %s", err)
+	}
+
+	if metadata.EntityID == "" {
+		return errors.New("metadata: entityID must not be empty")
+	}
+	if extensions := metadata.Extensions; extensions != nil {
+		if extensions.RegistrationInfo != nil && extensions.RegistrationInfo.RegistrationAuthority == "" {
+			return errors.New("metadata: RegistrationInfo registrationAuthority must not be empty")
+		}
+		if extensions.EntityAttributes != nil {
+			for _, attribute := range extensions.EntityAttributes.Attributes {
+				if attribute.Name == "" {
+					return errors.New("metadata: EntityAttributes Attribute Name must not be empty")
+				}
+			}
+		}
+	}
+	if len(metadata.SPSSODescriptors) == 0 {
+		return errors.New("metadata: SPSSODescriptor is missing")
+	}
+	for _, spSSODescriptor := range metadata.SPSSODescriptors {
+		if !strings.Contains(spSSODescriptor.ProtocolSupportEnumeration, "urn:oasis:names:tc:SAML:2.0:protocol") {
+			return fmt.Errorf("metadata: protocolSupportEnumeration %q does not include SAML 2.0",
+				spSSODescriptor.ProtocolSupportEnumeration)
+		}
+
+		if len(spSSODescriptor.KeyDescriptors) == 0 {
+			return errors.New("metadata: KeyDescriptor is missing")
+		}
+		for _, keyDescriptor := range spSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" && keyDescriptor.Use != "encryption" {
+				return fmt.Errorf("metadata: KeyDescriptor use %q is not valid", keyDescriptor.Use)
+			}
+			certBytes, err := base64.StdEncoding.DecodeString(keyDescriptor.KeyInfo.Certificate)
+			if err != nil || len(certBytes) == 0 {
+				return fmt.Errorf("metadata: KeyDescriptor %q does not contain a certificate", keyDescriptor.Use)
+			}
+			if _, err := x509.ParseCertificate(certBytes); err != nil {
+				return fmt.Errorf("metadata: KeyDescriptor %q: cannot parse certificate: %s", keyDescriptor.Use, err)
+			}
+		}
+
+		if len(spSSODescriptor.AssertionConsumerServices) == 0 {
+			return errors.New("metadata: AssertionConsumerService is missing")
+		}
+		for _, acs := range spSSODescriptor.AssertionConsumerServices {
+			switch acs.Binding {
+			case HTTPPostBinding, HTTPRedirectBinding,
+				"urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact",
+				"urn:oasis:names:tc:SAML:2.0:bindings:PAOS":
+			default:
+				return fmt.Errorf("metadata: AssertionConsumerService binding %q is not valid", acs.Binding)
+			}
+			location, err := url.Parse(acs.Location)
+			if err != nil || location.Scheme == "" || location.Host == "" {
+				return fmt.Errorf("metadata: AssertionConsumerService location %q is not an absolute URL", acs.Location)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateKeyPair checks that Key is the private key of Certificate, and
+// that EncryptionKey is that of EncryptionCertificate, where both are set.
+// A key that does not match its certificate produces signatures that the
+// IDP rejects, or prevents assertions that the IDP encrypts from being
+// decrypted, so the mistake is best caught when the service provider is
+// configured rather than at the first login.
+func (sp *ServiceProvider) ValidateKeyPair() error {
+	if sp.Key != nil && sp.Certificate != nil && !certificateMatchesKey(sp.Certificate, sp.Key) {
+		return errors.New("Key does not match the public key of Certificate")
+	}
+	if key := sp.encryptionKey(); key != nil && sp.EncryptionCertificate != nil && !certificateMatchesKey(sp.EncryptionCertificate, key) {
+		return errors.New("EncryptionKey does not match the public key of EncryptionCertificate")
+	}
+	return nil
+}
+
+// ServiceProviderFromMetadata returns a ServiceProvider configured from md,
+// the XML metadata of the service provider itself, and key, the private key
+// of the certificate that it advertises. This allows the metadata to be the
+// single source of truth for the configuration of the service provider.
+//
+// MetadataURL is set to the entity ID, MetadataExtensions to its
+// Extensions, and UIInfo and AttributeConsumingServices to those of the
+// SPSSODescriptor. AcsURL is set to the location of the default assertion
+// consumer service with the HTTP-POST binding, or the one with the lowest
+// index if none is marked as the default, and the locations of the others
+// are added to AllowedACSURLs. ECP is set if there is an assertion consumer service with
+// the PAOS binding, and SignRequest if the SPSSODescriptor specifies
+// AuthnRequestsSigned="true". The signing certificate must match key. If
+// there is an encryption certificate that differs from it, it must match
+// key as well, and is used as EncryptionCertificate.
+//
+// The IDP metadata and other settings must be configured separately.
+func ServiceProviderFromMetadata(md []byte, key *rsa.PrivateKey) (*ServiceProvider, error) {
+	if key == nil {
+		return nil, errors.New("metadata: key must be specified")
+	}
+
+	entity := EntityDescriptor{}
+	if err := xml.Unmarshal(md, &entity); err != nil {
+		return nil, fmt.Errorf("metadata: cannot unmarshal: %s", err)
+	}
+	if len(entity.SPSSODescriptors) == 0 {
+		return nil, errors.New("metadata: SPSSODescriptor is missing")
+	}
+	spSSODescriptor := entity.SPSSODescriptors[0]
+
+	metadataURL, err := url.Parse(entity.EntityID)
+	if err != nil || entity.EntityID == "" {
+		return nil, fmt.Errorf("metadata: entityID %q is not a valid URL", entity.EntityID)
+	}
+
+	sp := &ServiceProvider{
+		Key:                key,
+		MetadataURL:        *metadataURL,
+		MetadataExtensions: entity.Extensions,
+		NameIDFormats:      spSSODescriptor.NameIDFormats,
+		SignRequest:        spSSODescriptor.AuthnRequestsSigned != nil && *spSSODescriptor.AuthnRequestsSigned,
+
+		AttributeConsumingServices: spSSODescriptor.AttributeConsumingServices,
+	}
+	if spSSODescriptor.Extensions != nil {
+		sp.UIInfo = spSSODescriptor.Extensions.UIInfo
+	}
+
+	signingCerts, err := spSSODescriptor.SigningCertificates()
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %s", err)
+	}
+	if len(signingCerts) == 0 {
+		return nil, errors.New("metadata: signing certificate is missing")
+	}
+	sp.Certificate = signingCerts[0]
+	if !certificateMatchesKey(sp.Certificate, key) {
+		return nil, errors.New("metadata: key does not match the signing certificate")
+	}
+
+	encryptionCerts, err := spSSODescriptor.EncryptionCertificates()
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %s", err)
+	}
+	if len(encryptionCerts) > 0 && !bytes.Equal(encryptionCerts[0].Raw, sp.Certificate.Raw) {
+		if !certificateMatchesKey(encryptionCerts[0], key) {
+			return nil, errors.New("metadata: key does not match the encryption certificate")
+		}
+		sp.EncryptionCertificate = encryptionCerts[0]
+	}
+
+	var acs *IndexedEndpoint
+	for i, endpoint := range spSSODescriptor.AssertionConsumerServices {
+		if endpoint.Binding != HTTPPostBinding {
+			continue
+		}
+		if endpoint.IsDefault != nil && *endpoint.IsDefault {
+			acs = &spSSODescriptor.AssertionConsumerServices[i]
+			break
+		}
+		if acs == nil || endpoint.Index < acs.Index {
+			acs = &spSSODescriptor.AssertionConsumerServices[i]
+		}
+	}
+	if acs == nil {
+		return nil, errors.New("metadata: AssertionConsumerService with the HTTP-POST binding is missing")
+	}
+	acsURL, err := url.Parse(acs.Location)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: AssertionConsumerService location %q is not a valid URL", acs.Location)
+	}
+	sp.AcsURL = *acsURL
+
+	for _, endpoint := range spSSODescriptor.AssertionConsumerServices {
+		if endpoint.Binding == PAOSBinding {
+			sp.ECP = true
+		}
+		if sp.isACSURL(endpoint.Location, "") {
+			continue
+		}
+		location, err := url.Parse(endpoint.Location)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: AssertionConsumerService location %q is not a valid URL", endpoint.Location)
+		}
+		sp.AllowedACSURLs = append(sp.AllowedACSURLs, *location)
+	}
+	return sp, nil
+}
+
+// certificateMatchesKey returns true if the public key of cert is that of
+// key.
+func certificateMatchesKey(cert *x509.Certificate, key *rsa.PrivateKey) bool {
+	certPublicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	return ok && certPublicKey.N.Cmp(key.PublicKey.N) == 0 && certPublicKey.E == key.PublicKey.E
+}
+
 // MakeRedirectAuthenticationRequest creates a SAML authentication request using
 // the HTTP-Redirect binding. It returns a URL that we will redirect the user to
 // in order to start the auth process.
 func (sp *ServiceProvider) MakeRedirectAuthenticationRequest(relayState string) (*url.URL, error) {
-	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(HTTPRedirectBinding))
+	req, err := sp.MakeAuthenticationRequestForBinding(HTTPRedirectBinding)
+	if err != nil {
+		return nil, err
+	}
+	return sp.RedirectURL(req, relayState)
+}
+
+// RedirectURL returns a URL suitable for using the redirect binding with
+// req, like req.Redirect, but compresses the request with
+// RedirectCompressionLevel. If requests must be signed, the URL carries the
+// SigAlg and Signature parameters that SignRedirectQuery produces, and any
+// enveloped signature of req is omitted, as the binding requires.
+func (sp *ServiceProvider) RedirectURL(req *AuthnRequest, relayState string) (*url.URL, error) {
+	if !sp.signsAuthnRequests() {
+		return req.RedirectWithCompressionLevel(relayState, sp.redirectCompressionLevel())
+	}
+
+	unsignedReq := *req
+	unsignedReq.Signature = nil
+	doc := etree.NewDocument()
+	doc.SetRoot(unsignedReq.Element())
+	message, err := doc.WriteToString()
+	if err != nil {
+		return nil, err
+	}
+	signedQuery, err := sp.SignRedirectQuery(message, relayState, sp.signatureMethod())
+	if err != nil {
+		return nil, err
+	}
+
+	rv, err := url.Parse(req.Destination)
 	if err != nil {
 		return nil, err
 	}
-	return req.Redirect(relayState), nil
+	query := rv.Query()
+	for name, values := range signedQuery {
+		query[name] = values
+	}
+	rv.RawQuery = query.Encode()
+	return rv, nil
+}
+
+func (sp *ServiceProvider) redirectCompressionLevel() int {
+	if sp.RedirectCompressionLevel == nil {
+		return flate.BestCompression
+	}
+	return *sp.RedirectCompressionLevel
+}
+
+// MakeLoginURL returns the URL of the IDP's HTTP-Redirect binding endpoint
+// with the SAMLRequest and RelayState parameters, as produced by
+// MakeRedirectAuthenticationRequest. It is meant for front ends that
+// navigate to the IDP themselves rather than following a redirect. If
+// requests must be signed, the URL carries the SigAlg and Signature
+// parameters, as RedirectURL describes.
+func (sp *ServiceProvider) MakeLoginURL(relayState string) (string, error) {
+	if sp.GetSSOBindingLocation(HTTPRedirectBinding) == "" {
+		return "", errors.New("the IDP does not support the HTTP-Redirect binding")
+	}
+	redirectURL, err := sp.MakeRedirectAuthenticationRequest(relayState)
+	if err != nil {
+		return "", err
+	}
+	return redirectURL.String(), nil
 }
 
 // Redirect returns a URL suitable for using the redirect binding with the request
 func (req *AuthnRequest) Redirect(relayState string) *url.URL {
+	rv, err := req.RedirectWithCompressionLevel(relayState, flate.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+	return rv
+}
+
+// RedirectWithCompressionLevel is like Redirect, but compresses the request
+// with the given DEFLATE level, such as flate.BestCompression, which keeps
+// the URL short, or flate.BestSpeed. It returns an error if level is not
+// valid.
+func (req *AuthnRequest) RedirectWithCompressionLevel(relayState string, level int) (*url.URL, error) {
 	w := &bytes.Buffer{}
 	w1 := base64.NewEncoder(base64.StdEncoding, w)
-	w2, _ := flate.NewWriter(w1, 9)
+	w2, err := flate.NewWriter(w1, level)
+	if err != nil {
+		return nil, err
+	}
 	doc := etree.NewDocument()
 	doc.SetRoot(req.Element())
 	if _, err := doc.WriteTo(w2); err != nil {
-		panic(err)
+		return nil, err
 	}
 	w2.Close()
 	w1.Close()
@@ -189,7 +945,7 @@ func (req *AuthnRequest) Redirect(relayState string) *url.URL {
 	}
 	rv.RawQuery = query.Encode()
 
-	return rv
+	return rv, nil
 }
 
 // GetSSOBindingLocation returns URL for the IDP's Single Sign On Service binding
@@ -205,6 +961,19 @@ func (sp *ServiceProvider) GetSSOBindingLocation(binding string) string {
 	return ""
 }
 
+// IDPMetadataByEntityID returns the metadata of the IDP whose entity ID is
+// entityID, such as the Issuer of an assertion returned by ParseResponse,
+// from IDPMetadata or IDPMetadatas. It returns nil if there is none.
+func (sp *ServiceProvider) IDPMetadataByEntityID(entityID string) *EntityDescriptor {
+	if sp.IDPMetadata != nil && sp.IDPMetadata.EntityID == entityID {
+		return sp.IDPMetadata
+	}
+	if entity, ok := sp.IDPMetadatas[entityID]; ok {
+		return &entity
+	}
+	return nil
+}
+
 // getIDPSigningCert returns the certificate which we can use to verify things
 // signed by the IDP in PEM format, or nil if no such certificate is found.
 func (sp *ServiceProvider) getIDPSigningCert() (*x509.Certificate, error) {
@@ -235,22 +1004,90 @@ func (sp *ServiceProvider) getIDPSigningCert() (*x509.Certificate, error) {
 		return nil, errors.New("cannot find any signing certificate in the IDP SSO descriptor")
 	}
 
-	// cleanup whitespace
-	certStr = regexp.MustCompile(`\s+`).ReplaceAllString(certStr, "")
-	certBytes, err := base64.StdEncoding.DecodeString(certStr)
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse certificate: %s", err)
-	}
+	return parseKeyInfoCertificate(certStr)
+}
+
+// MakeAuthenticationRequest produces a new AuthnRequest object for idpURL.
+func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnRequest, error) {
+	return sp.makeAuthenticationRequest(idpURL, HTTPPostBinding, HTTPPostBinding, acsIndex)
+}
+
+// MakeAuthenticationRequestForBinding produces a new AuthnRequest object to
+// be sent to the IDP with binding, such as HTTPRedirectBinding. Its
+// Destination is the location of the IDP's SingleSignOnService with that
+// binding, as GetSSOBindingLocation returns, so that it always matches the
+// endpoint to which the request is sent. It returns an error if the IDP
+// metadata has no such endpoint.
+func (sp *ServiceProvider) MakeAuthenticationRequestForBinding(binding string) (*AuthnRequest, error) {
+	return sp.MakeAuthenticationRequestWithBindings(binding, HTTPPostBinding)
+}
 
-	parsedCert, err := x509.ParseCertificate(certBytes)
+// MakeAuthenticationRequestWithBindings is like
+// MakeAuthenticationRequestForBinding, producing an AuthnRequest to be sent
+// to the IDP with requestBinding, but asks the IDP to send the response
+// with responseBinding. The two are independent, so that, for example, a
+// request sent with HTTPRedirectBinding can ask for the response with
+// HTTPPostBinding explicitly. The ProtocolBinding of the request is
+// responseBinding, and it refers to the assertion consumer service of our
+// metadata with that binding. It returns an error if our metadata does not
+// advertise one, since the IDP could not send the response to it.
+func (sp *ServiceProvider) MakeAuthenticationRequestWithBindings(requestBinding, responseBinding string) (*AuthnRequest, error) {
+	idpURL, err := sp.ssoBindingLocation(requestBinding)
 	if err != nil {
 		return nil, err
 	}
-	return parsedCert, nil
+	for _, acs := range sp.assertionConsumerServices() {
+		if acs.Binding == responseBinding {
+			return sp.makeAuthenticationRequest(idpURL, requestBinding, acs.Binding, acs.Index)
+		}
+	}
+	return nil, fmt.Errorf("cannot make AuthnRequest: our metadata has no AssertionConsumerService with the %s binding", responseBinding)
 }
 
-// MakeAuthenticationRequest produces a new AuthnRequest object for idpURL.
-func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnRequest, error) {
+// ssoBindingLocation is like GetSSOBindingLocation, but returns an error if
+// the IDP has no SingleSignOnService with binding.
+func (sp *ServiceProvider) ssoBindingLocation(binding string) (string, error) {
+	if sp.IDPMetadata == nil {
+		return "", errors.New("cannot make AuthnRequest: IDPMetadata must be specified")
+	}
+	location := sp.GetSSOBindingLocation(binding)
+	if location == "" {
+		return "", fmt.Errorf("cannot make AuthnRequest: the IDP metadata has no SingleSignOnService with the %s binding", binding)
+	}
+	return location, nil
+}
+
+// newRequestID returns the ID of a new request, as IDGenerator or IDPrefix
+// specify.
+func (sp *ServiceProvider) newRequestID() (string, error) {
+	if sp.IDGenerator != nil {
+		id := sp.IDGenerator()
+		if !isNCName(id) {
+			return "", fmt.Errorf("IDGenerator returned %q, which is not a valid XML NCName", id)
+		}
+		return id, nil
+	}
+	if sp.IDPrefix == "" {
+		return NewID(), nil
+	}
+	id := fmt.Sprintf("%s%x", sp.IDPrefix, randomBytes(20))
+	if !isNCName(id) {
+		return "", fmt.Errorf("IDPrefix %q does not produce a valid XML NCName", sp.IDPrefix)
+	}
+	return id, nil
+}
+
+// makeAuthenticationRequest produces a new AuthnRequest object for idpURL
+// that asks for the response to be sent with binding to the assertion
+// consumer service of our metadata whose index is index. If the request
+// must be signed, it is given an enveloped signature, unless it is to be
+// sent with requestBinding HTTPRedirectBinding, in which case RedirectURL
+// signs the query instead.
+func (sp *ServiceProvider) makeAuthenticationRequest(idpURL string, requestBinding string, binding string, index int) (*AuthnRequest, error) {
+	if sp.SignRequest && (sp.Key == nil || sp.Certificate == nil) {
+		return nil, errors.New("cannot make AuthnRequest: SignRequest is set, but Key and Certificate are not specified")
+	}
+
 	var nameIDFormat string
 	switch sp.AuthnNameIDFormat {
 	case "":
@@ -262,13 +1099,22 @@ func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnReque
 		nameIDFormat = string(sp.AuthnNameIDFormat)
 	}
 
+	id, err := sp.newRequestID()
+	if err != nil {
+		return nil, err
+	}
+	issueInstant := TimeNow()
+	if sp.Clock != nil {
+		issueInstant = sp.Clock.Now().UTC()
+	}
+
 	allowCreate := true
 	req := AuthnRequest{
 		AssertionConsumerServiceURL: sp.AcsURL.String(),
 		Destination:                 idpURL,
-		ProtocolBinding:             HTTPPostBinding, // default binding for the response
-		ID:                          fmt.Sprintf("id-%x", randomBytes(20)),
-		IssueInstant:                TimeNow(),
+		ProtocolBinding:             binding,
+		ID:                          id,
+		IssueInstant:                issueInstant,
 		Version:                     "2.0",
 		Issuer: &Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
@@ -281,16 +1127,100 @@ func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnReque
 			// urn:oasis:names:tc:SAML:2.0:nameid-format:transient
 			Format: &nameIDFormat,
 		},
+		Consent:    sp.AuthnRequestConsent,
 		ForceAuthn: sp.ForceAuthn,
+		IsPassive:  sp.IsPassive,
+	}
+	if sp.AuthnRequestSubject != nil {
+		nameID := *sp.AuthnRequestSubject
+		req.Subject = &Subject{NameID: &nameID}
+	}
+	if sp.IDPMetadata != nil && sp.UseACSIndex[sp.IDPMetadata.EntityID] {
+		req.AssertionConsumerServiceURL = ""
+		req.ProtocolBinding = ""
+		req.AssertionConsumerServiceIndex = strconv.Itoa(index)
+	}
+
+	if !sp.SignRequest && sp.idpWantsAuthnRequestsSigned() && sp.Logger != nil {
+		sp.Logger.Printf("IDP metadata specifies WantAuthnRequestsSigned, signing AuthnRequest")
+	}
+	if sp.signsAuthnRequests() && requestBinding != HTTPRedirectBinding {
+		if err := sp.SignAuthnRequest(&req); err != nil {
+			return nil, err
+		}
+	}
+	if sp.LogAuthnRequests && sp.Logger != nil {
+		doc := etree.NewDocument()
+		doc.SetRoot(req.Element())
+		if reqBuf, err := doc.WriteToString(); err == nil {
+			sp.Logger.Printf("DEBUG: AuthnRequest %s to %s: %s", req.ID, req.Destination, reqBuf)
+		}
 	}
 	return &req, nil
 }
 
+// signsAuthnRequests returns true if authentication requests must be
+// signed, because of SignRequest or the IDP metadata.
+func (sp *ServiceProvider) signsAuthnRequests() bool {
+	return sp.SignRequest || sp.idpWantsAuthnRequestsSigned()
+}
+
+// signatureMethod returns SignatureMethod, or its default.
+func (sp *ServiceProvider) signatureMethod() string {
+	if sp.SignatureMethod == "" {
+		return dsig.RSASHA256SignatureMethod
+	}
+	return sp.SignatureMethod
+}
+
+// idpWantsAuthnRequestsSigned returns true if the IDP metadata specifies
+// that authentication requests must be signed.
+func (sp *ServiceProvider) idpWantsAuthnRequestsSigned() bool {
+	if sp.IDPMetadata == nil {
+		return false
+	}
+	for _, idpSSODescriptor := range sp.IDPMetadata.IDPSSODescriptors {
+		if idpSSODescriptor.WantAuthnRequestsSigned != nil && *idpSSODescriptor.WantAuthnRequestsSigned {
+			return true
+		}
+	}
+	return false
+}
+
+// SignAuthnRequest adds an enveloped signature to req using sp.Key and
+// sp.Certificate, with SignatureMethod.
+func (sp *ServiceProvider) SignAuthnRequest(req *AuthnRequest) error {
+	if sp.Key == nil || sp.Certificate == nil {
+		return errors.New("cannot sign AuthnRequest: Key and Certificate must be specified")
+	}
+	keyPair := tls.Certificate{
+		Certificate: [][]byte{sp.Certificate.Raw},
+		PrivateKey:  sp.Key,
+		Leaf:        sp.Certificate,
+	}
+	keyStore := dsig.TLSCertKeyStore(keyPair)
+
+	signingContext := dsig.NewDefaultSigningContext(keyStore)
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
+	if err := signingContext.SetSignatureMethod(sp.signatureMethod()); err != nil {
+		return err
+	}
+
+	signedRequestEl, err := signingContext.SignEnveloped(req.Element())
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
 // MakePostAuthenticationRequest creates a SAML authentication request using
 // the HTTP-POST binding. It returns HTML text representing an HTML form that
 // can be sent presented to a browser to initiate the login process.
 func (sp *ServiceProvider) MakePostAuthenticationRequest(relayState string) ([]byte, error) {
-	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(HTTPPostBinding))
+	req, err := sp.MakeAuthenticationRequestForBinding(HTTPPostBinding)
 	if err != nil {
 		return nil, err
 	}
@@ -350,10 +1280,173 @@ func (aa AssertionAttributes) Get(name string) *AssertionAttribute {
 	return nil
 }
 
-// AssertionAttribute represents an attribute of the user extracted from
-// a SAML Assertion.
-type AssertionAttribute struct {
-	FriendlyName string
+// ErrNoPassive is the PrivateErr of the InvalidResponseError returned by
+// ParseResponse when the IDP responds to a request with IsPassive set that
+// it cannot authenticate the user without interacting with them.
+var ErrNoPassive = errors.New("the IDP cannot authenticate the user passively")
+
+// StrongSignatureMethods are the signature algorithms that use SHA-256 or
+// stronger, for use as ServiceProvider.AllowedSignatureMethods.
+var StrongSignatureMethods = []string{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha384",
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384",
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512",
+}
+
+// StrongDigestMethods are the digest algorithms SHA-256 and stronger, for use
+// as ServiceProvider.AllowedDigestMethods.
+var StrongDigestMethods = []string{
+	"http://www.w3.org/2001/04/xmlenc#sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#sha384",
+	"http://www.w3.org/2001/04/xmlenc#sha512",
+}
+
+// AlgorithmNotAllowedError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when a signature uses an algorithm that is not
+// in AllowedSignatureMethods or AllowedDigestMethods, or an assertion is
+// encrypted with an algorithm that is not in KeyTransportAlgorithms or
+// DataEncryptionAlgorithms.
+type AlgorithmNotAllowedError struct {
+	// Method is the element that names the algorithm, either
+	// "SignatureMethod", "DigestMethod" or "EncryptionMethod".
+	Method    string
+	Algorithm string
+}
+
+func (e *AlgorithmNotAllowedError) Error() string {
+	return fmt.Sprintf("%s %s is not allowed", e.Method, e.Algorithm)
+}
+
+// PreviousIDPCertificate is a signing certificate that the IDP used before
+// it rolled over its key. It is trusted until Until.
+type PreviousIDPCertificate struct {
+	Certificate *x509.Certificate
+	Until       time.Time
+}
+
+// StaleMetadataError is the PrivateErr of the InvalidResponseError returned
+// by ParseResponse when the signing certificate in the IDP metadata has
+// expired. This usually means that the IDP has rotated its certificate and
+// the metadata should be fetched again.
+type StaleMetadataError struct {
+	EntityID string
+	NotAfter time.Time
+}
+
+func (e *StaleMetadataError) Error() string {
+	return fmt.Sprintf("the signing certificate in the metadata of IDP %s expired at %s; the metadata may be stale and should be refreshed",
+		e.EntityID, e.NotAfter.Format(time.RFC3339))
+}
+
+// AuthnContextLevelError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the AuthnContextLevel of the assertion is
+// lower than MinAuthnContextLevel.
+type AuthnContextLevelError struct {
+	// ClassRefs are the AuthnContextClassRefs of the assertion.
+	ClassRefs []string
+	Level     int
+	MinLevel  int
+}
+
+func (e *AuthnContextLevelError) Error() string {
+	return fmt.Sprintf("AuthnContextClassRefs %q have level %d, but level %d is required", e.ClassRefs, e.Level, e.MinLevel)
+}
+
+// InResponseToError is the PrivateErr of the InvalidResponseError returned
+// by ParseResponse when the InResponseTo of the Response is not one of the
+// possible request IDs.
+type InResponseToError struct {
+	InResponseTo       string
+	PossibleRequestIDs []string
+}
+
+func (e *InResponseToError) Error() string {
+	return fmt.Sprintf("`InResponseTo` does not match any of the possible request IDs (expected %v)", e.PossibleRequestIDs)
+}
+
+// TimestampError is the PrivateErr of the InvalidResponseError returned by
+// ParseResponse when RequireUTCTimestamps is set and a timestamp is not an
+// xs:dateTime in UTC.
+type TimestampError struct {
+	// Element is the local name of the element with the timestamp, for
+	// example "Conditions".
+	Element   string
+	Attribute string
+	Value     string
+}
+
+func (e *TimestampError) Error() string {
+	return fmt.Sprintf("%s %s %q is not a UTC xs:dateTime", e.Element, e.Attribute, e.Value)
+}
+
+// MultipleAssertionsPolicy determines how a ServiceProvider handles a
+// Response that contains more than one Assertion or EncryptedAssertion.
+type MultipleAssertionsPolicy int
+
+const (
+	// RejectMultipleAssertions causes responses with more than one assertion
+	// to be rejected.
+	RejectMultipleAssertions MultipleAssertionsPolicy = iota
+
+	// MergeMultipleAssertions causes each assertion to be validated and
+	// then merged into one. The assertions must all have the same subject.
+	// The merged assertion is the first assertion with the AuthnStatements
+	// and AttributeStatements of the others appended to its own.
+	MergeMultipleAssertions
+)
+
+// NameIDFormatPolicy determines how a ServiceProvider checks the Format of
+// the NameID of an assertion. The Format is only checked if
+// AuthnNameIDFormat is set to a format other than UnspecifiedNameIDFormat.
+// A NameID without a Format has the format UnspecifiedNameIDFormat. The
+// SAML 1.1 URIs of the unspecified and emailAddress formats, which ADFS
+// sends, are equivalent to UnspecifiedNameIDFormat and
+// EmailAddressNameIDFormat.
+type NameIDFormatPolicy int
+
+const (
+	// IgnoreNameIDFormat causes the NameID Format not to be checked.
+	IgnoreNameIDFormat NameIDFormatPolicy = iota
+
+	// RequireRequestedNameIDFormat causes assertions whose NameID Format is
+	// not AuthnNameIDFormat to be rejected with ErrNameIDFormatMismatch.
+	RequireRequestedNameIDFormat
+
+	// AllowDeclaredNameIDFormats is a relaxed RequireRequestedNameIDFormat
+	// for IDPs that return another format than the one requested. The
+	// NameID Format may also be any of the NameIDFormats that our metadata
+	// declares.
+	AllowDeclaredNameIDFormats
+)
+
+// SubjectConfirmationNotBeforePolicy determines how a ServiceProvider
+// treats a bearer SubjectConfirmationData that has a NotBefore attribute.
+// Section 4.1.4.2 of SAMLProfiles requires that the SubjectConfirmationData
+// of a bearer SubjectConfirmation in the Web Browser SSO profile does not
+// have one, because the assertion must be usable as soon as it is issued,
+// so an assertion with one comes from a non-conforming IDP or was not
+// meant for this profile.
+type SubjectConfirmationNotBeforePolicy int
+
+const (
+	// WarnSubjectConfirmationNotBefore causes such assertions to be
+	// accepted with a WarningSubjectConfirmationNotBefore.
+	WarnSubjectConfirmationNotBefore SubjectConfirmationNotBeforePolicy = iota
+
+	// RejectSubjectConfirmationNotBefore causes a bearer
+	// SubjectConfirmation whose SubjectConfirmationData has a NotBefore to
+	// be rejected with ErrSubjectConfirmationNotBefore, like one with an
+	// invalid Recipient.
+	RejectSubjectConfirmationNotBefore
+)
+
+// AssertionAttribute represents an attribute of the user extracted from
+// a SAML Assertion.
+type AssertionAttribute struct {
+	FriendlyName string
 	Name         string
 	Value        string
 }
@@ -382,8 +1475,26 @@ func (ivr *InvalidResponseError) Error() string {
 // If the function fails it will return an InvalidResponseError whose
 // properties are useful in describing which part of the parsing process
 // failed. However, to discourage inadvertent disclosure the diagnostic
-// information, the Error() method returns a static string.
+// information, the Error() method returns a static string. If the IDP
+// could not satisfy a passive request, its PrivateErr is ErrNoPassive.
+//
+// The Issuer of the Response is optional, but is checked against
+// IDPMetadata if present. The issuer of an assertion is its own Issuer if
+// it has one, and otherwise the Issuer of the Response, which is then set
+// as the Issuer of the returned assertion. A response in which neither is
+// present is rejected.
 func (sp *ServiceProvider) ParseResponse(req *http.Request, possibleRequestIDs []string) (*Assertion, error) {
+	assertion, _, err := sp.ParseResponseWithWarnings(req, possibleRequestIDs)
+	return assertion, err
+}
+
+// ParseResponseWithWarnings is like ParseResponse, but also returns the
+// warnings for a response that is accepted. Warnings describe properties of
+// the response that are allowed, but that a stricter policy may reject, such
+// as a weak signature algorithm. They are useful for finding out how an IDP
+// would fare under such a policy before enforcing it. Whether the response
+// is accepted is the same as for ParseResponse.
+func (sp *ServiceProvider) ParseResponseWithWarnings(req *http.Request, possibleRequestIDs []string) (*Assertion, []Warning, error) {
 	now := TimeNow()
 	retErr := &InvalidResponseError{
 		Now:      now,
@@ -393,138 +1504,437 @@ func (sp *ServiceProvider) ParseResponse(req *http.Request, possibleRequestIDs [
 	rawResponseBuf, err := base64.StdEncoding.DecodeString(req.PostForm.Get("SAMLResponse"))
 	if err != nil {
 		retErr.PrivateErr = fmt.Errorf("cannot parse base64: %s", err)
-		return nil, retErr
+		return nil, nil, retErr
+	}
+	return sp.parseResponse(rawResponseBuf, possibleRequestIDs, sp.clientIP(req), sp.forwardedScheme(req), now)
+}
+
+// RequestScheme returns the scheme, "https" or "http", of the connection
+// over which the client made req. It is that of ForwardedProtoHeader if it
+// is set and the request has it, and otherwise "https" if req was made over
+// TLS.
+func (sp *ServiceProvider) RequestScheme(req *http.Request) string {
+	if scheme := sp.forwardedScheme(req); scheme != "" {
+		return scheme
+	}
+	if req.TLS != nil || (req.URL != nil && req.URL.Scheme == "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedScheme returns the scheme in the ForwardedProtoHeader of req, or
+// the empty string if ForwardedProtoHeader is not set or the header does
+// not hold "https" or "http". The first scheme in the header is used.
+func (sp *ServiceProvider) forwardedScheme(req *http.Request) string {
+	if sp.ForwardedProtoHeader == "" {
+		return ""
+	}
+	schemes := strings.Split(req.Header.Get(sp.ForwardedProtoHeader), ",")
+	switch scheme := strings.ToLower(strings.TrimSpace(schemes[0])); scheme {
+	case "https", "http":
+		return scheme
+	}
+	return ""
+}
+
+// clientIP returns the IP address of the client that made req, as
+// determined by ClientIPHeader.
+func (sp *ServiceProvider) clientIP(req *http.Request) string {
+	if sp.ClientIPHeader == "" {
+		return hostIP(req.RemoteAddr)
+	}
+	ips := strings.Split(req.Header.Get(sp.ClientIPHeader), ",")
+	return hostIP(strings.TrimSpace(ips[0]))
+}
+
+// hostIP returns the IP address of addr, which is an IP address with or
+// without a port, in canonical form, or the empty string if addr is not
+// an IP address.
+func hostIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// parseResponse implements ParseResponseWithWarnings for the XML of a
+// Response, however it was received. clientIP is the address of the client
+// that sent it, for ValidateSubjectAddress, and scheme is the scheme of its
+// connection as determined by ForwardedProtoHeader, if any.
+func (sp *ServiceProvider) parseResponse(rawResponseBuf []byte, possibleRequestIDs []string, clientIP string, scheme string, now time.Time) (*Assertion, []Warning, error) {
+	retErr := &InvalidResponseError{
+		Now:      now,
+		Response: string(rawResponseBuf),
+	}
+
+	timer := parseStageTimer{}
+	timer.begin(ParseStageDecode)
+	defer timer.report(sp.ObserveParseStage)
+
+	rawResponseBuf, err := decodeCharset(rawResponseBuf)
+	if err != nil {
+		retErr.PrivateErr = fmt.Errorf("cannot decode response: %s", err)
+		return nil, nil, retErr
 	}
-	retErr.Response = string(rawResponseBuf)
 
 	// do some validation first before we decrypt
 	resp := Response{}
 	if err := xml.Unmarshal(rawResponseBuf, &resp); err != nil {
 		retErr.PrivateErr = fmt.Errorf("cannot unmarshal response: %s", err)
-		return nil, retErr
+		return nil, nil, retErr
 	}
-	if resp.Destination != sp.AcsURL.String() {
+	if resp.Version != "2.0" {
+		retErr.PrivateErr = fmt.Errorf("Response Version is %q, expected \"2.0\"", resp.Version)
+		return nil, nil, retErr
+	}
+	if !sp.isACSURL(resp.Destination, scheme) {
 		retErr.PrivateErr = fmt.Errorf("`Destination` does not match AcsURL (expected %q)", sp.AcsURL.String())
-		return nil, retErr
+		return nil, nil, retErr
 	}
 
 	requestIDvalid := false
 	for _, possibleRequestID := range possibleRequestIDs {
-		if resp.InResponseTo == possibleRequestID {
+		if constantTimeEqual(resp.InResponseTo, possibleRequestID) {
 			requestIDvalid = true
 		}
 	}
 	if !requestIDvalid {
-		retErr.PrivateErr = fmt.Errorf("`InResponseTo` does not match any of the possible request IDs (expected %v)", possibleRequestIDs)
-		return nil, retErr
+		retErr.PrivateErr = &InResponseToError{
+			InResponseTo:       resp.InResponseTo,
+			PossibleRequestIDs: possibleRequestIDs,
+		}
+		return nil, nil, retErr
 	}
 
 	if resp.IssueInstant.Add(MaxIssueDelay).Before(now) {
 		retErr.PrivateErr = fmt.Errorf("IssueInstant expired at %s", resp.IssueInstant.Add(MaxIssueDelay))
-		return nil, retErr
+		return nil, nil, retErr
 	}
-	if resp.Issuer.Value != sp.IDPMetadata.EntityID {
-		retErr.PrivateErr = fmt.Errorf("Issuer does not match the IDP metadata (expected %q)", sp.IDPMetadata.EntityID)
-		return nil, retErr
+	if resp.Issuer != nil {
+		if resp.Issuer.Value != sp.IDPMetadata.EntityID {
+			retErr.PrivateErr = fmt.Errorf("Issuer does not match the IDP metadata (expected %q)", sp.IDPMetadata.EntityID)
+			return nil, nil, retErr
+		}
+		if err := sp.validateIssuerFormat(resp.Issuer); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		}
 	}
 	if resp.Status.StatusCode.Value != StatusSuccess {
+		if subStatusCode := resp.Status.StatusCode.StatusCode; subStatusCode != nil && subStatusCode.Value == StatusNoPassive {
+			retErr.PrivateErr = ErrNoPassive
+			return nil, nil, retErr
+		}
 		retErr.PrivateErr = fmt.Errorf("Status code was not %s", StatusSuccess)
-		return nil, retErr
+		return nil, nil, retErr
 	}
 
-	var assertion *Assertion
-	if resp.EncryptedAssertion == nil {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(rawResponseBuf); err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
 
-		doc := etree.NewDocument()
-		if err := doc.ReadFromBytes(rawResponseBuf); err != nil {
-			retErr.PrivateErr = err
-			return nil, retErr
-		}
+	if err := sp.removeComments(doc.Root()); err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
 
-		// TODO(ross): verify that the namespace is urn:oasis:names:tc:SAML:2.0:protocol
-		responseEl := doc.Root()
-		if responseEl.Tag != "Response" {
-			retErr.PrivateErr = fmt.Errorf("expected to find a response object, not %s", doc.Root().Tag)
-			return nil, retErr
-		}
+	// TODO(ross): verify that the namespace is urn:oasis:names:tc:SAML:2.0:protocol
+	responseEl := doc.Root()
+	if responseEl.Tag != "Response" {
+		retErr.PrivateErr = fmt.Errorf("expected to find a response object, not %s", doc.Root().Tag)
+		return nil, nil, retErr
+	}
+	if err := validateNotWrapped(responseEl); err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
+	if err := sp.validateTimestamps(responseEl); err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
 
+	assertionEls, err := findChildren(responseEl, "urn:oasis:names:tc:SAML:2.0:assertion", "Assertion")
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
+	encryptedAssertionEls, err := findChildren(responseEl, "urn:oasis:names:tc:SAML:2.0:assertion", "EncryptedAssertion")
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
+	if len(assertionEls)+len(encryptedAssertionEls) == 0 {
+		retErr.PrivateErr = ErrNoAssertion
+		return nil, nil, retErr
+	}
+	if n := len(assertionEls) + len(encryptedAssertionEls); n > 1 && sp.MultipleAssertions != MergeMultipleAssertions {
+		retErr.PrivateErr = fmt.Errorf("response contains %d assertions, but only one is allowed", n)
+		return nil, nil, retErr
+	}
+
+	var assertions []*Assertion
+	var warnings []Warning
+	if len(assertionEls) > 0 {
+		timer.begin(ParseStageVerifySignature)
 		if err = sp.validateSigned(responseEl); err != nil {
 			retErr.PrivateErr = err
-			return nil, retErr
+			return nil, nil, retErr
 		}
-
-		assertion = resp.Assertion
+		warnings = append(warnings, signatureWarnings(responseEl)...)
+		timer.begin(ParseStageDecode)
+
+		plaintextAssertions := struct {
+			Assertions []*Assertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+		}{}
+		if err := xml.Unmarshal(rawResponseBuf, &plaintextAssertions); err != nil {
+			retErr.PrivateErr = fmt.Errorf("cannot unmarshal response: %s", err)
+			return nil, nil, retErr
+		}
+		// The assertions we use must be exactly the ones whose signatures
+		// were checked.
+		if len(plaintextAssertions.Assertions) != len(assertionEls) {
+			retErr.PrivateErr = fmt.Errorf("%s: found %d assertions, but validated %d", errSignatureWrapping,
+				len(plaintextAssertions.Assertions), len(assertionEls))
+			return nil, nil, retErr
+		}
+		for i, assertion := range plaintextAssertions.Assertions {
+			if assertion.ID != assertionEls[i].SelectAttrValue("ID", "") {
+				retErr.PrivateErr = fmt.Errorf("%s: assertion %q is not the validated assertion", errSignatureWrapping, assertion.ID)
+				return nil, nil, retErr
+			}
+		}
+		assertions = append(assertions, plaintextAssertions.Assertions...)
 	}
 
 	// decrypt the response
-	if resp.EncryptedAssertion != nil {
-		doc := etree.NewDocument()
-		if err := doc.ReadFromBytes(rawResponseBuf); err != nil {
+	symmetricKeys := map[string][]byte{}
+	for _, encryptedAssertionEl := range encryptedAssertionEls {
+		el := encryptedAssertionEl.FindElement("./EncryptedData")
+		if el == nil {
+			retErr.PrivateErr = fmt.Errorf("EncryptedAssertion does not contain EncryptedData")
+			return nil, nil, retErr
+		}
+		timer.begin(ParseStageDecrypt)
+		el, err = sp.resolveEncryptedKey(responseEl, encryptedAssertionEl, el)
+		if err != nil {
 			retErr.PrivateErr = err
-			return nil, retErr
+			return nil, nil, retErr
 		}
-		el := doc.FindElement("//EncryptedAssertion/EncryptedData")
-		plaintextAssertion, err := xmlenc.Decrypt(sp.Key, el)
+		if err := sp.validateEncryptionAlgorithms(el); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		}
+		plaintextAssertion, err := sp.decryptEncryptedData(el, symmetricKeys)
 		if err != nil {
 			retErr.PrivateErr = fmt.Errorf("failed to decrypt response: %s", err)
-			return nil, retErr
+			return nil, nil, retErr
 		}
 		retErr.Response = string(plaintextAssertion)
+		timer.begin(ParseStageDecode)
 
-		doc = etree.NewDocument()
+		doc := etree.NewDocument()
 		if err := doc.ReadFromBytes(plaintextAssertion); err != nil {
 			retErr.PrivateErr = fmt.Errorf("cannot parse plaintext response %v", err)
-			return nil, retErr
+			return nil, nil, retErr
 		}
 
+		if err := sp.removeComments(doc.Root()); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		}
+		if doc.Root().Tag != "Assertion" {
+			retErr.PrivateErr = fmt.Errorf("expected to find an assertion, not %s", doc.Root().Tag)
+			return nil, nil, retErr
+		}
+		if declared, err := declareContextNamespaces(doc.Root(), encryptedAssertionEl); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		} else if declared {
+			if plaintextAssertion, err = doc.WriteToBytes(); err != nil {
+				retErr.PrivateErr = err
+				return nil, nil, retErr
+			}
+		}
+		if err := validateNotWrapped(doc.Root()); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		}
+		if err := sp.validateTimestamps(doc.Root()); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		}
+		timer.begin(ParseStageVerifySignature)
 		if err := sp.validateSigned(doc.Root()); err != nil {
 			retErr.PrivateErr = err
-			return nil, retErr
+			return nil, nil, retErr
 		}
+		warnings = append(warnings, signatureWarnings(doc.Root())...)
+		timer.begin(ParseStageDecode)
 
-		assertion = &Assertion{}
+		assertion := &Assertion{}
 		if err := xml.Unmarshal(plaintextAssertion, assertion); err != nil {
 			retErr.PrivateErr = err
-			return nil, retErr
+			return nil, nil, retErr
+		}
+		assertions = append(assertions, assertion)
+	}
+
+	if len(assertions) == 0 {
+		retErr.PrivateErr = ErrNoAssertion
+		return nil, nil, retErr
+	}
+
+	timer.begin(ParseStageValidateConditions)
+	for _, assertion := range assertions {
+		if assertion.Issuer.Value == "" {
+			if sp.RequireAssertionIssuer {
+				retErr.PrivateErr = ErrNoAssertionIssuer
+				return nil, nil, retErr
+			}
+			if resp.Issuer == nil {
+				retErr.PrivateErr = ErrNoIssuer
+				return nil, nil, retErr
+			}
+			assertion.Issuer = *resp.Issuer
+		}
+		if err := sp.validateAssertion(assertion, possibleRequestIDs, scheme, now); err != nil {
+			retErr.PrivateErr = fmt.Errorf("assertion invalid: %s", err)
+			return nil, nil, retErr
+		}
+		if sp.ValidateSubjectAddress {
+			if err := validateSubjectAddress(assertion.Subject, clientIP); err != nil {
+				retErr.PrivateErr = fmt.Errorf("assertion invalid: %s", err)
+				return nil, nil, retErr
+			}
 		}
+		warnings = append(warnings, clockSkewWarnings(assertion, now)...)
+		warnings = append(warnings, subjectConfirmationWarnings(assertion)...)
 	}
 
-	if err := sp.validateAssertion(assertion, possibleRequestIDs, now); err != nil {
-		retErr.PrivateErr = fmt.Errorf("assertion invalid: %s", err)
-		return nil, retErr
+	assertion, err := mergeAssertions(assertions)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
+	if len(assertion.AuthnStatements) == 0 && !sp.AllowMissingAuthnStatement {
+		retErr.PrivateErr = ErrNoAuthnStatement
+		return nil, nil, retErr
+	}
+	if err := sp.validateNameIDFormat(assertion); err != nil {
+		retErr.PrivateErr = err
+		return nil, nil, retErr
+	}
+	if level := sp.AuthnContextLevel(assertion); sp.MinAuthnContextLevel > 0 && level < sp.MinAuthnContextLevel {
+		retErr.PrivateErr = &AuthnContextLevelError{
+			ClassRefs: authnContextClassRefs(assertion),
+			Level:     level,
+			MinLevel:  sp.MinAuthnContextLevel,
+		}
+		return nil, nil, retErr
 	}
+	assertion.ResponseConsent = resp.Consent
 
-	return assertion, nil
+	for _, validate := range sp.Validators {
+		if err := validate(assertion); err != nil {
+			retErr.PrivateErr = err
+			return nil, nil, retErr
+		}
+	}
+	if sp.ReplayStore != nil {
+		for _, a := range assertions {
+			if err := sp.consumeAssertion(a); err != nil {
+				retErr.PrivateErr = err
+				return nil, nil, retErr
+			}
+		}
+	}
+	for _, transform := range sp.Transformers {
+		transform(assertion)
+	}
+	return assertion, warnings, nil
+}
+
+// AuthnContextLevel returns the assurance level of assertion, which is the
+// highest of the levels that AuthnContextLevels assigns to the
+// AuthnContextClassRefs of its AuthnStatements, or 0 if it has none.
+func (sp *ServiceProvider) AuthnContextLevel(assertion *Assertion) int {
+	level := 0
+	for _, classRef := range authnContextClassRefs(assertion) {
+		if l := sp.AuthnContextLevels[classRef]; l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// authnContextClassRefs returns the AuthnContextClassRefs of the
+// AuthnStatements of assertion.
+func authnContextClassRefs(assertion *Assertion) []string {
+	var classRefs []string
+	for _, authnStatement := range assertion.AuthnStatements {
+		if classRef := authnStatement.AuthnContext.AuthnContextClassRef; classRef != nil {
+			classRefs = append(classRefs, strings.TrimSpace(classRef.Value))
+		}
+	}
+	return classRefs
+}
+
+// mergeAssertions combines validated assertions, which must all be about
+// the same subject, as described by MergeMultipleAssertions.
+func mergeAssertions(assertions []*Assertion) (*Assertion, error) {
+	merged := *assertions[0]
+	for _, assertion := range assertions[1:] {
+		if subjectNameID(assertion) != subjectNameID(&merged) {
+			return nil, fmt.Errorf("assertions have different subjects")
+		}
+		merged.AuthnStatements = append(merged.AuthnStatements, assertion.AuthnStatements...)
+		merged.AttributeStatements = append(merged.AttributeStatements, assertion.AttributeStatements...)
+	}
+	return &merged, nil
+}
+
+// subjectNameID returns the NameID of the subject of assertion, or the zero
+// NameID if there is none.
+func subjectNameID(assertion *Assertion) NameID {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return NameID{}
+	}
+	return *assertion.Subject.NameID
 }
 
 // validateAssertion checks that the conditions specified in assertion match
 // the requirements to accept. If validation fails, it returns an error describing
 // the failure. (The digital signature on the assertion is not checked -- this
-// should be done before calling this function).
-func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleRequestIDs []string, now time.Time) error {
+// should be done before calling this function). scheme is as for
+// parseResponse.
+func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleRequestIDs []string, scheme string, now time.Time) error {
+	if assertion.Version != "2.0" {
+		return fmt.Errorf("Version is %q, expected \"2.0\"", assertion.Version)
+	}
 	if assertion.IssueInstant.Add(MaxIssueDelay).Before(now) {
 		return fmt.Errorf("expired on %s", assertion.IssueInstant.Add(MaxIssueDelay))
 	}
 	if assertion.Issuer.Value != sp.IDPMetadata.EntityID {
 		return fmt.Errorf("issuer is not %q", sp.IDPMetadata.EntityID)
 	}
-	for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
-		requestIDvalid := false
-		for _, possibleRequestID := range possibleRequestIDs {
-			if subjectConfirmation.SubjectConfirmationData.InResponseTo == possibleRequestID {
-				requestIDvalid = true
-				break
-			}
-		}
-		if !requestIDvalid {
-			return fmt.Errorf("SubjectConfirmation one of the possible request IDs (%v)", possibleRequestIDs)
-		}
-		if subjectConfirmation.SubjectConfirmationData.Recipient != sp.AcsURL.String() {
-			return fmt.Errorf("SubjectConfirmation Recipient is not %s", sp.AcsURL.String())
-		}
-		if subjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Add(MaxClockSkew).Before(now) {
-			return fmt.Errorf("SubjectConfirmationData is expired")
+	if err := sp.validateIssuerFormat(&assertion.Issuer); err != nil {
+		return err
+	}
+	if err := sp.validateSubject(assertion.Subject, possibleRequestIDs, scheme, now); err != nil {
+		return err
+	}
+	if assertion.Conditions == nil {
+		if sp.AllowMissingConditions {
+			return nil
 		}
+		return ErrNoConditions
 	}
 	if assertion.Conditions.NotBefore.Add(-MaxClockSkew).After(now) {
 		return fmt.Errorf("Conditions is not yet valid")
@@ -533,19 +1943,149 @@ func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleReque
 		return fmt.Errorf("Conditions is expired")
 	}
 
+	audiences := sp.allowedAudiences()
 	audienceRestrictionsValid := false
 	for _, audienceRestriction := range assertion.Conditions.AudienceRestrictions {
-		if audienceRestriction.Audience.Value == sp.MetadataURL.String() {
+		if containsString(audiences, audienceRestriction.Audience.Value) {
 			audienceRestrictionsValid = true
 		}
 	}
 	if !audienceRestrictionsValid {
-		return fmt.Errorf("Conditions AudienceRestriction does not contain %q", sp.MetadataURL.String())
+		if len(audiences) == 1 {
+			return fmt.Errorf("Conditions AudienceRestriction does not contain %q", audiences[0])
+		}
+		return fmt.Errorf("Conditions AudienceRestriction does not contain any of %q", audiences)
+	}
+	return nil
+}
+
+// allowedAudiences returns the audiences that are accepted in the
+// AudienceRestriction of an assertion.
+func (sp *ServiceProvider) allowedAudiences() []string {
+	if len(sp.AllowedAudiences) == 0 {
+		return []string{sp.MetadataURL.String()}
+	}
+	return sp.AllowedAudiences
+}
+
+// validateNameIDFormat returns ErrNameIDFormatMismatch if the NameID of
+// assertion does not have a format that sp.NameIDFormatPolicy allows.
+func (sp *ServiceProvider) validateNameIDFormat(assertion *Assertion) error {
+	if sp.NameIDFormatPolicy == IgnoreNameIDFormat ||
+		sp.AuthnNameIDFormat == "" || equivalentNameIDFormat(sp.AuthnNameIDFormat) == UnspecifiedNameIDFormat {
+		return nil
+	}
+	format := equivalentNameIDFormat(NameIDFormat(subjectNameID(assertion).Format))
+	if format == "" {
+		format = UnspecifiedNameIDFormat
+	}
+	if format == equivalentNameIDFormat(sp.AuthnNameIDFormat) {
+		return nil
+	}
+	if sp.NameIDFormatPolicy == AllowDeclaredNameIDFormats {
+		for _, declaredFormat := range sp.nameIDFormats() {
+			if format == equivalentNameIDFormat(declaredFormat) {
+				return nil
+			}
+		}
+	}
+	return ErrNameIDFormatMismatch
+}
+
+// saml11NameIDFormats maps the NameID formats that SAML 2.0 inherits from
+// SAML 1.1, and that IDPs such as ADFS send with their SAML 1.1 URIs, to
+// the URIs of the equivalent formats that this package uses.
+var saml11NameIDFormats = map[NameIDFormat]NameIDFormat{
+	"urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified":  UnspecifiedNameIDFormat,
+	"urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress": EmailAddressNameIDFormat,
+}
+
+// equivalentNameIDFormat returns the format that NameIDFormatPolicy treats
+// format as.
+func equivalentNameIDFormat(format NameIDFormat) NameIDFormat {
+	if equivalent, ok := saml11NameIDFormats[format]; ok {
+		return equivalent
+	}
+	return format
+}
+
+// validateIssuerFormat returns an error if sp.ValidateIssuerFormat is set
+// and issuer has a Format other than EntityNameIDFormat.
+func (sp *ServiceProvider) validateIssuerFormat(issuer *Issuer) error {
+	if !sp.ValidateIssuerFormat || issuer.Format == "" {
+		return nil
+	}
+	if issuer.Format != string(EntityNameIDFormat) {
+		return fmt.Errorf("issuer format is not %q", EntityNameIDFormat)
 	}
 	return nil
 }
 
 func findChild(parentEl *etree.Element, childNS string, childTag string) (*etree.Element, error) {
+	children, err := findChildren(parentEl, childNS, childTag)
+	if err != nil || len(children) == 0 {
+		return nil, err
+	}
+	return children[0], nil
+}
+
+// declareContextNamespaces declares on el, the root element of a decrypted
+// assertion, the namespace prefixes that are in scope at contextEl, the
+// EncryptedAssertion that it replaces, and that el does not declare itself.
+// It reports whether it declared any.
+//
+// An element is encrypted without the namespace declarations of its
+// ancestors, so an assertion that uses a prefix that the IDP declared on
+// the Response, for example an Assertion with the saml2 prefix in a
+// Response whose Issuer has the saml prefix, cannot be parsed on its own.
+// Since the exclusive canonicalization that signatures use includes only
+// the declarations of the prefixes that are used, this does not change the
+// bytes that the signature of the assertion covers. A signature that uses
+// inclusive canonicalization, which includes every declaration in scope,
+// remains valid only if the IDP declared the same namespaces in the same
+// places when it signed the assertion.
+func declareContextNamespaces(el, contextEl *etree.Element) (bool, error) {
+	ctx, err := etreeutils.NSBuildParentContext(contextEl)
+	if err != nil {
+		return false, err
+	}
+	ctx, err = ctx.SubContext(contextEl)
+	if err != nil {
+		return false, err
+	}
+	// the prefixes el declares, including "" for the default namespace
+	own := map[string]bool{"xml": true, "xmlns": true}
+	for _, attr := range el.Attr {
+		switch {
+		case attr.Space == "xmlns":
+			own[attr.Key] = true
+		case attr.Space == "" && attr.Key == "xmlns":
+			own[""] = true
+		}
+	}
+
+	prefixes := ctx.Prefixes()
+	names := make([]string, 0, len(prefixes))
+	for prefix, namespace := range prefixes {
+		if own[prefix] || (prefix == "" && namespace == etreeutils.XMLNamespace) {
+			continue
+		}
+		names = append(names, prefix)
+	}
+	sort.Strings(names)
+	for _, prefix := range names {
+		if prefix == "" {
+			el.CreateAttr("xmlns", prefixes[prefix])
+		} else {
+			el.CreateAttr("xmlns:"+prefix, prefixes[prefix])
+		}
+	}
+	return len(names) > 0, nil
+}
+
+// findChildren returns the children of parentEl with the specified namespace and tag.
+func findChildren(parentEl *etree.Element, childNS string, childTag string) ([]*etree.Element, error) {
+	var children []*etree.Element
 	for _, childEl := range parentEl.ChildElements() {
 		if childEl.Tag != childTag {
 			continue
@@ -568,9 +2108,138 @@ func findChild(parentEl *etree.Element, childNS string, childTag string) (*etree
 			continue
 		}
 
-		return childEl, nil
+		children = append(children, childEl)
+	}
+	return children, nil
+}
+
+// ErrNoAssertion is returned when a response whose status is Success does
+// not contain an assertion.
+var ErrNoAssertion = errors.New("response has a Success status but does not contain an assertion")
+
+// ErrNoAuthnStatement is returned when the assertions of a response do not
+// contain an AuthnStatement, unless AllowMissingAuthnStatement is set.
+var ErrNoAuthnStatement = errors.New("assertion does not contain an AuthnStatement")
+
+// ErrNoConditions is returned when an assertion does not contain a
+// Conditions element, unless AllowMissingConditions is set.
+var ErrNoConditions = errors.New("assertion does not contain Conditions")
+
+// ErrNameIDFormatMismatch is returned when the NameID of an assertion does
+// not have the format that was requested, as checked according to
+// NameIDFormatPolicy.
+var ErrNameIDFormatMismatch = errors.New("NameID format does not match the requested format")
+
+// ErrNoIssuer is returned when neither an assertion nor the response that
+// carries it has an Issuer.
+var ErrNoIssuer = errors.New("neither the assertion nor the response has an Issuer")
+
+// ErrNoAssertionIssuer is returned when an assertion does not have an
+// Issuer and RequireAssertionIssuer is set.
+var ErrNoAssertionIssuer = errors.New("assertion does not have an Issuer")
+
+// ErrNoValidSubjectConfirmation is returned when an assertion has no Subject or
+// the Subject has no bearer SubjectConfirmation.
+var ErrNoValidSubjectConfirmation = errors.New("assertion does not contain a bearer SubjectConfirmation")
+
+// ErrNoSubjectConfirmationData is returned when a bearer SubjectConfirmation
+// does not contain SubjectConfirmationData. Without it, nothing binds the
+// assertion to the request it answers or to this service provider.
+var ErrNoSubjectConfirmationData = errors.New("bearer SubjectConfirmation does not contain SubjectConfirmationData")
+
+// ErrIncompleteSubjectConfirmationData is returned when the
+// SubjectConfirmationData of a bearer SubjectConfirmation lacks a Recipient or
+// a NotOnOrAfter attribute, which SAMLProfiles requires of it.
+var ErrIncompleteSubjectConfirmationData = errors.New("bearer SubjectConfirmationData must have a Recipient and a NotOnOrAfter attribute")
+
+// ErrSubjectConfirmationNotBefore is returned when a bearer
+// SubjectConfirmationData has a NotBefore attribute and
+// SubjectConfirmationNotBefore is RejectSubjectConfirmationNotBefore.
+var ErrSubjectConfirmationNotBefore = errors.New("bearer SubjectConfirmationData must not have a NotBefore attribute")
+
+// validateSubject returns nil iff subject has at least one bearer
+// SubjectConfirmation whose SubjectConfirmationData is valid. If every bearer
+// SubjectConfirmation is invalid, the reason the last one was rejected is returned.
+func (sp *ServiceProvider) validateSubject(subject *Subject, possibleRequestIDs []string, scheme string, now time.Time) error {
+	if subject == nil {
+		return ErrNoValidSubjectConfirmation
+	}
+
+	err := ErrNoValidSubjectConfirmation
+	for _, subjectConfirmation := range subject.SubjectConfirmations {
+		if subjectConfirmation.Method != "urn:oasis:names:tc:SAML:2.0:cm:bearer" {
+			continue
+		}
+		err = sp.validateSubjectConfirmationData(subjectConfirmation.SubjectConfirmationData, possibleRequestIDs, scheme, now)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// validateSubjectAddress returns an error if the SubjectConfirmationData
+// of subject has an Address that is not clientIP.
+func validateSubjectAddress(subject *Subject, clientIP string) error {
+	if subject == nil {
+		return nil
+	}
+	for _, subjectConfirmation := range subject.SubjectConfirmations {
+		data := subjectConfirmation.SubjectConfirmationData
+		if data == nil || data.Address == "" {
+			continue
+		}
+		if clientIP == "" || hostIP(data.Address) != clientIP {
+			return fmt.Errorf("SubjectConfirmationData Address %q does not match the client address %q", data.Address, clientIP)
+		}
 	}
-	return nil, nil
+	return nil
+}
+
+// isACSURL returns true if rawURL is AcsURL or one of AllowedACSURLs, or,
+// if scheme is not empty, one of them with its scheme replaced by scheme.
+func (sp *ServiceProvider) isACSURL(rawURL string, scheme string) bool {
+	for _, acsURL := range append([]url.URL{sp.AcsURL}, sp.AllowedACSURLs...) {
+		if rawURL == acsURL.String() {
+			return true
+		}
+		if scheme != "" {
+			acsURL.Scheme = scheme
+			if rawURL == acsURL.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (sp *ServiceProvider) validateSubjectConfirmationData(data *SubjectConfirmationData, possibleRequestIDs []string, scheme string, now time.Time) error {
+	if data == nil {
+		return ErrNoSubjectConfirmationData
+	}
+	if data.Recipient == "" || data.NotOnOrAfter.IsZero() {
+		return ErrIncompleteSubjectConfirmationData
+	}
+	requestIDvalid := false
+	for _, possibleRequestID := range possibleRequestIDs {
+		if constantTimeEqual(data.InResponseTo, possibleRequestID) {
+			requestIDvalid = true
+			break
+		}
+	}
+	if !requestIDvalid {
+		return fmt.Errorf("SubjectConfirmation one of the possible request IDs (%v)", possibleRequestIDs)
+	}
+	if !sp.isACSURL(data.Recipient, scheme) {
+		return fmt.Errorf("SubjectConfirmation Recipient is not %s", sp.AcsURL.String())
+	}
+	if data.NotOnOrAfter.Add(MaxClockSkew).Before(now) {
+		return fmt.Errorf("SubjectConfirmationData is expired")
+	}
+	if !data.NotBefore.IsZero() && sp.SubjectConfirmationNotBefore == RejectSubjectConfirmationNotBefore {
+		return ErrSubjectConfirmationNotBefore
+	}
+	return nil
 }
 
 // validateSigned returns a nil error iff each of the signatures on the Response and Assertion elements
@@ -580,33 +2249,58 @@ func (sp *ServiceProvider) validateSigned(responseEl *etree.Element) error {
 
 	// Some SAML responses have the signature on the Response object, and some on the Assertion
 	// object, and some on both. We will require that at least one signature be present and that
-	// all signatures be valid
+	// all signatures be valid. When there are several assertions, each must be covered by a
+	// signature, either its own or the Response's.
 	sigEl, err := findChild(responseEl, "http://www.w3.org/2000/09/xmldsig#", "Signature")
 	if err != nil {
 		return err
 	}
+	responseSigned := false
 	if sigEl != nil {
+		if err = validateSignatureReference(responseEl, sigEl); err != nil {
+			return err
+		}
 		if err = sp.validateSignature(responseEl); err != nil {
+			if _, ok := err.(*StaleMetadataError); ok {
+				return err
+			}
 			return fmt.Errorf("cannot validate signature on Response: %v", err)
 		}
+		if err = sp.validateSignatureAlgorithms(sigEl); err != nil {
+			return err
+		}
 		haveSignature = true
+		responseSigned = true
 	}
 
-	assertionEl, err := findChild(responseEl, "urn:oasis:names:tc:SAML:2.0:assertion", "Assertion")
+	assertionEls, err := findChildren(responseEl, "urn:oasis:names:tc:SAML:2.0:assertion", "Assertion")
 	if err != nil {
 		return err
 	}
-	if assertionEl != nil {
+	for _, assertionEl := range assertionEls {
 		sigEl, err := findChild(assertionEl, "http://www.w3.org/2000/09/xmldsig#", "Signature")
 		if err != nil {
 			return err
 		}
-		if sigEl != nil {
-			if err = sp.validateSignature(assertionEl); err != nil {
-				return fmt.Errorf("cannot validate signature on Response: %v", err)
+		if sigEl == nil {
+			if !responseSigned {
+				return errors.New("either the Response or Assertion must be signed")
 			}
-			haveSignature = true
+			continue
+		}
+		if err = validateSignatureReference(assertionEl, sigEl); err != nil {
+			return err
+		}
+		if err = sp.validateSignature(assertionEl); err != nil {
+			if _, ok := err.(*StaleMetadataError); ok {
+				return err
+			}
+			return fmt.Errorf("cannot validate signature on Response: %v", err)
 		}
+		if err = sp.validateSignatureAlgorithms(sigEl); err != nil {
+			return err
+		}
+		haveSignature = true
 	}
 
 	if !haveSignature {
@@ -615,13 +2309,319 @@ func (sp *ServiceProvider) validateSigned(responseEl *etree.Element) error {
 	return nil
 }
 
-// validateSignature returns nill iff the Signature embedded in the element is valid
+// removeComments removes the XML comments within el, or returns an error
+// if there are any and sp.RejectXMLComments is set.
+//
+// The exclusive canonicalization used by signatures omits comments, so a
+// comment can be inserted into signed text without invalidating the
+// signature. For example a NameID of "user@example.com.evil.com" can be made
+// to read as "user@example.com" by a parser that stops at the comment in
+// "user@example.com<!---->.evil.com". encoding/xml, which reads the values
+// of the assertion, concatenates all of the text, as the signature does.
+func (sp *ServiceProvider) removeComments(el *etree.Element) error {
+	children := append([]etree.Token(nil), el.Child...)
+	for _, token := range children {
+		switch token := token.(type) {
+		case *etree.Comment:
+			if sp.RejectXMLComments {
+				return errors.New("response contains an XML comment")
+			}
+			el.RemoveChild(token)
+		case *etree.Element:
+			if err := sp.removeComments(token); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// timestampAttributes are the attributes of SAML elements whose values are
+// xs:dateTime timestamps.
+var timestampAttributes = []string{"IssueInstant", "NotBefore", "NotOnOrAfter", "AuthnInstant", "SessionNotOnOrAfter"}
+
+func isTimestampAttribute(name string) bool {
+	for _, n := range timestampAttributes {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// utcTimestampRegexp matches an xs:dateTime in UTC, with optional fractional
+// seconds.
+var utcTimestampRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?Z$`)
+
+// validateTimestamps returns a *TimestampError for the first timestamp
+// within el that is not an xs:dateTime in UTC, if sp.RequireUTCTimestamps
+// is set.
+func (sp *ServiceProvider) validateTimestamps(el *etree.Element) error {
+	if !sp.RequireUTCTimestamps {
+		return nil
+	}
+	for _, attr := range el.Attr {
+		if attr.Space != "" || !isTimestampAttribute(attr.Key) {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, attr.Value); err != nil || !utcTimestampRegexp.MatchString(attr.Value) {
+			return &TimestampError{Element: el.Tag, Attribute: attr.Key, Value: attr.Value}
+		}
+	}
+	for _, child := range el.ChildElements() {
+		if err := sp.validateTimestamps(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errSignatureWrapping prefixes the errors that indicate an XML signature
+// wrapping attack, in which a signed element is moved to where it is not
+// used and replaced by a forged one.
+var errSignatureWrapping = errors.New("possible signature wrapping attack")
+
+// validateNotWrapped checks the structure of a Response, or of a decrypted
+// Assertion, for signs of signature wrapping. Every ID in the document must
+// be unique, so that a signature reference identifies a single element, and
+// Assertions may only appear as children of the Response or within the
+// Advice of another assertion, where they are not used. Assertions anywhere
+// else, such as in Extensions or in the Object of a Signature, are rejected.
+func validateNotWrapped(rootEl *etree.Element) error {
+	ids := map[string]bool{}
+	var walk func(el, parentEl *etree.Element) error
+	walk = func(el, parentEl *etree.Element) error {
+		if id := el.SelectAttrValue("ID", ""); id != "" {
+			if ids[id] {
+				return fmt.Errorf("%s: duplicate ID %q", errSignatureWrapping, id)
+			}
+			ids[id] = true
+		}
+		if el.Tag == "Assertion" && parentEl != nil && parentEl != rootEl && parentEl.Tag != "Advice" {
+			return fmt.Errorf("%s: Assertion found within %s", errSignatureWrapping, parentEl.Tag)
+		}
+		for _, childEl := range el.ChildElements() {
+			if err := walk(childEl, el); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(rootEl, nil)
+}
+
+// validateSignatureReference returns an error unless the signature sigEl
+// of el refers to el itself by its ID.
+func validateSignatureReference(el, sigEl *etree.Element) error {
+	referenceEls := sigEl.FindElements("./SignedInfo/Reference")
+	if len(referenceEls) != 1 {
+		return fmt.Errorf("%s: signature has %d references, expected 1", errSignatureWrapping, len(referenceEls))
+	}
+	uri := referenceEls[0].SelectAttrValue("URI", "")
+	if id := el.SelectAttrValue("ID", ""); id == "" || uri != "#"+id {
+		return fmt.Errorf("%s: signature of %s %q references %q", errSignatureWrapping, el.Tag, id, uri)
+	}
+	return nil
+}
+
+// resolveEncryptedKey returns the EncryptedData element el of
+// encryptedAssertionEl with the EncryptedKey that holds its key placed in
+// its KeyInfo, which is where xmlenc.Decrypt looks for it.
+//
+// The SAML specification also allows the EncryptedKey to be a sibling of
+// the EncryptedData, as some IDPs, such as Azure AD, produce. Other IDPs
+// place a single EncryptedKey in the Response, responseEl, to be shared by
+// the EncryptedData of each of its EncryptedAssertions. Such a key is
+// found, among those of encryptedAssertionEl and then those of responseEl,
+// by the RetrievalMethod in the KeyInfo of el if there is one, and
+// otherwise by its DataReference to el or its Recipient. In that case, a
+// copy of el is returned and the document is not modified.
+func (sp *ServiceProvider) resolveEncryptedKey(responseEl, encryptedAssertionEl, el *etree.Element) (*etree.Element, error) {
+	if el.FindElement("./KeyInfo/EncryptedKey") != nil {
+		return el, nil
+	}
+	encryptedKeyEls := append(encryptedAssertionEl.FindElements("./EncryptedKey"),
+		responseEl.FindElements("./EncryptedKey")...)
+
+	var encryptedKeyEl *etree.Element
+	if retrievalMethodEl := el.FindElement("./KeyInfo/RetrievalMethod"); retrievalMethodEl != nil {
+		uri := retrievalMethodEl.SelectAttrValue("URI", "")
+		for _, candidateEl := range encryptedKeyEls {
+			if id := candidateEl.SelectAttrValue("Id", ""); id != "" && uri == "#"+id {
+				encryptedKeyEl = candidateEl
+				break
+			}
+		}
+		if encryptedKeyEl == nil {
+			return nil, fmt.Errorf("cannot find the EncryptedKey %q referenced by the RetrievalMethod", uri)
+		}
+	} else {
+		dataURI := "#" + el.SelectAttrValue("Id", "")
+		entityID := sp.Metadata().EntityID
+		for _, candidateEl := range encryptedKeyEls {
+			if referenceEls := candidateEl.FindElements("./ReferenceList/DataReference"); len(referenceEls) > 0 {
+				referenced := false
+				for _, referenceEl := range referenceEls {
+					if referenceEl.SelectAttrValue("URI", "") == dataURI {
+						referenced = true
+					}
+				}
+				if !referenced {
+					continue
+				}
+			}
+			if recipient := candidateEl.SelectAttrValue("Recipient", ""); recipient != "" && recipient != entityID {
+				continue
+			}
+			encryptedKeyEl = candidateEl
+			break
+		}
+		if encryptedKeyEl == nil {
+			return el, nil
+		}
+	}
+
+	el = el.Copy()
+	keyInfoEl := el.FindElement("./KeyInfo")
+	if keyInfoEl == nil {
+		keyInfoEl = el.CreateElement("ds:KeyInfo")
+		keyInfoEl.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
+	}
+	if retrievalMethodEl := keyInfoEl.FindElement("./RetrievalMethod"); retrievalMethodEl != nil {
+		keyInfoEl.RemoveChild(retrievalMethodEl)
+	}
+	keyInfoEl.AddChild(encryptedKeyEl.Copy())
+	return el, nil
+}
+
+// decryptEncryptedData decrypts the EncryptedData element el with the key
+// in the EncryptedKey in its KeyInfo, if there is one. The keys decrypted
+// from EncryptedKeys are kept in symmetricKeys by their ciphertext, so that
+// an EncryptedKey that is shared by several EncryptedData elements is only
+// decrypted once.
+func (sp *ServiceProvider) decryptEncryptedData(el *etree.Element, symmetricKeys map[string][]byte) ([]byte, error) {
+	encryptedKeyEl := el.FindElement("./KeyInfo/EncryptedKey")
+	if encryptedKeyEl == nil {
+		return xmlenc.Decrypt(sp.encryptionKey(), el)
+	}
+	cipherValueEl := encryptedKeyEl.FindElement("./CipherData/CipherValue")
+	if cipherValueEl == nil {
+		return nil, fmt.Errorf("EncryptedKey does not contain a CipherValue")
+	}
+	cipherValue := strings.Join(strings.Fields(cipherValueEl.Text()), "")
+	key, ok := symmetricKeys[cipherValue]
+	if !ok {
+		var err error
+		key, err = xmlenc.Decrypt(sp.encryptionKey(), encryptedKeyEl)
+		if err != nil {
+			return nil, err
+		}
+		symmetricKeys[cipherValue] = key
+	}
+
+	el = el.Copy()
+	keyInfoEl := el.FindElement("./KeyInfo")
+	keyInfoEl.RemoveChild(keyInfoEl.FindElement("./EncryptedKey"))
+	return xmlenc.Decrypt(key, el)
+}
+
+// validateEncryptionAlgorithms returns an AlgorithmNotAllowedError if the
+// EncryptedData element el, or the EncryptedKey within it, is encrypted with
+// an algorithm that sp does not advertise in its metadata.
+func (sp *ServiceProvider) validateEncryptionAlgorithms(el *etree.Element) error {
+	if err := validateEncryptionMethod(el, sp.dataEncryptionAlgorithms()); err != nil {
+		return err
+	}
+	if encryptedKeyEl := el.FindElement("./KeyInfo/EncryptedKey"); encryptedKeyEl != nil {
+		return validateEncryptionMethod(encryptedKeyEl, sp.keyTransportAlgorithms())
+	}
+	return nil
+}
+
+func validateEncryptionMethod(el *etree.Element, allowed []string) error {
+	algorithm := ""
+	if methodEl := el.FindElement("./EncryptionMethod"); methodEl != nil {
+		algorithm = methodEl.SelectAttrValue("Algorithm", "")
+	}
+	if !containsString(allowed, algorithm) {
+		return &AlgorithmNotAllowedError{Method: "EncryptionMethod", Algorithm: algorithm}
+	}
+	return nil
+}
+
+// validateSignatureAlgorithms returns an AlgorithmNotAllowedError if the
+// signature sigEl uses an algorithm that is not allowed by
+// sp.AllowedSignatureMethods or sp.AllowedDigestMethods.
+func (sp *ServiceProvider) validateSignatureAlgorithms(sigEl *etree.Element) error {
+	checks := []struct {
+		Path    string
+		Allowed []string
+	}{
+		{"./SignedInfo/SignatureMethod", sp.AllowedSignatureMethods},
+		{"./SignedInfo/Reference/DigestMethod", sp.AllowedDigestMethods},
+	}
+	for _, check := range checks {
+		if len(check.Allowed) == 0 {
+			continue
+		}
+		for _, methodEl := range sigEl.FindElements(check.Path) {
+			algorithm := methodEl.SelectAttrValue("Algorithm", "")
+			if !containsString(check.Allowed, algorithm) {
+				return &AlgorithmNotAllowedError{Method: methodEl.Tag, Algorithm: algorithm}
+			}
+		}
+	}
+	return nil
+}
+
+// validateSignature returns nill iff the Signature embedded in the element is valid.
+// The signing certificate in the IDP metadata is tried first, then the other
+// signing certificates in the IDP metadata, then those of
+// PreviousIDPCertificates that are still trusted. Trying each of them matters
+// most when the Signature has no KeyInfo, since nothing in the response then
+// says which of them signed it.
 func (sp *ServiceProvider) validateSignature(el *etree.Element) error {
 	cert, err := sp.getIDPSigningCert()
 	if err != nil {
 		return err
 	}
 
+	now := TimeNow()
+	if Clock != nil {
+		now = Clock.Now()
+	}
+	if now.After(cert.NotAfter) {
+		err = &StaleMetadataError{EntityID: sp.IDPMetadata.EntityID, NotAfter: cert.NotAfter}
+	} else {
+		err = validateSignatureWithCert(el, cert)
+	}
+	if err == nil {
+		return nil
+	}
+	if certs, certsErr := sp.IDPMetadata.SigningCertificates(); certsErr == nil {
+		for _, other := range certs {
+			if other.Equal(cert) || now.After(other.NotAfter) {
+				continue
+			}
+			if validateSignatureWithCert(el, other) == nil {
+				return nil
+			}
+		}
+	}
+	for _, previous := range sp.PreviousIDPCertificates {
+		if previous.Certificate == nil || !now.Before(previous.Until) {
+			continue
+		}
+		if validateSignatureWithCert(el, previous.Certificate) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// validateSignatureWithCert returns nil iff the Signature embedded in the
+// element is valid and made with the key of cert.
+func validateSignatureWithCert(el *etree.Element, cert *x509.Certificate) error {
 	certificateStore := dsig.MemoryX509CertificateStore{
 		Roots: []*x509.Certificate{cert},
 	}
@@ -2,7 +2,10 @@ package saml
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
 	"time"
+	"unicode"
 
 	dsig "github.com/russellhaering/goxmldsig"
 )
@@ -20,6 +23,29 @@ var Clock *dsig.Clock
 // rand.Reader, but it can be replaced for testing.
 var RandReader = rand.Reader
 
+// NewID returns a new random ID, suitable for the ID attribute of a SAML
+// message.
+func NewID() string {
+	return fmt.Sprintf("id-%x", randomBytes(20))
+}
+
+// isNCName returns true if s is a valid XML NCName, as required of the
+// values of ID attributes.
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func randomBytes(n int) []byte {
 	rv := make([]byte, n)
 	if _, err := RandReader.Read(rv); err != nil {
@@ -27,3 +53,20 @@ func randomBytes(n int) []byte {
 	}
 	return rv
 }
+
+// constantTimeEqual returns true if a and b are equal. The time taken is
+// independent of the contents of a and b, so it is suitable for comparing
+// security sensitive values such as request IDs.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// containsString returns true if s is one of values.
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package saml
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// WarningCode identifies the kind of a Warning.
+type WarningCode string
+
+// Values for WarningCode
+const (
+	// WarningAssertionNotSigned means that an assertion was accepted because
+	// the Response containing it was signed, but the assertion itself was not.
+	WarningAssertionNotSigned WarningCode = "AssertionNotSigned"
+
+	// WarningWeakSignatureAlgorithm means that a signature uses SHA-1, either
+	// as its digest method or as part of its signature method.
+	WarningWeakSignatureAlgorithm WarningCode = "WeakSignatureAlgorithm"
+
+	// WarningClockSkew means that a time constraint of the assertion was
+	// satisfied only because of the allowance of MaxClockSkew.
+	WarningClockSkew WarningCode = "ClockSkew"
+
+	// WarningSubjectConfirmationNotBefore means that a bearer
+	// SubjectConfirmationData has a NotBefore attribute, which the Web
+	// Browser SSO profile forbids. See SubjectConfirmationNotBeforePolicy.
+	WarningSubjectConfirmationNotBefore WarningCode = "SubjectConfirmationNotBefore"
+)
+
+// Warning describes a property of a response that ParseResponseWithWarnings
+// accepted, but that a stricter policy might reject.
+type Warning struct {
+	Code    WarningCode
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Code, w.Message)
+}
+
+// weakSignatureAlgorithms are the SignatureMethod and DigestMethod
+// algorithms that produce a WarningWeakSignatureAlgorithm.
+var weakSignatureAlgorithms = map[string]bool{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1": true,
+	"http://www.w3.org/2000/09/xmldsig#dsa-sha1": true,
+	"http://www.w3.org/2000/09/xmldsig#sha1":     true,
+}
+
+// signatureWarnings returns the warnings for the signatures of el, which is
+// either a Response that has passed validateSigned or an Assertion.
+func signatureWarnings(el *etree.Element) []Warning {
+	warnings := signatureAlgorithmWarnings(el)
+	if el.Tag == "Assertion" {
+		return warnings
+	}
+	for _, assertionEl := range el.SelectElements("Assertion") {
+		if assertionEl.SelectElement("Signature") == nil {
+			warnings = append(warnings, Warning{
+				Code:    WarningAssertionNotSigned,
+				Message: fmt.Sprintf("assertion %q is not signed", assertionEl.SelectAttrValue("ID", "")),
+			})
+			continue
+		}
+		warnings = append(warnings, signatureAlgorithmWarnings(assertionEl)...)
+	}
+	return warnings
+}
+
+// signatureAlgorithmWarnings returns the warnings for the algorithms of the
+// signature of el, if it has one.
+func signatureAlgorithmWarnings(el *etree.Element) []Warning {
+	sigEl := el.SelectElement("Signature")
+	if sigEl == nil {
+		return nil
+	}
+	var warnings []Warning
+	for _, path := range []string{"./SignedInfo/SignatureMethod", "./SignedInfo/Reference/DigestMethod"} {
+		for _, methodEl := range sigEl.FindElements(path) {
+			algorithm := methodEl.SelectAttrValue("Algorithm", "")
+			if weakSignatureAlgorithms[algorithm] {
+				warnings = append(warnings, Warning{
+					Code:    WarningWeakSignatureAlgorithm,
+					Message: fmt.Sprintf("%s of %s %q is %s", methodEl.Tag, el.Tag, el.SelectAttrValue("ID", ""), algorithm),
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+// clockSkewWarnings returns the warnings for the time constraints of a valid
+// assertion that hold only because of MaxClockSkew.
+func clockSkewWarnings(assertion *Assertion, now time.Time) []Warning {
+	var warnings []Warning
+	skewed := func(what string, t time.Time) {
+		warnings = append(warnings, Warning{
+			Code:    WarningClockSkew,
+			Message: fmt.Sprintf("%s is %s, but the time is %s", what, t.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano)),
+		})
+	}
+	if conditions := assertion.Conditions; conditions != nil {
+		if conditions.NotBefore.After(now) {
+			skewed("Conditions NotBefore", conditions.NotBefore)
+		}
+		if !conditions.NotOnOrAfter.IsZero() && !conditions.NotOnOrAfter.After(now) {
+			skewed("Conditions NotOnOrAfter", conditions.NotOnOrAfter)
+		}
+	}
+	if subject := assertion.Subject; subject != nil {
+		for _, subjectConfirmation := range subject.SubjectConfirmations {
+			data := subjectConfirmation.SubjectConfirmationData
+			if data != nil && !data.NotOnOrAfter.IsZero() && !data.NotOnOrAfter.After(now) {
+				skewed("SubjectConfirmationData NotOnOrAfter", data.NotOnOrAfter)
+			}
+		}
+	}
+	return warnings
+}
+
+// subjectConfirmationWarnings returns the warnings for the bearer
+// SubjectConfirmations of a valid assertion that have a NotBefore.
+func subjectConfirmationWarnings(assertion *Assertion) []Warning {
+	if assertion.Subject == nil {
+		return nil
+	}
+	var warnings []Warning
+	for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
+		data := subjectConfirmation.SubjectConfirmationData
+		if subjectConfirmation.Method != "urn:oasis:names:tc:SAML:2.0:cm:bearer" || data == nil || data.NotBefore.IsZero() {
+			continue
+		}
+		warnings = append(warnings, Warning{
+			Code:    WarningSubjectConfirmationNotBefore,
+			Message: fmt.Sprintf("bearer SubjectConfirmationData has NotBefore %s", data.NotBefore.Format(time.RFC3339Nano)),
+		})
+	}
+	return warnings
+}
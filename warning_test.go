@@ -0,0 +1,96 @@
+package saml
+
+import (
+	"time"
+
+	"github.com/beevik/etree"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&WarningTest{})
+
+type WarningTest struct {
+}
+
+func (test *WarningTest) TestSignatureWarnings(c *C) {
+	doc := etree.NewDocument()
+	err := doc.ReadFromString(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" ID="response">` +
+		`<ds:Signature><ds:SignedInfo>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`<ds:Reference URI="#response"><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/></ds:Reference>` +
+		`</ds:SignedInfo></ds:Signature>` +
+		`<saml:Assertion ID="unsigned"/>` +
+		`<saml:Assertion ID="signed"><ds:Signature><ds:SignedInfo>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2000/09/xmldsig#rsa-sha1"/>` +
+		`<ds:Reference URI="#signed"><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/></ds:Reference>` +
+		`</ds:SignedInfo></ds:Signature></saml:Assertion>` +
+		`</samlp:Response>`)
+	c.Assert(err, IsNil)
+
+	c.Assert(signatureWarnings(doc.Root()), DeepEquals, []Warning{
+		{
+			Code:    WarningAssertionNotSigned,
+			Message: "assertion \"unsigned\" is not signed",
+		},
+		{
+			Code:    WarningWeakSignatureAlgorithm,
+			Message: "SignatureMethod of Assertion \"signed\" is http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+		},
+	})
+}
+
+func (test *WarningTest) TestClockSkewWarnings(c *C) {
+	now := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	assertion := &Assertion{
+		Conditions: &Conditions{
+			NotBefore:    now.Add(-time.Minute),
+			NotOnOrAfter: now.Add(time.Minute),
+		},
+		Subject: &Subject{
+			SubjectConfirmations: []SubjectConfirmation{
+				{SubjectConfirmationData: &SubjectConfirmationData{NotOnOrAfter: now.Add(time.Minute)}},
+			},
+		},
+	}
+	c.Assert(clockSkewWarnings(assertion, now), HasLen, 0)
+
+	assertion.Conditions.NotBefore = now.Add(time.Second)
+	assertion.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotOnOrAfter = now
+	c.Assert(clockSkewWarnings(assertion, now), DeepEquals, []Warning{
+		{
+			Code:    WarningClockSkew,
+			Message: "Conditions NotBefore is 2015-12-01T01:57:10Z, but the time is 2015-12-01T01:57:09Z",
+		},
+		{
+			Code:    WarningClockSkew,
+			Message: "SubjectConfirmationData NotOnOrAfter is 2015-12-01T01:57:09Z, but the time is 2015-12-01T01:57:09Z",
+		},
+	})
+}
+
+func (test *WarningTest) TestSubjectConfirmationWarnings(c *C) {
+	notBefore := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	assertion := &Assertion{
+		Subject: &Subject{
+			SubjectConfirmations: []SubjectConfirmation{
+				{
+					Method:                  "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+					SubjectConfirmationData: &SubjectConfirmationData{},
+				},
+				{
+					Method:                  "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key",
+					SubjectConfirmationData: &SubjectConfirmationData{NotBefore: notBefore},
+				},
+			},
+		},
+	}
+	c.Assert(subjectConfirmationWarnings(assertion), HasLen, 0)
+
+	assertion.Subject.SubjectConfirmations[0].SubjectConfirmationData.NotBefore = notBefore
+	c.Assert(subjectConfirmationWarnings(assertion), DeepEquals, []Warning{
+		{
+			Code:    WarningSubjectConfirmationNotBefore,
+			Message: "bearer SubjectConfirmationData has NotBefore 2015-12-01T01:57:09Z",
+		},
+	})
+}
@@ -104,17 +104,18 @@ func (e RSA) Decrypt(key interface{}, ciphertextEl *etree.Element) ([]byte, erro
 		return nil, err
 	}
 
-	{
-		digestMethodEl := ciphertextEl.FindElement("./EncryptionMethod/DigestMethod")
-		if digestMethodEl == nil {
-			return nil, fmt.Errorf("cannot find required DigestMethod element")
-		}
-		hashAlgorithmStr := digestMethodEl.SelectAttrValue("Algorithm", "")
-		digestMethod, ok := digestMethods[hashAlgorithmStr]
-		if !ok {
-			return nil, ErrAlgorithmNotImplemented(hashAlgorithmStr)
+	// PKCS1v15 does not use a digest method. For OAEP it is optional and
+	// defaults to SHA-1.
+	if e.DigestMethod != nil {
+		e.DigestMethod = SHA1
+		if digestMethodEl := ciphertextEl.FindElement("./EncryptionMethod/DigestMethod"); digestMethodEl != nil {
+			hashAlgorithmStr := digestMethodEl.SelectAttrValue("Algorithm", "")
+			digestMethod, ok := digestMethods[hashAlgorithmStr]
+			if !ok {
+				return nil, ErrAlgorithmNotImplemented(hashAlgorithmStr)
+			}
+			e.DigestMethod = digestMethod
 		}
-		e.DigestMethod = digestMethod
 	}
 
 	return e.keyDecrypter(e, rsaKey, ciphertext)
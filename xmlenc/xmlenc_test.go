@@ -1,6 +1,7 @@
 package xmlenc
 
 import (
+	"encoding/base64"
 	"io/ioutil"
 	"math/rand"
 
@@ -58,6 +59,31 @@ func (test *TestFoo) TestDataAES128CBC(c *C) {
 	}
 }
 
+func (test *TestFoo) TestDataAESGCM(c *C) {
+	plaintext, err := ioutil.ReadFile("test_data/encrypt-data-aes128-cbc.data")
+	c.Assert(err, IsNil)
+
+	for _, blockCipher := range []BlockCipher{AES128GCM, AES192GCM, AES256GCM} {
+		key := []byte("abcdefghijklmnopqrstuvwxyz012345")[:blockCipher.KeySize()]
+		cipherEl, err := blockCipher.Encrypt(key, plaintext)
+		c.Assert(err, IsNil)
+		c.Assert(cipherEl.FindElement("./EncryptionMethod").SelectAttrValue("Algorithm", ""), Equals, blockCipher.Algorithm())
+
+		actualPlaintext, err := Decrypt(key, cipherEl)
+		c.Assert(err, IsNil)
+		c.Assert(actualPlaintext, DeepEquals, plaintext)
+
+		// the authentication tag detects a modified ciphertext
+		cipherValueEl := cipherEl.FindElement("./CipherData/CipherValue")
+		ciphertext, err := base64.StdEncoding.DecodeString(cipherValueEl.Text())
+		c.Assert(err, IsNil)
+		ciphertext[len(ciphertext)/2] ^= 1
+		cipherValueEl.SetText(base64.StdEncoding.EncodeToString(ciphertext))
+		_, err = Decrypt(key, cipherEl)
+		c.Assert(err, ErrorMatches, "cipher: message authentication failed")
+	}
+}
+
 /*
 func (test *TestFoo) TestAES256CBC(c *C) {
 	doc := etree.NewDocument()